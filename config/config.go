@@ -1,10 +1,15 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sq325/cmdDaemon/internal/tool"
 	"gopkg.in/yaml.v2"
@@ -20,7 +25,25 @@ const (
 )
 
 var (
-	DefaultConfig = `cmds:
+	DefaultConfig = `defaults: # 所有cmd的默认配置, cmd中设置的同名字段优先
+  restartLimit: 5 # restartWindow内最大重启次数
+  restartWindow: 30m # 重启次数的滑动窗口
+  backoffBase: 1s # 重启间隔基数, 第n次重启间隔为backoffBase*2^n
+  backoffMax: 5m # 重启间隔上限
+  backoffJitter: full # 重启间隔抖动策略: none, full, decorrelated
+  resetAfter: 30m # 距上次重启超过resetAfter后重置重启间隔
+  cooldown: 10m # 超过重启限制后等待cooldown再尝试重启, 0表示不再重启
+  # log: # 子进程日志文件的轮转, 默认不轮转, cmd中的log可覆盖
+  #   maxSize: 100MB # 超过maxSize后轮转
+  #   rotateEvery: 24h # 每隔rotateEvery轮转
+  #   maxBackups: 7 # 保留的轮转文件数, 0表示全部保留
+  #   compress: true # gzip压缩轮转后的文件
+  #   split: true # stdout和stderr分别写入<日志文件>.stdout.log和<日志文件>.stderr.log
+  #   prefix: true # 每行前加RFC3339时间戳、流名称(stdout/stderr)和cmd名称
+# api: # 通过管理接口(--web.enable-admin-api)添加的cmd的限制
+#   allowUsers: [nobody] # 可以使用的user, 默认只允许守护进程自身的用户
+#   allowGroups: [nogroup] # 可以使用的group和groups, 默认只允许守护进程自身的组
+cmds:
   - cmd: ./cmd/prometheusLinux/prometheus
     args: 
       - --web.listen-address
@@ -38,18 +61,362 @@ var (
       hostname: "proxy-a" # 默认os.Hostname()
       ip: "12.12.12.12" # 默认/etc/hosts中根据hostname查找
       metricsPath: "/metrics" # 需填写，如果为""，表示该cmd不提供metrics
-      app: "xieCloud" # 应用名称, 用于区分不同应用的cmd`
+      app: "xieCloud" # 应用名称, 用于区分不同应用的cmd
+    restart: always # 重启策略: always(默认), on-failure, never
+    successExitCodes: [0] # on-failure时视为成功的退出码, 默认[0]
+    # restartLimit: 10 # 可覆盖defaults中的重启限制, restartWindow/backoffBase/backoffMax/backoffJitter/resetAfter/cooldown同理
+    # workDir: ./cmd/prometheusLinux # 工作目录, 相对路径的cmd基于workDir解析, 默认为守护进程的工作目录
+    # inheritEnv: true # 是否继承守护进程的环境变量, 默认true
+    # envFile: ./cmd/prometheusLinux/.env # KEY=VALUE格式的环境变量文件
+    # env: # 环境变量, 优先级: env > envFile > 继承的环境变量
+    #   GOMAXPROCS: "2"
+    # user: nobody # 运行cmd的用户名或uid, 需要守护进程以root运行, 默认为守护进程的用户
+    # group: nogroup # 运行cmd的组名或gid, 默认为user的主组, user为没有passwd条目的uid时必填
+    # groups: [] # 附加组, 默认为user的附加组
+    # umask: "022" # 八进制umask, 默认为守护进程的umask
+    # stopSignal: SIGTERM # 停止cmd时发送的信号, 默认SIGTERM
+    # stopTimeout: 10s # 发送stopSignal后等待cmd退出的时间, 超时后发送SIGKILL, 默认10s
+    # dependsOn: [] # 依赖的cmd名称(name注释), 依赖就绪后才启动, 退出时先于依赖停止
+    # healthCheck: # 主动健康检查, 连续失败failureThreshold次后重启cmd. 不配置探针时根据ip/port/metricsPath注释生成http或tcp探针
+    #   http:
+    #     url: http://127.0.0.1:9091/-/healthy
+    #     expectedStatus: 200 # 默认2xx或3xx
+    #   # tcp:
+    #   #   address: 127.0.0.1:9091
+    #   # exec:
+    #   #   cmd: ./check.sh
+    #   #   args: []
+    #   interval: 10s
+    #   timeout: 3s
+    #   failureThreshold: 3
+    #   startPeriod: 30s # 启动后startPeriod内的失败不计数
+    # critical: true # /ready要求所有critical的cmd就绪, 没有cmd配置critical时要求所有cmd就绪, 被停止或退出后不再重启的cmd除外
+    # log: # 覆盖defaults中的日志轮转配置
+    #   maxSize: 10MB
+    # logSink: # 同时发送输出到syslog或journald, 结构化字段包括name、app、port、hostname注释和stream
+    #   type: syslog # syslog(RFC5424)或journald(原生协议)
+    #   address: udp://10.0.0.1:514 # unix:///dev/log(默认)、udp://host:port或tcp://host:port. journald为socket路径, 默认/run/systemd/journal/socket
+    #   facility: local0 # syslog facility, 默认user
+    #   tag: prometheus # syslog APP-NAME或journald SYSLOG_IDENTIFIER, 默认name注释
+    #   file: true # 是否继续写日志文件, 默认true`
 )
 
+// RestartPolicy decides whether an exited cmd should be restarted
+type RestartPolicy string
+
+const (
+	RestartAlways    RestartPolicy = "always"     // 总是重启, 默认值
+	RestartOnFailure RestartPolicy = "on-failure" // 退出码不在successExitCodes中时重启
+	RestartNever     RestartPolicy = "never"      // 从不重启
+)
+
+// Default values of LimiterConf
+const (
+	DefaultRestartLimit  = 5
+	DefaultBackoffBase   = time.Second
+	DefaultResetAfter    = 30 * time.Minute
+	DefaultRestartWindow = 30 * time.Minute
+	DefaultBackoffMax    = 5 * time.Minute
+	DefaultBackoffJitter = JitterFull
+	DefaultCooldown      = 10 * time.Minute
+)
+
+// BackoffJitter is the jitter strategy of restart backoff
+type BackoffJitter string
+
+const (
+	JitterNone         BackoffJitter = "none"         // 不加抖动: min(backoffMax, backoffBase*2^n)
+	JitterFull         BackoffJitter = "full"         // 在[0, min(backoffMax, backoffBase*2^n)]中随机
+	JitterDecorrelated BackoffJitter = "decorrelated" // 在[backoffBase, 上次间隔*3]中随机, 不超过backoffMax
+)
+
+// LimiterConf 限制cmd的重启次数和重启间隔.
+// 0有含义的字段为指针, nil表示未设置, 显式设置的0不会被defaults覆盖
+type LimiterConf struct {
+	RestartLimit  *int           `yaml:"restartLimit"`  // restartWindow内最大重启次数, 默认5, 0表示不重启
+	RestartWindow time.Duration  `yaml:"restartWindow"` // 重启次数的滑动窗口, 默认30m
+	BackoffBase   time.Duration  `yaml:"backoffBase"`   // 重启间隔基数, 第n次重启间隔为backoffBase*2^n, 默认1s
+	BackoffMax    *time.Duration `yaml:"backoffMax"`    // 重启间隔上限, 默认5m, 0表示不限制
+	BackoffJitter BackoffJitter  `yaml:"backoffJitter"` // 重启间隔抖动策略: none, full, decorrelated, 默认full
+	ResetAfter    *time.Duration `yaml:"resetAfter"`    // 距上次重启超过resetAfter后重置重启间隔, 默认30m, 0表示不重置
+	Cooldown      *time.Duration `yaml:"cooldown"`      // 超过重启限制后等待cooldown再尝试重启, 默认10m, 0表示不再重启
+}
+
+// WithDefaults return a copy of l, unset fields are filled by d
+func (l LimiterConf) WithDefaults(d LimiterConf) LimiterConf {
+	if l.RestartLimit == nil {
+		l.RestartLimit = d.RestartLimit
+	}
+	if l.RestartWindow == 0 {
+		l.RestartWindow = d.RestartWindow
+	}
+	if l.BackoffBase == 0 {
+		l.BackoffBase = d.BackoffBase
+	}
+	if l.BackoffMax == nil {
+		l.BackoffMax = d.BackoffMax
+	}
+	if l.BackoffJitter == "" {
+		l.BackoffJitter = d.BackoffJitter
+	}
+	if l.ResetAfter == nil {
+		l.ResetAfter = d.ResetAfter
+	}
+	if l.Cooldown == nil {
+		l.Cooldown = d.Cooldown
+	}
+	return l
+}
+
+func (l LimiterConf) validate() error {
+	if l.RestartLimit != nil && *l.RestartLimit < 0 {
+		return fmt.Errorf("restartLimit %d must not be negative", *l.RestartLimit)
+	}
+	negative := func(d *time.Duration) bool { return d != nil && *d < 0 }
+	if l.RestartWindow < 0 || l.BackoffBase < 0 || negative(l.BackoffMax) || negative(l.ResetAfter) || negative(l.Cooldown) {
+		return errors.New("restartWindow, backoffBase, backoffMax, resetAfter and cooldown must not be negative")
+	}
+	switch l.BackoffJitter {
+	case "", JitterNone, JitterFull, JitterDecorrelated:
+	default:
+		return fmt.Errorf("unknown backoffJitter %q, must be one of %s, %s, %s", l.BackoffJitter, JitterNone, JitterFull, JitterDecorrelated)
+	}
+	return nil
+}
+
+// DefaultLimiterConf is the builtin LimiterConf used when neither cmd nor defaults set a value
+var DefaultLimiterConf = LimiterConf{
+	RestartLimit:  tool.Ptr(DefaultRestartLimit),
+	RestartWindow: DefaultRestartWindow,
+	BackoffBase:   DefaultBackoffBase,
+	BackoffMax:    tool.Ptr(DefaultBackoffMax),
+	BackoffJitter: DefaultBackoffJitter,
+	ResetAfter:    tool.Ptr(DefaultResetAfter),
+	Cooldown:      tool.Ptr(DefaultCooldown),
+}
+
 type Conf struct {
-	Cmds []struct {
-		Cmd  string   `yaml:"cmd"`
-		Args []string `yaml:"args"`
-		// Annotations for the command, such as name, port, hostname, admIP, etc.
-		// port must be set if the command listens on a port
-		// if no metrics, set metricsPath to ""
-		Annotations map[string]string `yaml:"annotations"`
-	} `yaml:"cmds"`
+	// Defaults apply to every cmd which does not set the same field
+	Defaults Defaults  `yaml:"defaults"`
+	Cmds     []CmdConf `yaml:"cmds"`
+	// API restricts the cmds added through the admin API
+	API APIConf `yaml:"api"`
+}
+
+// APIConf 限制通过管理接口添加的cmd.
+// 用户名或id, 未列出时只允许守护进程自身的uid、gid和附加组
+type APIConf struct {
+	AllowUsers  []string `yaml:"allowUsers"`  // cmd可以使用的user
+	AllowGroups []string `yaml:"allowGroups"` // cmd可以使用的group和groups
+}
+
+// Defaults is the global default block of Conf
+type Defaults struct {
+	LimiterConf `yaml:",inline"`
+	// Log is the default rotation of the log files of cmds
+	Log LogConf `yaml:"log"`
+}
+
+// CmdConf is the config of a single cmd
+type CmdConf struct {
+	Cmd  string   `yaml:"cmd"`
+	Args []string `yaml:"args"`
+	// Annotations for the command, such as name, port, hostname, admIP, etc.
+	// port must be set if the command listens on a port
+	// if no metrics, set metricsPath to ""
+	Annotations map[string]string `yaml:"annotations"`
+
+	// Restart policy: always, on-failure or never. Default always
+	Restart RestartPolicy `yaml:"restart"`
+	// SuccessExitCodes are the exit codes treated as success by on-failure. Default [0]
+	SuccessExitCodes []int `yaml:"successExitCodes"`
+
+	// Limiter settings, fallback to Conf.Defaults
+	LimiterConf `yaml:",inline"`
+
+	// Env is the extra environment variables of the cmd, override envFile and inherited ones
+	Env map[string]string `yaml:"env"`
+	// EnvFile is a .env file of KEY=VALUE lines, override inherited environment variables
+	EnvFile string `yaml:"envFile"`
+	// InheritEnv is whether to inherit the daemon's environment variables. Default true
+	InheritEnv *bool `yaml:"inheritEnv"`
+	// WorkDir is the working directory of the cmd, relative cmd path is resolved against it.
+	// Default the daemon's working directory
+	WorkDir string `yaml:"workDir"`
+
+	// User is the user name or uid to run the cmd as. Default the daemon's user
+	User string `yaml:"user"`
+	// Group is the group name or gid to run the cmd as. Default the user's primary group
+	Group string `yaml:"group"`
+	// Groups are the supplementary group names or gids. Default the user's supplementary groups
+	Groups []string `yaml:"groups"`
+	// Umask is the octal umask of the cmd, e.g. "022". Default the daemon's umask
+	Umask string `yaml:"umask"`
+
+	// StopSignal is the signal sent to the cmd's process group on stop, e.g. SIGINT. Default SIGTERM
+	StopSignal string `yaml:"stopSignal"`
+	// StopTimeout is how long to wait for the cmd to exit before SIGKILL. Default 10s
+	StopTimeout time.Duration `yaml:"stopTimeout"`
+
+	// DependsOn are the names of cmds that must be ready before this cmd starts.
+	// On shutdown this cmd is stopped before them
+	DependsOn []string `yaml:"dependsOn"`
+
+	// HealthCheck is the active health check of the cmd, nil means no health check.
+	// An unhealthy cmd is killed and restarted according to its restart policy and limiter
+	HealthCheck *HealthCheckConf `yaml:"healthCheck"`
+
+	// Critical cmds must be ready for the daemon to be ready (/ready).
+	// If no cmd is critical, all cmds are treated as critical,
+	// except stopped ones and exited ones not restarted by their restart policy
+	Critical bool `yaml:"critical"`
+
+	// Log is the rotation and format of the log file of the cmd, fallback to Conf.Defaults.
+	// Only used when the daemon writes cmd output to log files
+	Log LogConf `yaml:"log"`
+	// LogSink ship the output of the cmd to syslog or journald, nil means no sink
+	LogSink *LogSinkConf `yaml:"logSink"`
+}
+
+// Default stop settings of a cmd
+const (
+	DefaultStopSignal  = syscall.SIGTERM
+	DefaultStopTimeout = 10 * time.Second
+)
+
+// StopSignalValue parse the stop signal of the cmd, return DefaultStopSignal if not set
+func (c *CmdConf) StopSignalValue() (syscall.Signal, error) {
+	if c.StopSignal == "" {
+		return DefaultStopSignal, nil
+	}
+	sig, err := tool.ParseSignal(c.StopSignal)
+	if err != nil {
+		return 0, fmt.Errorf("stopSignal: %w", err)
+	}
+	return sig, nil
+}
+
+// Environ return the environment of the cmd in "KEY=value" form.
+// Priority: env > envFile > inherited environment.
+// Return nil if the cmd just inherits the daemon's environment.
+func (c *CmdConf) Environ() ([]string, error) {
+	inherit := c.InheritEnv == nil || *c.InheritEnv
+	if inherit && len(c.Env) == 0 && c.EnvFile == "" {
+		return nil, nil
+	}
+
+	var fileEnv map[string]string
+	if c.EnvFile != "" {
+		var err error
+		fileEnv, err = ParseEnvFile(c.EnvFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	environ := make([]string, 0, len(c.Env)+len(fileEnv))
+	if inherit {
+		for _, kv := range os.Environ() {
+			k, _, _ := strings.Cut(kv, "=")
+			if _, ok := c.Env[k]; ok {
+				continue
+			}
+			if _, ok := fileEnv[k]; ok {
+				continue
+			}
+			environ = append(environ, kv)
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(fileEnv)) {
+		if _, ok := c.Env[k]; ok {
+			continue
+		}
+		environ = append(environ, k+"="+fileEnv[k])
+	}
+	for _, k := range slices.Sorted(maps.Keys(c.Env)) {
+		environ = append(environ, k+"="+c.Env[k])
+	}
+	return environ, nil
+}
+
+// Validate check the conf and fill default values
+func (c *Conf) Validate() error {
+	if err := c.Defaults.LimiterConf.validate(); err != nil {
+		return fmt.Errorf("defaults: %w", err)
+	}
+	if err := c.Defaults.Log.validate(); err != nil {
+		return fmt.Errorf("defaults: %w", err)
+	}
+	for i := range c.Cmds {
+		cmd := &c.Cmds[i]
+		if cmd.Cmd == "" {
+			return fmt.Errorf("cmds[%d]: cmd is empty", i)
+		}
+		switch cmd.Restart {
+		case "":
+			cmd.Restart = RestartAlways
+		case RestartAlways, RestartOnFailure, RestartNever:
+		default:
+			return fmt.Errorf("cmds[%d]: unknown restart policy %q, must be one of %s, %s, %s",
+				i, cmd.Restart, RestartAlways, RestartOnFailure, RestartNever)
+		}
+		if len(cmd.SuccessExitCodes) == 0 {
+			cmd.SuccessExitCodes = []int{0}
+		}
+		if err := cmd.LimiterConf.validate(); err != nil {
+			return fmt.Errorf("cmds[%d]: %w", i, err)
+		}
+		cmd.LimiterConf = cmd.LimiterConf.WithDefaults(c.Defaults.LimiterConf).WithDefaults(DefaultLimiterConf)
+		if err := cmd.Log.validate(); err != nil {
+			return fmt.Errorf("cmds[%d]: %w", i, err)
+		}
+		cmd.Log = cmd.Log.WithDefaults(c.Defaults.Log)
+		if cmd.LogSink != nil {
+			if err := cmd.LogSink.validate(); err != nil {
+				return fmt.Errorf("cmds[%d]: %w", i, err)
+			}
+		}
+		if cmd.EnvFile != "" {
+			if _, err := ParseEnvFile(cmd.EnvFile); err != nil {
+				return fmt.Errorf("cmds[%d]: %w", i, err)
+			}
+		}
+		cred, err := cmd.Credential()
+		if err != nil {
+			return fmt.Errorf("cmds[%d]: %w", i, err)
+		}
+		if NeedPrivilege(cred) && os.Geteuid() != 0 {
+			return fmt.Errorf("cmds[%d]: run as uid %d gid %d groups %v requires root privilege, but daemon runs as uid %d",
+				i, cred.Uid, cred.Gid, cred.Groups, os.Geteuid())
+		}
+		if _, err := cmd.UmaskValue(); err != nil {
+			return fmt.Errorf("cmds[%d]: %w", i, err)
+		}
+		if _, err := cmd.StopSignalValue(); err != nil {
+			return fmt.Errorf("cmds[%d]: %w", i, err)
+		}
+		switch {
+		case cmd.StopTimeout < 0:
+			return fmt.Errorf("cmds[%d]: stopTimeout must not be negative", i)
+		case cmd.StopTimeout == 0:
+			cmd.StopTimeout = DefaultStopTimeout
+		}
+		if cmd.HealthCheck != nil {
+			if err := cmd.HealthCheck.validate(cmd.Annotations); err != nil {
+				return fmt.Errorf("cmds[%d]: healthCheck: %w", i, err)
+			}
+		}
+		if cmd.WorkDir != "" {
+			info, err := os.Stat(cmd.WorkDir)
+			if err != nil {
+				return fmt.Errorf("cmds[%d]: workDir: %w", i, err)
+			}
+			if !info.IsDir() {
+				return fmt.Errorf("cmds[%d]: workDir %s is not a directory", i, cmd.WorkDir)
+			}
+		}
+	}
+	return c.validateDependsOn()
 }
 
 func (c *Conf) Accept(v confVisitor) {
@@ -59,9 +426,12 @@ func (c *Conf) Accept(v confVisitor) {
 	v(c)
 }
 
-func GenerateCmds(conf *Conf) ([]*exec.Cmd, []map[string]string) {
+// GenerateCmds generate the cmds of conf and their annotations in order.
+// Return an error if the environment or the credential of a cmd can not be resolved,
+// e.g. envFile changed after Validate, rather than running it with the daemon's environment or identity
+func GenerateCmds(conf *Conf) ([]*exec.Cmd, []map[string]string, error) {
 	if len(conf.Cmds) == 0 {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	cmds := make([]*exec.Cmd, 0, len(conf.Cmds))
@@ -71,11 +441,26 @@ func GenerateCmds(conf *Conf) ([]*exec.Cmd, []map[string]string) {
 	conf.Accept(withIP)
 	conf.Accept(withName)
 
-	for _, cmd := range conf.Cmds {
-		cmds = append(cmds, exec.Command(cmd.Cmd, cmd.Args...))
+	for i := range conf.Cmds {
+		cmd := &conf.Cmds[i]
+		c := exec.Command(cmd.Cmd, cmd.Args...)
+		c.Dir = cmd.WorkDir
+		env, err := cmd.Environ()
+		if err != nil {
+			return nil, nil, fmt.Errorf("cmds[%d]: %w", i, err)
+		}
+		c.Env = env
+		cred, err := cmd.Credential()
+		if err != nil {
+			return nil, nil, fmt.Errorf("cmds[%d]: %w", i, err)
+		}
+		if NeedPrivilege(cred) {
+			c.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+		}
+		cmds = append(cmds, c)
 		annotationsList = append(annotationsList, cmd.Annotations)
 	}
-	return cmds, annotationsList
+	return cmds, annotationsList, nil
 }
 
 func Unmarshal(b []byte) (*Conf, error) {
@@ -85,7 +470,10 @@ func Unmarshal(b []byte) (*Conf, error) {
 		fmt.Println("Unmarshal config failed")
 		panic(err)
 	}
-	return &conf, err
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return &conf, nil
 }
 
 type confVisitor func(conf *Conf)
@@ -147,7 +535,7 @@ func withName(c *Conf) {
 		}
 		if c.Cmds[i].Annotations[AnnotationsNameKey] == "" {
 			// No need to check for nil again, already done above
-			c.Cmds[i].Annotations[AnnotationsNameKey] = filepath.Base(c.Cmds[i].Cmd)
+			c.Cmds[i].Annotations[AnnotationsNameKey] = c.Cmds[i].Name()
 		}
 	}
 }
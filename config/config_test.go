@@ -1,7 +1,16 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/sq325/cmdDaemon/internal/tool"
 )
 
 func TestUnmarshalDefaultConfig(t *testing.T) {
@@ -26,7 +35,10 @@ func TestGenerateCmds(t *testing.T) {
 		t.Fatalf("Expected no error, but got: %v", err)
 	}
 
-	cmds, anos := GenerateCmds(conf)
+	cmds, anos, err := GenerateCmds(conf)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
 	if len(cmds) != 1 {
 		t.Fatalf("Expected 1 command, but got: %d", len(cmds))
 	}
@@ -45,3 +57,384 @@ func TestGenerateCmds(t *testing.T) {
 	}
 
 }
+
+func TestUnmarshalRestartPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		yaml      string
+		wantErr   bool
+		wantPol   RestartPolicy
+		wantCodes []int
+	}{
+		{
+			name:      "default policy",
+			yaml:      "cmds:\n  - cmd: sleep\n",
+			wantPol:   RestartAlways,
+			wantCodes: []int{0},
+		},
+		{
+			name:      "on-failure with success codes",
+			yaml:      "cmds:\n  - cmd: sleep\n    restart: on-failure\n    successExitCodes: [0, 2]\n",
+			wantPol:   RestartOnFailure,
+			wantCodes: []int{0, 2},
+		},
+		{
+			name:    "unknown policy",
+			yaml:    "cmds:\n  - cmd: sleep\n    restart: sometimes\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := Unmarshal([]byte(tt.yaml))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Expected error, but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			if conf.Cmds[0].Restart != tt.wantPol {
+				t.Errorf("Expected restart policy %q, but got: %q", tt.wantPol, conf.Cmds[0].Restart)
+			}
+			if !slices.Equal(conf.Cmds[0].SuccessExitCodes, tt.wantCodes) {
+				t.Errorf("Expected success exit codes %v, but got: %v", tt.wantCodes, conf.Cmds[0].SuccessExitCodes)
+			}
+		})
+	}
+}
+
+func TestUnmarshalStop(t *testing.T) {
+	tests := []struct {
+		name        string
+		yaml        string
+		wantErr     bool
+		wantSignal  syscall.Signal
+		wantTimeout time.Duration
+	}{
+		{
+			name:        "default",
+			yaml:        "cmds:\n  - cmd: sleep\n",
+			wantSignal:  syscall.SIGTERM,
+			wantTimeout: DefaultStopTimeout,
+		},
+		{
+			name:        "custom",
+			yaml:        "cmds:\n  - cmd: sleep\n    stopSignal: SIGQUIT\n    stopTimeout: 90s\n",
+			wantSignal:  syscall.SIGQUIT,
+			wantTimeout: 90 * time.Second,
+		},
+		{
+			name:    "unknown signal",
+			yaml:    "cmds:\n  - cmd: sleep\n    stopSignal: SIGFOO\n",
+			wantErr: true,
+		},
+		{
+			name:    "negative timeout",
+			yaml:    "cmds:\n  - cmd: sleep\n    stopTimeout: -1s\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := Unmarshal([]byte(tt.yaml))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Expected error, but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			sig, _ := conf.Cmds[0].StopSignalValue()
+			if sig != tt.wantSignal {
+				t.Errorf("Expected stop signal %v, but got: %v", tt.wantSignal, sig)
+			}
+			if conf.Cmds[0].StopTimeout != tt.wantTimeout {
+				t.Errorf("Expected stop timeout %v, but got: %v", tt.wantTimeout, conf.Cmds[0].StopTimeout)
+			}
+		})
+	}
+}
+
+func TestUnmarshalLimiterDefaults(t *testing.T) {
+	yml := `defaults:
+  restartLimit: 3
+  backoffMax: 1m
+cmds:
+  - cmd: sleep
+  - cmd: sleep
+    restartLimit: 10
+    backoffBase: 2s
+`
+	conf, err := Unmarshal([]byte(yml))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	want := []LimiterConf{
+		{RestartLimit: tool.Ptr(3), RestartWindow: DefaultRestartWindow, BackoffBase: DefaultBackoffBase, BackoffMax: tool.Ptr(time.Minute), BackoffJitter: JitterFull, ResetAfter: tool.Ptr(DefaultResetAfter), Cooldown: tool.Ptr(DefaultCooldown)},
+		{RestartLimit: tool.Ptr(10), RestartWindow: DefaultRestartWindow, BackoffBase: 2 * time.Second, BackoffMax: tool.Ptr(time.Minute), BackoffJitter: JitterFull, ResetAfter: tool.Ptr(DefaultResetAfter), Cooldown: tool.Ptr(DefaultCooldown)},
+	}
+	for i, w := range want {
+		if got := conf.Cmds[i].LimiterConf; !reflect.DeepEqual(got, w) {
+			t.Errorf("cmds[%d] limiter = %+v, want %+v", i, got, w)
+		}
+	}
+
+	// cmd中显式设置的0优先于defaults
+	conf, err = Unmarshal([]byte(`defaults:
+  restartLimit: 3
+  resetAfter: 1h
+  cooldown: 10m
+cmds:
+  - cmd: sleep
+    restartLimit: 0
+    resetAfter: 0s
+    cooldown: 0s
+  - cmd: sleep
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := conf.Cmds[0].LimiterConf; *l.RestartLimit != 0 || *l.ResetAfter != 0 || *l.Cooldown != 0 {
+		t.Errorf("explicit 0 overridden by defaults: restartLimit %d, resetAfter %v, cooldown %v", *l.RestartLimit, *l.ResetAfter, *l.Cooldown)
+	}
+	if l := conf.Cmds[1].LimiterConf; *l.RestartLimit != 3 || *l.ResetAfter != time.Hour || *l.Cooldown != 10*time.Minute {
+		t.Errorf("unset fields not filled by defaults: restartLimit %d, resetAfter %v, cooldown %v", *l.RestartLimit, *l.ResetAfter, *l.Cooldown)
+	}
+
+	if _, err := Unmarshal([]byte("cmds:\n  - cmd: sleep\n    restartLimit: -1\n")); err == nil {
+		t.Error("Expected error for negative restartLimit, but got nil")
+	}
+	if _, err := Unmarshal([]byte("cmds:\n  - cmd: sleep\n    backoffJitter: random\n")); err == nil {
+		t.Error("Expected error for unknown backoffJitter, but got nil")
+	}
+}
+
+func TestCmdConf_Environ(t *testing.T) {
+	t.Setenv("CMDDAEMON_INHERITED", "daemon")
+	t.Setenv("CMDDAEMON_OVERRIDE", "daemon")
+
+	envFile := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(envFile, []byte("CMDDAEMON_OVERRIDE=file\nCMDDAEMON_FILE=file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inherit := false
+
+	tests := []struct {
+		name    string
+		conf    CmdConf
+		want    []string // must be in environ
+		notWant []string // must not be in environ
+		wantNil bool
+	}{
+		{
+			name:    "inherit only",
+			conf:    CmdConf{},
+			wantNil: true,
+		},
+		{
+			name:    "env file overrides inherited",
+			conf:    CmdConf{EnvFile: envFile},
+			want:    []string{"CMDDAEMON_INHERITED=daemon", "CMDDAEMON_OVERRIDE=file", "CMDDAEMON_FILE=file"},
+			notWant: []string{"CMDDAEMON_OVERRIDE=daemon"},
+		},
+		{
+			name:    "env overrides env file",
+			conf:    CmdConf{EnvFile: envFile, Env: map[string]string{"CMDDAEMON_OVERRIDE": "env"}},
+			want:    []string{"CMDDAEMON_OVERRIDE=env", "CMDDAEMON_FILE=file"},
+			notWant: []string{"CMDDAEMON_OVERRIDE=file", "CMDDAEMON_OVERRIDE=daemon"},
+		},
+		{
+			name:    "no inherit",
+			conf:    CmdConf{InheritEnv: &inherit, Env: map[string]string{"CMDDAEMON_ENV": "env"}},
+			want:    []string{"CMDDAEMON_ENV=env"},
+			notWant: []string{"CMDDAEMON_INHERITED=daemon"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.conf.Environ()
+			if err != nil {
+				t.Fatalf("Environ() error = %v", err)
+			}
+			if tt.wantNil {
+				if got != nil {
+					t.Errorf("Environ() = %v, want nil", got)
+				}
+				return
+			}
+			for _, kv := range tt.want {
+				if !slices.Contains(got, kv) {
+					t.Errorf("Environ() missing %s", kv)
+				}
+			}
+			for _, kv := range tt.notWant {
+				if slices.Contains(got, kv) {
+					t.Errorf("Environ() should not contain %s", kv)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateCmdsEnvAndWorkDir(t *testing.T) {
+	dir := t.TempDir()
+	yml := "cmds:\n  - cmd: sleep\n    workDir: " + dir + "\n    inheritEnv: false\n    env:\n      FOO: bar\n"
+	conf, err := Unmarshal([]byte(yml))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	cmds, _, err := GenerateCmds(conf)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if cmds[0].Dir != dir {
+		t.Errorf("Expected dir %s, but got: %s", dir, cmds[0].Dir)
+	}
+	if !slices.Equal(cmds[0].Env, []string{"FOO=bar"}) {
+		t.Errorf("Expected env [FOO=bar], but got: %v", cmds[0].Env)
+	}
+
+	// envFile在Validate之后被删除, 不能以守护进程的环境变量运行
+	envFile := filepath.Join(dir, ".env")
+	if err := os.WriteFile(envFile, []byte("FOO=bar\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err = Unmarshal([]byte("cmds:\n  - cmd: sleep\n    envFile: " + envFile + "\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	os.Remove(envFile)
+	if cmds, _, err := GenerateCmds(conf); err == nil {
+		t.Errorf("Expected error after envFile removed, but got: %v", cmds)
+	}
+
+	if _, err := Unmarshal([]byte("cmds:\n  - cmd: sleep\n    workDir: " + filepath.Join(dir, "missing") + "\n")); err == nil {
+		t.Error("Expected error for missing workDir, but got nil")
+	}
+	if _, err := Unmarshal([]byte("cmds:\n  - cmd: sleep\n    envFile: " + filepath.Join(dir, "missing.env") + "\n")); err == nil {
+		t.Error("Expected error for missing envFile, but got nil")
+	}
+}
+
+func TestUnmarshalDependsOn(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name: "valid chain",
+			yaml: `cmds:
+  - cmd: app
+    dependsOn: [proxy, cache]
+  - cmd: proxy
+    dependsOn: [cache]
+  - cmd: redis-server
+    annotations:
+      name: cache
+`,
+		},
+		{
+			name:    "unknown dependency",
+			yaml:    "cmds:\n  - cmd: app\n    dependsOn: [db]\n",
+			wantErr: `dependsOn unknown cmd "db"`,
+		},
+		{
+			name:    "self dependency",
+			yaml:    "cmds:\n  - cmd: app\n    dependsOn: [app]\n",
+			wantErr: "app depends on itself",
+		},
+		{
+			name: "cycle",
+			yaml: `cmds:
+  - cmd: a
+    dependsOn: [b]
+  - cmd: b
+    dependsOn: [c]
+  - cmd: c
+    dependsOn: [a]
+`,
+			wantErr: "dependency cycle: a -> b -> c -> a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Unmarshal([]byte(tt.yaml))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Expected no error, but got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Expected error containing %q, but got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalHealthCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr bool
+	}{
+		{
+			name: "http probe with defaults",
+			yaml: "cmds:\n  - cmd: sleep\n    healthCheck:\n      http:\n        url: http://127.0.0.1:9091/-/healthy\n",
+		},
+		{
+			name: "default probe from port annotation",
+			yaml: "cmds:\n  - cmd: sleep\n    annotations:\n      port: \"9091\"\n    healthCheck: {}\n",
+		},
+		{
+			name:    "no probe and no port",
+			yaml:    "cmds:\n  - cmd: sleep\n    healthCheck: {}\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid url",
+			yaml:    "cmds:\n  - cmd: sleep\n    healthCheck:\n      http:\n        url: 127.0.0.1:9091\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid tcp address",
+			yaml:    "cmds:\n  - cmd: sleep\n    healthCheck:\n      tcp:\n        address: localhost\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty exec",
+			yaml:    "cmds:\n  - cmd: sleep\n    healthCheck:\n      exec: {}\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := Unmarshal([]byte(tt.yaml))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Expected error, but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			h := conf.Cmds[0].HealthCheck
+			if h.Interval != DefaultHealthInterval || h.Timeout != DefaultHealthTimeout || h.FailureThreshold != DefaultHealthFailureThreshold {
+				t.Errorf("Expected default interval, timeout and failureThreshold, but got: %+v", h)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"syscall"
+)
+
+// Credential resolve user, group and groups of the cmd.
+// Return nil if none of them is set, the cmd runs as the daemon's user.
+//
+// If user is set but group is not, the user's primary group is used,
+// a numeric uid without passwd entry requires group.
+// If user is set but groups is not, the user's supplementary groups are used.
+func (c *CmdConf) Credential() (*syscall.Credential, error) {
+	if c.User == "" && c.Group == "" && len(c.Groups) == 0 {
+		return nil, nil
+	}
+
+	cred := &syscall.Credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+
+	var u *user.User
+	if c.User != "" {
+		var err error
+		u, err = lookupUser(c.User)
+		if err != nil {
+			return nil, err
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid %s of user %s", u.Uid, c.User)
+		}
+		cred.Uid = uint32(uid)
+		switch {
+		case u.Gid != "":
+			gid, err := strconv.ParseUint(u.Gid, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid gid %s of user %s", u.Gid, c.User)
+			}
+			cred.Gid = uint32(gid)
+		case c.Group == "":
+			// 没有passwd条目的uid没有主组, 不能使用守护进程的gid
+			return nil, fmt.Errorf("user %s has no passwd entry, group is required", c.User)
+		}
+	}
+
+	if c.Group != "" {
+		gid, err := lookupGid(c.Group)
+		if err != nil {
+			return nil, err
+		}
+		cred.Gid = gid
+	}
+
+	groups := c.Groups
+	if len(groups) == 0 && u != nil && u.Username != "" {
+		// 默认使用用户的附加组, 查询失败时不设置附加组
+		groups, _ = u.GroupIds()
+	}
+	for _, g := range groups {
+		gid, err := lookupGid(g)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(cred.Groups, gid) {
+			cred.Groups = append(cred.Groups, gid)
+		}
+	}
+	return cred, nil
+}
+
+// UmaskValue parse the octal umask of the cmd, return -1 if not set
+func (c *CmdConf) UmaskValue() (int, error) {
+	if c.Umask == "" {
+		return -1, nil
+	}
+	mask, err := strconv.ParseUint(c.Umask, 8, 32)
+	if err != nil || mask > 0777 {
+		return -1, fmt.Errorf("invalid umask %q, must be an octal number like 022", c.Umask)
+	}
+	return int(mask), nil
+}
+
+// NeedPrivilege report whether switching to cred requires root privilege
+func NeedPrivilege(cred *syscall.Credential) bool {
+	if cred == nil {
+		return false
+	}
+	if int(cred.Uid) != os.Getuid() || int(cred.Gid) != os.Getgid() {
+		return true
+	}
+	// 设置附加组需要CAP_SETGID, 与当前附加组一致时除外
+	current, err := os.Getgroups()
+	if err != nil {
+		return true
+	}
+	for _, gid := range cred.Groups {
+		if !slices.Contains(current, int(gid)) {
+			return true
+		}
+	}
+	return len(cred.Groups) != len(current)
+}
+
+// ErrIdentityNotAllowed is returned by APIConf.Allow
+var ErrIdentityNotAllowed = errors.New("user or group not allowed")
+
+// Allow check the user, group and groups of a cmd added through the admin API.
+// Each of them must be the daemon's own or listed in allowUsers/allowGroups,
+// the primary and supplementary groups of an allowed user are allowed with it
+func (a APIConf) Allow(c *CmdConf) error {
+	cred, err := c.Credential()
+	if err != nil || cred == nil {
+		return err
+	}
+	if int(cred.Uid) != os.Getuid() && !slices.ContainsFunc(a.AllowUsers, func(name string) bool {
+		u, err := lookupUser(name)
+		return err == nil && u.Uid == strconv.FormatUint(uint64(cred.Uid), 10)
+	}) {
+		return fmt.Errorf("%w: user %s is not in api.allowUsers", ErrIdentityNotAllowed, c.User)
+	}
+
+	var gids []uint32
+	if c.Group != "" {
+		gids = append(gids, cred.Gid)
+	}
+	if len(c.Groups) > 0 {
+		gids = append(gids, cred.Groups...)
+	}
+	own, _ := os.Getgroups()
+	for _, gid := range gids {
+		if int(gid) == os.Getgid() || slices.Contains(own, int(gid)) {
+			continue
+		}
+		if !slices.ContainsFunc(a.AllowGroups, func(name string) bool {
+			allowed, err := lookupGid(name)
+			return err == nil && allowed == gid
+		}) {
+			return fmt.Errorf("%w: gid %d is not in api.allowGroups", ErrIdentityNotAllowed, gid)
+		}
+	}
+	return nil
+}
+
+// lookupUser lookup user by name or uid.
+// A numeric uid without passwd entry is allowed, e.g. in containers
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+	if _, perr := strconv.ParseUint(name, 10, 32); perr != nil {
+		return nil, fmt.Errorf("lookup user %s err: %w", name, err)
+	}
+	if u, err := user.LookupId(name); err == nil {
+		return u, nil
+	}
+	return &user.User{Uid: name}, nil
+}
+
+// lookupGid lookup group by name or gid.
+// A numeric gid without group entry is allowed
+func lookupGid(name string) (uint32, error) {
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("lookup group %s err: %w", name, err)
+	}
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid gid %s of group %s", g.Gid, name)
+	}
+	return uint32(gid), nil
+}
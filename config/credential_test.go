@@ -0,0 +1,169 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestCmdConf_Credential(t *testing.T) {
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skip("user nobody not found:", err)
+	}
+	nobody, _ := user.Lookup("nobody")
+
+	tests := []struct {
+		name    string
+		conf    CmdConf
+		wantNil bool
+		wantUid string
+		wantGid string
+		wantErr bool
+	}{
+		{
+			name:    "not set",
+			conf:    CmdConf{},
+			wantNil: true,
+		},
+		{
+			name:    "user with primary group",
+			conf:    CmdConf{User: "nobody"},
+			wantUid: nobody.Uid,
+			wantGid: nobody.Gid,
+		},
+		{
+			name:    "numeric uid and gid without entry",
+			conf:    CmdConf{User: "54321", Group: "54321"},
+			wantUid: "54321",
+			wantGid: "54321",
+		},
+		{
+			name:    "numeric uid without entry and group",
+			conf:    CmdConf{User: "54321"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown user",
+			conf:    CmdConf{User: "this-user-does-not-exist"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown group",
+			conf:    CmdConf{Groups: []string{"this-group-does-not-exist"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cred, err := tt.conf.Credential()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Credential() = %+v, want error", cred)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Credential() error = %v", err)
+			}
+			if tt.wantNil {
+				if cred != nil {
+					t.Errorf("Credential() = %+v, want nil", cred)
+				}
+				return
+			}
+			if got := itoa(cred.Uid); got != tt.wantUid {
+				t.Errorf("Credential() uid = %s, want %s", got, tt.wantUid)
+			}
+			if got := itoa(cred.Gid); got != tt.wantGid {
+				t.Errorf("Credential() gid = %s, want %s", got, tt.wantGid)
+			}
+		})
+	}
+}
+
+func TestCmdConf_UmaskValue(t *testing.T) {
+	tests := []struct {
+		umask   string
+		want    int
+		wantErr bool
+	}{
+		{umask: "", want: -1},
+		{umask: "022", want: 022},
+		{umask: "0077", want: 077},
+		{umask: "888", wantErr: true},
+		{umask: "1777", wantErr: true},
+	}
+	for _, tt := range tests {
+		c := CmdConf{Umask: tt.umask}
+		got, err := c.UmaskValue()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("UmaskValue(%q) error = %v, wantErr %v", tt.umask, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("UmaskValue(%q) = %o, want %o", tt.umask, got, tt.want)
+		}
+	}
+}
+
+func TestNeedPrivilege(t *testing.T) {
+	groups, err := os.Getgroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	for _, g := range groups {
+		self.Groups = append(self.Groups, uint32(g))
+	}
+	if NeedPrivilege(nil) {
+		t.Error("NeedPrivilege(nil) = true, want false")
+	}
+	if NeedPrivilege(self) {
+		t.Error("NeedPrivilege(self) = true, want false")
+	}
+	other := *self
+	other.Uid++
+	if !NeedPrivilege(&other) {
+		t.Error("NeedPrivilege(other uid) = false, want true")
+	}
+}
+
+func TestAPIConf_Allow(t *testing.T) {
+	uid, gid := strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())
+	tests := []struct {
+		name    string
+		api     APIConf
+		conf    CmdConf
+		wantErr bool
+	}{
+		{name: "not set", conf: CmdConf{}},
+		{name: "daemon's own user and group", conf: CmdConf{User: uid, Group: gid}},
+		{name: "other user", conf: CmdConf{User: "54321", Group: gid}, wantErr: true},
+		{name: "allowed user", api: APIConf{AllowUsers: []string{"54321"}}, conf: CmdConf{User: "54321", Group: gid}},
+		{name: "other group", conf: CmdConf{Group: "54322"}, wantErr: true},
+		{name: "other supplementary group", conf: CmdConf{Groups: []string{gid, "54322"}}, wantErr: true},
+		{name: "allowed group", api: APIConf{AllowGroups: []string{"54322"}}, conf: CmdConf{Group: "54322", Groups: []string{"54322"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.api.Allow(&tt.conf)
+			if tt.wantErr {
+				if !errors.Is(err, ErrIdentityNotAllowed) {
+					t.Errorf("Allow() error = %v, want ErrIdentityNotAllowed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Allow() error = %v", err)
+			}
+		})
+	}
+}
+
+func itoa(id uint32) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
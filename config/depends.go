@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Name return the name annotation of the cmd, default the basename of cmd
+func (c *CmdConf) Name() string {
+	if name := c.Annotations[AnnotationsNameKey]; name != "" {
+		return name
+	}
+	return filepath.Base(c.Cmd)
+}
+
+// validateDependsOn check that every dependsOn refers to an existing cmd name
+// and there is no dependency cycle
+func (c *Conf) validateDependsOn() error {
+	byName := make(map[string][]int, len(c.Cmds))
+	for i := range c.Cmds {
+		name := c.Cmds[i].Name()
+		byName[name] = append(byName[name], i)
+	}
+
+	// graph[i]: cmd i依赖的cmd
+	graph := make([][]int, len(c.Cmds))
+	for i := range c.Cmds {
+		for _, dep := range c.Cmds[i].DependsOn {
+			deps, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("cmds[%d]: dependsOn unknown cmd %q", i, dep)
+			}
+			if slices.Contains(deps, i) {
+				return fmt.Errorf("cmds[%d]: %s depends on itself", i, dep)
+			}
+			graph[i] = append(graph[i], deps...)
+		}
+	}
+
+	// 深度优先搜索查找环
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	color := make([]int, len(c.Cmds))
+	var path []int
+	var visit func(i int) error
+	visit = func(i int) error {
+		color[i] = visiting
+		path = append(path, i)
+		for _, j := range graph[i] {
+			switch color[j] {
+			case visiting:
+				cycle := path[slices.Index(path, j):]
+				names := make([]string, 0, len(cycle)+1)
+				for _, k := range cycle {
+					names = append(names, c.Cmds[k].Name())
+				}
+				names = append(names, c.Cmds[j].Name())
+				return fmt.Errorf("dependency cycle: %s", strings.Join(names, " -> "))
+			case unvisited:
+				if err := visit(j); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		color[i] = visited
+		return nil
+	}
+	for i := range c.Cmds {
+		if color[i] == unvisited {
+			if err := visit(i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"os/exec"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/sq325/cmdDaemon/internal/tool"
+)
+
+// CmdIDs return the stable identity of each cmd in c, used to match cmds between configs.
+// The identity is the name annotation, with ":port" if the port annotation is set.
+// Cmds sharing the same identity are told apart by the hash of cmd, args and env
+func (c *Conf) CmdIDs() []string {
+	ids := make([]string, len(c.Cmds))
+	count := make(map[string]int, len(c.Cmds))
+	for i := range c.Cmds {
+		ids[i] = c.Cmds[i].baseID()
+		count[ids[i]]++
+	}
+	for i := range c.Cmds {
+		if count[ids[i]] > 1 {
+			ids[i] += "@" + c.Cmds[i].hash()
+		}
+	}
+	return ids
+}
+
+func (c *CmdConf) baseID() string {
+	if port := c.Annotations[AnnotationsPortKey]; port != "" {
+		return c.Name() + ":" + port
+	}
+	return c.Name()
+}
+
+// hash return the hash of cmd, args and env of c
+func (c *CmdConf) hash() string {
+	args := make([]string, 0, 1+len(c.Args)+len(c.Env))
+	args = append(args, c.Cmd)
+	args = append(args, c.Args...)
+	for _, k := range slices.Sorted(maps.Keys(c.Env)) {
+		args = append(args, "env:"+k+"="+c.Env[k])
+	}
+	return tool.HashCmd(&exec.Cmd{Args: args})
+}
+
+// CmdDiff is a cmd in ConfDiff, Old or New is nil if the cmd is added or removed
+type CmdDiff struct {
+	ID  string   `json:"id"`
+	Cmd string   `json:"cmd"` // cmd和args
+	Old *CmdConf `json:"-"`
+	New *CmdConf `json:"-"`
+
+	Fields      []string           `json:"fields,omitempty"`      // 变化的字段, 不包括annotations
+	Annotations []AnnotationChange `json:"annotations,omitempty"` // 变化的annotations
+}
+
+// AnnotationChange is a changed annotation, Old or New is empty if the annotation is added or removed
+type AnnotationChange struct {
+	Key string `json:"key"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// ConfDiff is the difference between two configs
+type ConfDiff struct {
+	Added     []CmdDiff `json:"added"`
+	Removed   []CmdDiff `json:"removed"`
+	Changed   []CmdDiff `json:"changed"`
+	Unchanged []CmdDiff `json:"unchanged"`
+}
+
+// Empty report whether nothing is added, removed or changed
+func (d *ConfDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Diff compare the cmds of old and new by CmdIDs.
+// Default annotations of both configs are filled like GenerateCmds before comparing
+func Diff(old, new *Conf) *ConfDiff {
+	for _, c := range []*Conf{old, new} {
+		c.Accept(withHostName)
+		c.Accept(withIP)
+		c.Accept(withName)
+	}
+
+	oldIDs, newIDs := old.CmdIDs(), new.CmdIDs()
+	diff := &ConfDiff{}
+	for i, id := range newIDs {
+		cmd := &new.Cmds[i]
+		j := slices.Index(oldIDs, id)
+		switch {
+		case j < 0:
+			diff.Added = append(diff.Added, CmdDiff{ID: id, Cmd: cmd.String(), New: cmd})
+		case reflect.DeepEqual(old.Cmds[j], *cmd):
+			diff.Unchanged = append(diff.Unchanged, CmdDiff{ID: id, Cmd: cmd.String(), Old: &old.Cmds[j], New: cmd})
+		default:
+			diff.Changed = append(diff.Changed, CmdDiff{
+				ID:          id,
+				Cmd:         cmd.String(),
+				Old:         &old.Cmds[j],
+				New:         cmd,
+				Fields:      changedFields(reflect.ValueOf(old.Cmds[j]), reflect.ValueOf(*cmd)),
+				Annotations: annotationChanges(old.Cmds[j].Annotations, cmd.Annotations),
+			})
+		}
+	}
+	for j, id := range oldIDs {
+		if !slices.Contains(newIDs, id) {
+			diff.Removed = append(diff.Removed, CmdDiff{ID: id, Cmd: old.Cmds[j].String(), Old: &old.Cmds[j]})
+		}
+	}
+	return diff
+}
+
+// String return the cmd and args of c
+func (c *CmdConf) String() string {
+	return strings.Join(append([]string{c.Cmd}, c.Args...), " ")
+}
+
+// changedFields return the yaml names of the changed fields of two CmdConf values,
+// fields of inline structs are compared one by one, annotations are skipped
+func changedFields(old, new reflect.Value) []string {
+	var fields []string
+	for i := 0; i < old.NumField(); i++ {
+		tag := old.Type().Field(i).Tag.Get("yaml")
+		name, _, _ := strings.Cut(tag, ",")
+		switch {
+		case strings.HasSuffix(tag, ",inline"):
+			fields = append(fields, changedFields(old.Field(i), new.Field(i))...)
+		case name == "annotations":
+		case !reflect.DeepEqual(old.Field(i).Interface(), new.Field(i).Interface()):
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+func annotationChanges(old, new map[string]string) []AnnotationChange {
+	var changes []AnnotationChange
+	keys := slices.Sorted(maps.Keys(old))
+	for k := range new {
+		if _, ok := old[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		if old[k] != new[k] {
+			changes = append(changes, AnnotationChange{Key: k, Old: old[k], New: new[k]})
+		}
+	}
+	return changes
+}
+
+// String format d for humans, one cmd per line prefixed with
+// "+" (added), "-" (removed), "~" (changed, will be restarted) or "=" (unchanged)
+func (d *ConfDiff) String() string {
+	var b strings.Builder
+	for _, c := range d.Added {
+		fmt.Fprintf(&b, "+ %s: %s\n", c.ID, c.Cmd)
+	}
+	for _, c := range d.Removed {
+		fmt.Fprintf(&b, "- %s: %s\n", c.ID, c.Cmd)
+	}
+	for _, c := range d.Changed {
+		fmt.Fprintf(&b, "~ %s: %s (restart)\n", c.ID, c.Cmd)
+		if len(c.Fields) > 0 {
+			fmt.Fprintf(&b, "    fields: %s\n", strings.Join(c.Fields, ", "))
+		}
+		for _, a := range c.Annotations {
+			fmt.Fprintf(&b, "    annotation %s: %q -> %q\n", a.Key, a.Old, a.New)
+		}
+	}
+	for _, c := range d.Unchanged {
+		fmt.Fprintf(&b, "= %s: %s\n", c.ID, c.Cmd)
+	}
+	fmt.Fprintf(&b, "%d added, %d removed, %d changed, %d unchanged\n",
+		len(d.Added), len(d.Removed), len(d.Changed), len(d.Unchanged))
+	return b.String()
+}
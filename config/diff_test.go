@@ -0,0 +1,105 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConf_CmdIDs(t *testing.T) {
+	conf, err := Unmarshal([]byte(`cmds:
+  - cmd: ./prometheus
+    annotations:
+      port: "9091"
+  - cmd: sleep
+    args: ["1"]
+  - cmd: sleep
+    args: ["2"]
+  - cmd: node_exporter
+    annotations:
+      name: node
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := conf.CmdIDs()
+	if ids[0] != "prometheus:9091" || ids[3] != "node" {
+		t.Errorf("CmdIDs() = %v", ids)
+	}
+	if !strings.HasPrefix(ids[1], "sleep@") || !strings.HasPrefix(ids[2], "sleep@") || ids[1] == ids[2] {
+		t.Errorf("CmdIDs() of duplicate names = %v, %v, want distinct sleep@hash", ids[1], ids[2])
+	}
+	if again := conf.CmdIDs(); !slices.Equal(ids, again) {
+		t.Errorf("CmdIDs() not stable: %v != %v", ids, again)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old, err := Unmarshal([]byte(`cmds:
+  - cmd: proxy
+  - cmd: cache
+    args: ["--size", "1g"]
+  - cmd: legacy
+  - cmd: exporter
+    annotations:
+      app: a
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 模拟运行中的配置, 已由GenerateCmds填充默认注释
+	GenerateCmds(old)
+
+	new, err := Unmarshal([]byte(`cmds:
+  - cmd: proxy
+  - cmd: cache
+    args: ["--size", "2g"]
+  - cmd: app
+    dependsOn: [proxy]
+  - cmd: exporter
+    annotations:
+      app: b
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff := Diff(old, new)
+	ids := func(ds []CmdDiff) []string {
+		var s []string
+		for _, d := range ds {
+			s = append(s, d.ID)
+		}
+		return s
+	}
+	if got := ids(diff.Added); !slices.Equal(got, []string{"app"}) {
+		t.Errorf("Added = %v, want [app]", got)
+	}
+	if got := ids(diff.Removed); !slices.Equal(got, []string{"legacy"}) {
+		t.Errorf("Removed = %v, want [legacy]", got)
+	}
+	if got := ids(diff.Changed); !slices.Equal(got, []string{"cache", "exporter"}) {
+		t.Fatalf("Changed = %v, want [cache exporter]", got)
+	}
+	if cache := diff.Changed[0]; !slices.Equal(cache.Fields, []string{"args"}) || len(cache.Annotations) != 0 {
+		t.Errorf("Changed cache = %+v, want args changed", cache)
+	}
+	want := []AnnotationChange{{Key: "app", Old: "a", New: "b"}}
+	if exporter := diff.Changed[1]; len(exporter.Fields) != 0 || !slices.Equal(exporter.Annotations, want) {
+		t.Errorf("Changed exporter = %+v, want annotation app changed", exporter)
+	}
+	if got := ids(diff.Unchanged); !slices.Equal(got, []string{"proxy"}) {
+		t.Errorf("Unchanged = %v, want [proxy]", got)
+	}
+	if diff.Empty() {
+		t.Error("Empty() = true, want false")
+	}
+	for _, line := range []string{"+ app: app\n", "- legacy: legacy\n", "~ cache: cache --size 2g (restart)\n", `    annotation app: "a" -> "b"`, "= proxy: proxy\n"} {
+		if !strings.Contains(diff.String(), line) {
+			t.Errorf("String() = %q, want containing %q", diff.String(), line)
+		}
+	}
+	if d := Diff(new, new); !d.Empty() {
+		t.Errorf("Diff(new, new) = %+v, want empty", d)
+	}
+}
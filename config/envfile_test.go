@@ -0,0 +1,61 @@
+package config
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestParseEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "plain values and comments",
+			input: `# comment
+FOO=bar
+
+export BAZ=qux
+EMPTY=
+SPACED = value with spaces # inline comment
+`,
+			want: map[string]string{"FOO": "bar", "BAZ": "qux", "EMPTY": "", "SPACED": "value with spaces"},
+		},
+		{
+			name:  "quoted values",
+			input: "DQ=\"line1\\nline2 \\\"q\\\" # not comment\"\nSQ='raw \\n # not comment'\nURL=http://a/b#frag\n",
+			want:  map[string]string{"DQ": "line1\nline2 \"q\" # not comment", "SQ": "raw \\n # not comment", "URL": "http://a/b#frag"},
+		},
+		{
+			name:    "missing equal sign",
+			input:   "FOO\n",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated quote",
+			input:   "FOO=\"bar\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEnv(strings.NewReader(tt.input))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseEnv() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseEnv() error = %v", err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("parseEnv() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
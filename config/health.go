@@ -0,0 +1,97 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Default values of HealthCheckConf
+const (
+	DefaultHealthInterval         = 10 * time.Second
+	DefaultHealthTimeout          = 3 * time.Second
+	DefaultHealthFailureThreshold = 3
+)
+
+// HealthCheckConf is the active health check of a cmd.
+// All configured probes must succeed for the cmd to be healthy.
+// If no probe is configured, a default probe is derived from the annotations:
+// http://ip:port/metricsPath if metricsPath is set, otherwise tcp ip:port
+type HealthCheckConf struct {
+	HTTP *HTTPProbeConf `yaml:"http"`
+	TCP  *TCPProbeConf  `yaml:"tcp"`
+	Exec *ExecProbeConf `yaml:"exec"`
+
+	// Interval between two probes. Default 10s
+	Interval time.Duration `yaml:"interval"`
+	// Timeout of a single probe. Default 3s
+	Timeout time.Duration `yaml:"timeout"`
+	// FailureThreshold is the number of consecutive failures before the cmd is unhealthy and restarted. Default 3
+	FailureThreshold int `yaml:"failureThreshold"`
+	// StartPeriod is the time after start during which failures are not counted. Default 0
+	StartPeriod time.Duration `yaml:"startPeriod"`
+}
+
+// HTTPProbeConf probe the cmd by a http GET request
+type HTTPProbeConf struct {
+	URL string `yaml:"url"`
+	// ExpectedStatus is the expected status code, 0 means any 2xx or 3xx
+	ExpectedStatus int `yaml:"expectedStatus"`
+}
+
+// TCPProbeConf probe the cmd by a tcp connection
+type TCPProbeConf struct {
+	Address string `yaml:"address"` // host:port
+}
+
+// ExecProbeConf probe the cmd by running a command, exit code 0 means healthy
+type ExecProbeConf struct {
+	Cmd  string   `yaml:"cmd"`
+	Args []string `yaml:"args"`
+}
+
+// validate check h and fill default values, annotations are used to derive the default probe
+func (h *HealthCheckConf) validate(annotations map[string]string) error {
+	if h.Interval < 0 || h.Timeout < 0 || h.StartPeriod < 0 {
+		return errors.New("interval, timeout and startPeriod must not be negative")
+	}
+	if h.FailureThreshold < 0 {
+		return errors.New("failureThreshold must not be negative")
+	}
+	if h.Interval == 0 {
+		h.Interval = DefaultHealthInterval
+	}
+	if h.Timeout == 0 {
+		h.Timeout = DefaultHealthTimeout
+	}
+	if h.FailureThreshold == 0 {
+		h.FailureThreshold = DefaultHealthFailureThreshold
+	}
+
+	if h.HTTP == nil && h.TCP == nil && h.Exec == nil {
+		if annotations[AnnotationsPortKey] == "" {
+			return errors.New("no probe configured and no port annotation to derive one")
+		}
+		return nil
+	}
+	if h.HTTP != nil {
+		u, err := url.Parse(h.HTTP.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid http url %q", h.HTTP.URL)
+		}
+		if h.HTTP.ExpectedStatus != 0 && (h.HTTP.ExpectedStatus < 100 || h.HTTP.ExpectedStatus > 599) {
+			return fmt.Errorf("invalid http expectedStatus %d", h.HTTP.ExpectedStatus)
+		}
+	}
+	if h.TCP != nil {
+		if _, _, err := net.SplitHostPort(h.TCP.Address); err != nil {
+			return fmt.Errorf("invalid tcp address %q: %w", h.TCP.Address, err)
+		}
+	}
+	if h.Exec != nil && h.Exec.Cmd == "" {
+		return errors.New("exec cmd is empty")
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sq325/cmdDaemon/internal/logsink"
+)
+
+// LogConf is the rotation and format of the log file of a cmd, fallback to Conf.Defaults.
+// Zero values disable the corresponding rotation, the log file grows forever if neither
+// maxSize nor rotateEvery is set
+type LogConf struct {
+	// MaxSize rotate the log file before it exceeds the size, e.g. 100MB, 1GiB or bytes
+	MaxSize ByteSize `yaml:"maxSize"`
+	// RotateEvery rotate the log file every duration after it is opened
+	RotateEvery time.Duration `yaml:"rotateEvery"`
+	// MaxBackups is the number of rotated files kept, 0 keeps all
+	MaxBackups int `yaml:"maxBackups"`
+	// Compress gzip the rotated files. Default false
+	Compress *bool `yaml:"compress"`
+
+	// Split write stdout and stderr to <file>.stdout.log and <file>.stderr.log instead of one file. Default false
+	Split *bool `yaml:"split"`
+	// Prefix prefix each line with an RFC3339 timestamp, the stream name and the cmd name. Default false
+	Prefix *bool `yaml:"prefix"`
+}
+
+// WithDefaults return a copy of l, zero fields are filled by d
+func (l LogConf) WithDefaults(d LogConf) LogConf {
+	if l.MaxSize == 0 {
+		l.MaxSize = d.MaxSize
+	}
+	if l.RotateEvery == 0 {
+		l.RotateEvery = d.RotateEvery
+	}
+	if l.MaxBackups == 0 {
+		l.MaxBackups = d.MaxBackups
+	}
+	if l.Compress == nil {
+		l.Compress = d.Compress
+	}
+	if l.Split == nil {
+		l.Split = d.Split
+	}
+	if l.Prefix == nil {
+		l.Prefix = d.Prefix
+	}
+	return l
+}
+
+func (l LogConf) validate() error {
+	if l.MaxSize < 0 || l.RotateEvery < 0 || l.MaxBackups < 0 {
+		return errors.New("log: maxSize, rotateEvery and maxBackups must not be negative")
+	}
+	return nil
+}
+
+// LogSinkConf ship the output lines of a cmd to syslog or journald, in addition to or instead of the log file
+type LogSinkConf struct {
+	// Type is syslog (RFC5424) or journald (native protocol)
+	Type string `yaml:"type"`
+	// Address of syslog: unix:///dev/log (default), udp://host:514 or tcp://host:601.
+	// Path of the journald socket, default /run/systemd/journal/socket
+	Address string `yaml:"address"`
+	// Facility of syslog, e.g. local0. Default user
+	Facility string `yaml:"facility"`
+	// Tag is the syslog APP-NAME or journald SYSLOG_IDENTIFIER. Default the name annotation
+	Tag string `yaml:"tag"`
+	// File is whether to keep writing the log file. Default true
+	File *bool `yaml:"file"`
+}
+
+func (l *LogSinkConf) validate() error {
+	if _, _, err := logsink.ParseAddress(l.Type, l.Address); err != nil {
+		return fmt.Errorf("logSink: %w", err)
+	}
+	if _, err := logsink.ParseFacility(l.Facility); err != nil {
+		return fmt.Errorf("logSink: %w", err)
+	}
+	return nil
+}
+
+// ByteSize is a size in bytes, unmarshaled from a number of bytes or a string like 100MB or 1GiB
+type ByteSize int64
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KB":  1 << 10,
+	"KIB": 1 << 10,
+	"M":   1 << 20,
+	"MB":  1 << 20,
+	"MIB": 1 << 20,
+	"G":   1 << 30,
+	"GB":  1 << 30,
+	"GIB": 1 << 30,
+}
+
+// ParseByteSize parse a size like 100MB, 1GiB, 512k or 1024, units are powers of 1024
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' && r != '-' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	unit, ok := byteUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q, unknown unit %q", s, s[i:])
+	}
+	return ByteSize(n * float64(unit)), nil
+}
+
+// UnmarshalYAML implement yaml.Unmarshaler
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	size, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// MarshalYAML implement yaml.Marshaler
+func (b ByteSize) MarshalYAML() (interface{}, error) {
+	return int64(b), nil
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    ByteSize
+		wantErr bool
+	}{
+		{s: "1024", want: 1024},
+		{s: "512k", want: 512 << 10},
+		{s: "100MB", want: 100 << 20},
+		{s: "1.5 GiB", want: 3 << 29},
+		{s: "10XB", wantErr: true},
+		{s: "MB", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseByteSize(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseByteSize(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestUnmarshalLogConf(t *testing.T) {
+	yml := `defaults:
+  log:
+    maxSize: 100MB
+    maxBackups: 7
+    compress: true
+    prefix: true
+cmds:
+  - cmd: sleep
+  - cmd: sleep
+    log:
+      maxSize: 1024
+      rotateEvery: 24h
+      compress: false
+      split: true
+`
+	conf, err := Unmarshal([]byte(yml))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	l := conf.Cmds[0].Log
+	if l.MaxSize != 100<<20 || l.RotateEvery != 0 || l.MaxBackups != 7 || l.Compress == nil || !*l.Compress {
+		t.Errorf("cmds[0] log = %+v", l)
+	}
+	l = conf.Cmds[1].Log
+	if l.MaxSize != 1024 || l.RotateEvery != 24*time.Hour || l.MaxBackups != 7 || l.Compress == nil || *l.Compress {
+		t.Errorf("cmds[1] log = %+v", l)
+	}
+	if l.Split == nil || !*l.Split || l.Prefix == nil || !*l.Prefix || conf.Cmds[0].Log.Split != nil {
+		t.Errorf("split and prefix of cmds[1] = %v, %v", l.Split, l.Prefix)
+	}
+
+	if _, err := Unmarshal([]byte("cmds:\n  - cmd: sleep\n    log:\n      maxBackups: -1\n")); err == nil {
+		t.Error("Expected error for negative maxBackups, but got nil")
+	}
+}
+
+func TestUnmarshalLogSink(t *testing.T) {
+	conf, err := Unmarshal([]byte("cmds:\n  - cmd: sleep\n    logSink:\n      type: syslog\n      address: udp://127.0.0.1:514\n      facility: local0\n      file: false\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if s := conf.Cmds[0].LogSink; s == nil || s.Type != "syslog" || s.Facility != "local0" || s.File == nil || *s.File {
+		t.Errorf("logSink = %+v", s)
+	}
+	for _, yml := range []string{
+		"cmds:\n  - cmd: sleep\n    logSink:\n      type: kafka\n",
+		"cmds:\n  - cmd: sleep\n    logSink:\n      type: syslog\n      address: tcp://localhost\n",
+		"cmds:\n  - cmd: sleep\n    logSink:\n      type: syslog\n      facility: local9\n",
+	} {
+		if _, err := Unmarshal([]byte(yml)); err == nil {
+			t.Errorf("Expected error for %q, but got nil", yml)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/sq325/cmdDaemon/internal/tool"
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+var ErrCmdNotInFile = errors.New("cmd not found in config file")
+
+// AddCmdToFile append the cmd spec, a yaml or json mapping, to the cmds of the config file.
+// The rest of the file, including comments, is kept as is, see editCmds
+func AddCmdToFile(file string, spec []byte) error {
+	var node yamlv3.Node
+	if err := yamlv3.Unmarshal(spec, &node); err != nil {
+		return fmt.Errorf("parse cmd: %w", err)
+	}
+	if len(node.Content) == 0 || node.Content[0].Kind != yamlv3.MappingNode {
+		return errors.New("parse cmd: not a mapping")
+	}
+	cmd := node.Content[0]
+	blockStyle(cmd)
+	return editCmds(file, func(_ *Conf, cmds *yamlv3.Node) error {
+		cmds.Content = append(cmds.Content, cmd)
+		return nil
+	})
+}
+
+// blockStyle convert the style of a json spec, flow mappings and sequences and quoted strings,
+// to the block style of config files. Strings are still quoted if needed, e.g. port: "9091"
+func blockStyle(node *yamlv3.Node) {
+	node.Style = 0
+	for _, n := range node.Content {
+		blockStyle(n)
+	}
+}
+
+// RemoveCmdFromFile remove the cmd identified by id, see Conf.CmdIDs, from the cmds of the config file
+func RemoveCmdFromFile(file string, id string) error {
+	return editCmds(file, func(conf *Conf, cmds *yamlv3.Node) error {
+		for i, cmdID := range conf.CmdIDs() {
+			if cmdID == id && i < len(cmds.Content) {
+				cmds.Content = append(cmds.Content[:i], cmds.Content[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrCmdNotInFile, id)
+	})
+}
+
+// editCmds call edit with the conf and the cmds sequence node of the config file,
+// then write the edited node tree back to the file atomically
+func editCmds(file string, edit func(conf *Conf, cmds *yamlv3.Node) error) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var conf Conf
+	if err := yaml.Unmarshal(b, &conf); err != nil {
+		return fmt.Errorf("parse %s: %w", file, err)
+	}
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(b, &doc); err != nil {
+		return fmt.Errorf("parse %s: %w", file, err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yamlv3.MappingNode {
+		return fmt.Errorf("parse %s: not a mapping", file)
+	}
+	root := doc.Content[0]
+
+	var cmds *yamlv3.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "cmds" {
+			cmds = root.Content[i+1]
+			break
+		}
+	}
+	if cmds == nil {
+		cmds = &yamlv3.Node{Kind: yamlv3.SequenceNode, Tag: "!!seq"}
+		root.Content = append(root.Content, &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: "cmds"}, cmds)
+	}
+	if cmds.Kind == yamlv3.ScalarNode && cmds.Tag == "!!null" { // cmds:
+		*cmds = yamlv3.Node{Kind: yamlv3.SequenceNode, Tag: "!!seq"}
+	}
+	if cmds.Kind != yamlv3.SequenceNode {
+		return fmt.Errorf("parse %s: cmds is not a sequence", file)
+	}
+	if err := edit(&conf, cmds); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := yamlv3.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return fmt.Errorf("encode %s: %w", file, err)
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("encode %s: %w", file, err)
+	}
+	return tool.WriteFileAtomic(file, buf.Bytes())
+}
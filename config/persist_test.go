@@ -0,0 +1,66 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAddAndRemoveCmdFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "daemon.yml")
+	if err := os.WriteFile(file, []byte(`defaults:
+  restartLimit: 3 # 重启次数
+cmds:
+  # 代理
+  - cmd: proxy
+    annotations:
+      port: "8080"
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddCmdToFile(file, []byte(`{"cmd": "sleep", "args": ["100"], "annotations": {"name": "sleeper"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# 重启次数", "# 代理", "- cmd: sleep\n", "name: sleeper"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("config file = %s, want containing %q", b, want)
+		}
+	}
+	if info, _ := os.Stat(file); info.Mode().Perm() != 0600 {
+		t.Errorf("config file mode = %v, want 0600", info.Mode().Perm())
+	}
+	conf, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := conf.CmdIDs(); !slices.Equal(ids, []string{"proxy:8080", "sleeper"}) {
+		t.Fatalf("CmdIDs() after add = %v", ids)
+	}
+
+	if err := RemoveCmdFromFile(file, "proxy:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveCmdFromFile(file, "proxy:8080"); !errors.Is(err, ErrCmdNotInFile) {
+		t.Errorf("RemoveCmdFromFile(removed) error = %v, want ErrCmdNotInFile", err)
+	}
+	b, _ = os.ReadFile(file)
+	conf, err = Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := conf.CmdIDs(); !slices.Equal(ids, []string{"sleeper"}) || *conf.Defaults.RestartLimit != 3 {
+		t.Errorf("config after remove = %s", b)
+	}
+
+	if err := AddCmdToFile(file, []byte("- cmd: sleep")); err == nil {
+		t.Error("AddCmdToFile(sequence) error = nil")
+	}
+}
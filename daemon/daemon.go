@@ -3,31 +3,48 @@ package daemon
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"os/exec"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sq325/cmdDaemon/config"
+	"github.com/sq325/cmdDaemon/internal/loki"
 	"github.com/sq325/cmdDaemon/internal/tool"
 )
 
-const (
-	Exited = iota
-	Running
-)
-
 var (
-	ErrNoCmdFound   = errors.New("no cmd found")
-	ErrLimitReached = errors.New("restart limit reached")
+	ErrNoCmdFound        = errors.New("no cmd found")
+	ErrLimitReached      = errors.New("restart limit reached")
+	ErrInvalidTransition = errors.New("invalid state transition")
+	ErrNotRunning        = errors.New("cmd not running")
+	ErrStopTimeout       = errors.New("stop timeout")
+	ErrUnhealthy         = errors.New("health check failed")
+	ErrAmbiguousCmd      = errors.New("multiple cmds found")
+	ErrCmdExists         = errors.New("cmd already exists")
+	ErrInvalidConf       = errors.New("invalid cmd config")
+	ErrNoLogFile         = errors.New("no log file opened")
 )
 
 // Daemon is a daemon that manages multiple dcmds
 type Daemon struct {
-	ctx context.Context
+	ctx      context.Context
+	logDir   string          // 子进程日志目录
+	defaults config.Defaults // 配置文件中的defaults, AddCmd时合并到新cmd
+
+	mu     sync.Mutex   // 串行化Reload、AddCmd和RemoveCmd对DCmds的修改
+	cmdsMu sync.RWMutex // 保护DCmds, 修改时替换为新的slice, 读取方通过GetDCmds获取快照
 
 	exitedCmdCh chan *DaemonCmd
 	DCmds       []*DaemonCmd
 
+	events  *EventBus     // 生命周期事件, 保留最近的事件供查询
+	history *historyStore // 每个cmd最近的运行记录, 可以保存到状态文件
+	loki    *loki.Client  // 推送子进程输出到Loki, nil表示不推送
+
 	Logger *slog.Logger
 }
 
@@ -37,8 +54,13 @@ func NewDaemon(ctx context.Context, dcmds []*DaemonCmd, logger *slog.Logger) *Da
 		exitedCmdCh: make(chan *DaemonCmd, 20),
 		DCmds:       dcmds,
 		Logger:      logger,
+		history:     newHistoryStore(DefaultRunHistory, logger),
+	}
+	for _, dcmd := range dcmds {
+		withHistory(d.history)(dcmd)
 	}
 	WithCmdLogDir("./log")(d)
+	WithEventHistory(DefaultEventHistory)(d)
 	return d
 }
 
@@ -47,31 +69,6 @@ func (d *Daemon) Run() {
 	// 运行all cmds
 	// exitedCmdCh生产者
 	go d.run()
-	// 初始化restart指标
-	for _, dcmd := range d.DCmds {
-		dcmdRestartCount.WithLabelValues(
-			dcmd.Annotations[AnnotationsNameKey],
-			dcmd.Annotations[AnnotationsPortKey],
-			dcmd.Annotations[AnnotationsHostnameKey],
-			dcmd.Annotations[AnnotationsIPKey],
-			dcmd.Annotations[AnnotationsAppKey],
-		).Add(0)
-	}
-
-	// 每30分钟重置所有cmd的limiter
-	limitResetTicker := time.NewTicker(30 * time.Minute)
-	defer limitResetTicker.Stop()
-	go func() {
-		for {
-			select {
-			case <-d.ctx.Done():
-				return
-			case <-limitResetTicker.C:
-				d.resetLimiter()
-				d.Logger.Info("Reseted all cmd's limiter")
-			}
-		}
-	}()
 
 	// 每15分钟打印一次所有running cmd
 	printCmdTicker := time.NewTicker(20 * time.Minute)
@@ -83,13 +80,13 @@ func (d *Daemon) Run() {
 				return
 			case <-printCmdTicker.C:
 				d.Logger.Info("Print all cmd's limiter")
-				for _, dCmd := range d.DCmds {
-					if dCmd.Status == Exited {
-						d.Logger.Error("Command exited", "cmd", dCmd.Cmd.String())
+				for _, dCmd := range d.GetDCmds() {
+					if state := dCmd.State(); state != Running {
+						d.Logger.Error("Command not running", "cmd", dCmd.String(), "state", state, "since", dCmd.StateSince().Format(time.DateTime))
 						continue
 					}
 					dCmd.mu.Lock()
-					d.Logger.Info("Command status", "cmd", dCmd.Cmd.String(), "pid", dCmd.Cmd.Process.Pid, "restarts", dCmd.Limiter.count)
+					d.Logger.Info("Command status", "cmd", dCmd.String(), "pid", dCmd.Cmd.Process.Pid, "health", dCmd.healthStatus, "limiter", dCmd.Limiter.Status())
 					dCmd.mu.Unlock()
 				}
 				printCmdTicker.Reset(15 * time.Minute)
@@ -109,32 +106,60 @@ func (d *Daemon) Run() {
 		case dcmd := <-d.exitedCmdCh:
 			// 打印错误原因
 			dcmd.mu.Lock()
-			d.Logger.Warn("Command error", "cmd", dcmd.Cmd.String(), "error", dcmd.Err)
-			d.Logger.Warn("Restarting command", "cmd", dcmd.Cmd.String(), "restarts", dcmd.Limiter.count)
+			d.Logger.Warn("Command error", "cmd", dcmd.String(), "error", dcmd.Err)
+			dcmd.mu.Unlock()
+			// 根据重启策略判断是否需要重启
+			if !dcmd.shouldRestart() {
+				d.Logger.Info("Command exited, not restarting due to restart policy", "cmd", dcmd.String(), "policy", dcmd.restartPolicy)
+				continue
+			}
+			dcmd.mu.Lock()
+			if err := dcmd.setStateLocked(Backoff); err != nil {
+				dcmd.mu.Unlock()
+				d.Logger.Warn("Command not restarted", "cmd", dcmd.String(), "error", err)
+				continue
+			}
+			d.Logger.Warn("Restarting command", "cmd", dcmd.String(), "restarts", dcmd.Limiter.Status().Restarts)
+			gen := dcmd.gen // 等待期间被停止或手动启动时gen改变, 不再重启
 			dcmd.mu.Unlock()
 			go func() {
-				select {
-				case <-d.ctx.Done():
-					return
-				// 等到下次重启时间到了再重启
-				case <-time.After(time.Until(dcmd.Limiter.next())):
-					// 重启cmd
-					dcmd.update()
+				for {
+					select {
+					case <-d.ctx.Done():
+						return
+					// 等到下次重启时间到了再重启, cooldown中则等到cooldown结束
+					case <-time.After(time.Until(dcmd.Limiter.Next())):
+					}
+					// 等待期间被停止或手动启动, 不再重启, 也不计入已重置的Limiter
+					if !dcmd.restartPending(gen) {
+						return
+					}
 					// 没超过limit，重启cmd
 					if ok := dcmd.Limiter.Inc(); ok {
-						d.Logger.Warn("Command restarted")
-						dcmdRestartCount.WithLabelValues(
-							dcmd.Annotations[AnnotationsNameKey],
-							dcmd.Annotations[AnnotationsPortKey],
-							dcmd.Annotations[AnnotationsHostnameKey],
-							dcmd.Annotations[AnnotationsIPKey],
-							dcmd.Annotations[AnnotationsAppKey],
-						).Inc()
+						if !dcmd.update(gen) {
+							return
+						}
+						d.Logger.Warn("Command restarted", "cmd", dcmd.String())
+						e := NewCmdEvent(dcmd, EventRestart)
+						e.Message = fmt.Sprintf("restarts: %d", dcmd.Limiter.Status().Restarts)
+						d.events.Publish(e)
 						dcmd.startAndWait(d.exitedCmdCh)
 						return
 					}
-					// 如果超过limit的次数限制，就不再重启
-					d.Logger.Error("Command restart limit reached", "cmd", dcmd.Cmd.String(), "error", ErrLimitReached.Error())
+					// 超过limit的次数限制, 如果配置了cooldown, 等待cooldown结束后再尝试重启
+					if until, ok := dcmd.Limiter.CooldownUntil(); ok {
+						d.Logger.Error("Command restart limit reached, cooling down", "cmd", dcmd.String(), "until", until.Format(time.DateTime), "error", ErrLimitReached.Error())
+						e := NewCmdEvent(dcmd, EventLimitReached)
+						e.Message, e.Err = "cooling down until "+until.Format(time.DateTime), ErrLimitReached.Error()
+						d.events.Publish(e)
+						continue
+					}
+					// 否则不再重启
+					d.Logger.Error("Command restart limit reached", "cmd", dcmd.String(), "error", ErrLimitReached.Error())
+					e := NewCmdEvent(dcmd, EventLimitReached)
+					e.Message, e.Err = "giving up", ErrLimitReached.Error()
+					d.events.Publish(e)
+					dcmd.setState(Fatal)
 					return
 				}
 			}()
@@ -142,53 +167,264 @@ func (d *Daemon) Run() {
 	}
 }
 
-// run start all cmds and wait for them to exit
+// run start all cmds and wait for them to exit.
+// A cmd is started after all its dependencies are ready
 func (d *Daemon) run() {
-	for _, dCmd := range d.DCmds {
-		go dCmd.startAndWait(d.exitedCmdCh)
+	for _, dCmd := range d.GetDCmds() {
+		d.start(dCmd)
 	}
 }
 
-// resetLimiter reset all cmds' limiter
-func (d *Daemon) resetLimiter() {
-	for _, dCmd := range d.DCmds {
-		dCmd.Limiter.Reset()
+// start run dcmd in a new goroutine after its dependencies are ready
+func (d *Daemon) start(dcmd *DaemonCmd) {
+	gen := dcmd.generation()
+	go func() {
+		if !d.waitDependencies(dcmd) {
+			return
+		}
+		// 等待依赖期间被停止或重新启动
+		if dcmd.generation() != gen {
+			return
+		}
+		dcmd.startAndWait(d.exitedCmdCh)
+	}()
+}
+
+// Conf return the config of the running dcmds, defaults are already merged into each cmd
+func (d *Daemon) Conf() *config.Conf {
+	return d.confOf(d.GetDCmds())
+}
+
+func (d *Daemon) confOf(dcmds []*DaemonCmd) *config.Conf {
+	conf := &config.Conf{Defaults: d.defaults, Cmds: make([]config.CmdConf, 0, len(dcmds))}
+	for _, dcmd := range dcmds {
+		conf.Cmds = append(conf.Cmds, dcmd.conf)
 	}
+	return conf
+}
+
+// Diff compare conf with the config of the running dcmds without applying it,
+// using the same identity rules as Reload
+func (d *Daemon) Diff(conf *config.Conf) (*config.ConfDiff, error) {
+	diff, _, _, _, err := d.diff(conf)
+	return diff, err
 }
 
-// Reload reload all dcmds and ctx
-func (d *Daemon) Reload(ctx context.Context, cmds []*exec.Cmd, annotationsList []map[string]string) {
-	d.DCmds = make([]*DaemonCmd, 0, len(cmds))
-	// drain channel
-	close(d.exitedCmdCh)
-	if d.exitedCmdCh != nil {
-		for range d.exitedCmdCh {
+// diff return the diff between the running dcmds and conf, the cmds and annotations generated from conf,
+// and the running dcmds keyed by id
+func (d *Daemon) diff(conf *config.Conf) (*config.ConfDiff, []*exec.Cmd, []map[string]string, map[string]*DaemonCmd, error) {
+	cmds, annotationsList, err := config.GenerateCmds(conf)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidConf, err)
+	}
+	ids := conf.CmdIDs()
+	dcmds := d.GetDCmds()
+	oldConf := d.confOf(dcmds)
+	diff := config.Diff(oldConf, conf)
+
+	running := make(map[string]*DaemonCmd, len(dcmds))
+	for i, id := range oldConf.CmdIDs() {
+		running[id] = dcmds[i]
+	}
+
+	// 配置相同但envFile内容变化的cmd也需要重启
+	for _, c := range slices.Clone(diff.Unchanged) {
+		i := slices.Index(ids, c.ID)
+		old := running[c.ID]
+		old.mu.Lock()
+		env := old.Cmd.Env
+		old.mu.Unlock()
+		if !slices.Equal(env, cmds[i].Env) {
+			diff.Unchanged = slices.DeleteFunc(diff.Unchanged, func(u config.CmdDiff) bool { return u.ID == c.ID })
+			c.Fields = append(c.Fields, "envFile")
+			diff.Changed = append(diff.Changed, c)
 		}
 	}
+	return diff, cmds, annotationsList, running, nil
+}
 
-	d.exitedCmdCh = make(chan *DaemonCmd, 20)
-	d.ctx = ctx
+// Reload apply conf to the running daemon by diffing it with the current config:
+// removed cmds are stopped, added cmds are started, changed cmds are restarted,
+// and unchanged cmds keep running with their Limiter state.
+// ctx bounds stopping the removed and changed cmds, see DaemonCmd.Stop.
+// Return ErrInvalidConf and keep the running cmds if a cmd of conf can not be generated, see config.GenerateCmds
+func (d *Daemon) Reload(ctx context.Context, conf *config.Conf) (*config.ConfDiff, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	diff, cmds, annotationsList, running, err := d.diff(conf)
+	if err != nil {
+		d.events.Publish(Event{Type: EventReload, Err: err.Error()})
+		return nil, err
+	}
+	d.defaults = conf.Defaults
+	ids := conf.CmdIDs()
+
+	unchanged := make(map[string]bool, len(diff.Unchanged))
+	for _, c := range diff.Unchanged {
+		unchanged[c.ID] = true
+	}
+
+	var stale, fresh []*DaemonCmd
+	dcmds := make([]*DaemonCmd, 0, len(cmds))
 	for i, cmd := range cmds {
-		dCmd := NewDaemonCmd(d.ctx, cmd, annotationsList[i])
-		d.DCmds = append(d.DCmds, dCmd)
+		if unchanged[ids[i]] {
+			dcmds = append(dcmds, running[ids[i]])
+			continue
+		}
+		if old, ok := running[ids[i]]; ok {
+			stale = append(stale, old)
+		}
+		dcmd := NewDaemonCmd(d.ctx, cmd, annotationsList[i], WithCmdConf(conf.Cmds[i]), withID(ids[i]), withLogDir(d.logDir), withEvents(d.events), withHistory(d.history), withLoki(d.loki))
+		dcmds = append(dcmds, dcmd)
+		fresh = append(fresh, dcmd)
+	}
+	for _, c := range diff.Removed {
+		stale = append(stale, running[c.ID])
+	}
+
+	err = d.stop(ctx, stale)
+	d.setDCmds(dcmds)
+	// 停止后再删除, 停止时会添加运行记录
+	for _, c := range diff.Removed {
+		d.history.remove(c.ID)
+	}
+	for _, dcmd := range fresh {
+		d.start(dcmd)
+	}
+	e := Event{Type: EventReload, Message: fmt.Sprintf("added: %d, removed: %d, changed: %d, unchanged: %d",
+		len(diff.Added), len(diff.Removed), len(diff.Changed), len(diff.Unchanged))}
+	if err != nil {
+		e.Err = err.Error()
+	}
+	d.events.Publish(e)
+	return diff, err
+}
+
+// AddCmd validate c against the running config, defaults of the config file are applied,
+// then start supervising it after its dependencies are ready.
+// Return ErrCmdExists if a dcmd with the same name and port annotations exists
+func (d *Daemon) AddCmd(c config.CmdConf) (*DaemonCmd, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	conf := d.Conf()
+	ids := conf.CmdIDs()
+	conf.Cmds = append(conf.Cmds, c)
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConf, err)
+	}
+	added := &config.Conf{Cmds: conf.Cmds[len(conf.Cmds)-1:]}
+	cmds, annotationsList, err := config.GenerateCmds(added)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConf, err)
+	}
+	id := conf.CmdIDs()[len(ids)]
+	if slices.ContainsFunc(d.DCmds, func(dcmd *DaemonCmd) bool {
+		return dcmd.Annotations[AnnotationsNameKey] == annotationsList[0][AnnotationsNameKey] &&
+			dcmd.Annotations[AnnotationsPortKey] == annotationsList[0][AnnotationsPortKey]
+	}) {
+		return nil, fmt.Errorf("%w: %s, set a distinct name annotation", ErrCmdExists, id)
+	}
+
+	dcmd := NewDaemonCmd(d.ctx, cmds[0], annotationsList[0], WithCmdConf(added.Cmds[0]), withID(id), withLogDir(d.logDir), withEvents(d.events), withHistory(d.history), withLoki(d.loki))
+	d.setDCmds(append(slices.Clone(d.DCmds), dcmd))
+	d.Logger.Info("Command added", "cmd", dcmd.String(), "id", id)
+	d.start(dcmd)
+	return dcmd, nil
+}
+
+// RemoveCmd stop dcmd gracefully, see DaemonCmd.Stop, and stop supervising it.
+// Return ErrInvalidConf if other dcmds depend on it
+func (d *Daemon) RemoveCmd(ctx context.Context, dcmd *DaemonCmd) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	i := slices.Index(d.DCmds, dcmd)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrNoCmdFound, dcmd.ID())
+	}
+	conf := d.Conf()
+	conf.Cmds = slices.Delete(conf.Cmds, i, i+1)
+	if err := conf.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConf, err)
+	}
+
+	err := d.stop(ctx, []*DaemonCmd{dcmd})
+	d.setDCmds(slices.Delete(slices.Clone(d.DCmds), i, i+1))
+	d.history.remove(dcmd.ID())
+	d.Logger.Info("Command removed", "cmd", dcmd.String(), "id", dcmd.ID())
+	return err
+}
+
+// Stop stop all dcmds in reverse dependency order, see DaemonCmd.Stop.
+// A dcmd is stopped after all dcmds depending on it are stopped, independent dcmds are stopped concurrently
+func (d *Daemon) Stop(ctx context.Context) error {
+	return d.stop(ctx, d.GetDCmds())
+}
+
+// stop stop dcmds, a subset of d.DCmds, in reverse dependency order
+func (d *Daemon) stop(ctx context.Context, dcmds []*DaemonCmd) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs error
+	)
+	stopped := make(map[*DaemonCmd]chan struct{}, len(dcmds))
+	for _, dcmd := range dcmds {
+		stopped[dcmd] = make(chan struct{})
 	}
+	dependents := make(map[*DaemonCmd][]*DaemonCmd, len(dcmds))
+	for _, dcmd := range dcmds {
+		for _, dep := range d.dependencies(dcmd) {
+			if _, ok := stopped[dep]; ok {
+				dependents[dep] = append(dependents[dep], dcmd)
+			}
+		}
+	}
+	for _, dcmd := range dcmds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(stopped[dcmd])
+			for _, dependent := range dependents[dcmd] {
+				<-stopped[dependent]
+			}
+			if err := dcmd.Stop(ctx); err != nil {
+				mu.Lock()
+				errs = errors.Join(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
 }
 
-// GetDCmds return all dcmds
+// GetDCmds return a snapshot of all dcmds, safe to use while cmds are added or removed
 func (d *Daemon) GetDCmds() []*DaemonCmd {
+	d.cmdsMu.RLock()
+	defer d.cmdsMu.RUnlock()
 	return d.DCmds
 }
 
+// setDCmds replace DCmds, the old slice is not modified, d.mu must be held
+func (d *Daemon) setDCmds(dcmds []*DaemonCmd) {
+	d.cmdsMu.Lock()
+	defer d.cmdsMu.Unlock()
+	d.DCmds = dcmds
+}
+
 // cmdsLen return the number of cmds
 func (d *Daemon) cmdsLen() int {
-	return len(d.DCmds)
+	return len(d.GetDCmds())
 }
 
-// GetExitedCmdLen return the number of exited cmds
+// GetExitedCmdLen return the number of exited cmds, including cmds waiting to restart and gave up
 func (d *Daemon) GetExitedCmdLen() int {
 	var count int
-	for _, dcmd := range d.DCmds {
-		if dcmd.Status == Exited {
+	for _, dcmd := range d.GetDCmds() {
+		switch dcmd.State() {
+		case Exited, Backoff, Fatal:
 			count++
 		}
 	}
@@ -197,8 +433,8 @@ func (d *Daemon) GetExitedCmdLen() int {
 
 func (d *Daemon) GetRunningCmdLen() int {
 	var count int
-	for _, dcmd := range d.DCmds {
-		if dcmd.Status == Running {
+	for _, dcmd := range d.GetDCmds() {
+		if dcmd.State() == Running {
 			count++
 		}
 	}
@@ -206,7 +442,7 @@ func (d *Daemon) GetRunningCmdLen() int {
 }
 
 func (d *Daemon) GetDCmdByCmd(cmd *exec.Cmd) (*DaemonCmd, error) {
-	for _, dcmd := range d.DCmds {
+	for _, dcmd := range d.GetDCmds() {
 		hash := tool.HashCmd(cmd)
 		if hash == dcmd.CmdHash() {
 			return dcmd, nil
@@ -215,6 +451,51 @@ func (d *Daemon) GetDCmdByCmd(cmd *exec.Cmd) (*DaemonCmd, error) {
 	return nil, ErrNoCmdFound
 }
 
+// GetDCmdByID return the dcmd identified by id, which is the config identity (see DaemonCmd.ID),
+// the CmdHash or the name annotation. Return ErrAmbiguousCmd if several dcmds share the name
+func (d *Daemon) GetDCmdByID(id string) (*DaemonCmd, error) {
+	for _, dcmd := range d.GetDCmds() {
+		if dcmd.ID() == id || dcmd.CmdHash() == id {
+			return dcmd, nil
+		}
+	}
+	var found *DaemonCmd
+	for _, dcmd := range d.GetDCmds() {
+		if dcmd.Annotations[AnnotationsNameKey] != id {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%w: %s, use id or hash instead", ErrAmbiguousCmd, id)
+		}
+		found = dcmd
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoCmdFound, id)
+	}
+	return found, nil
+}
+
+// StartCmd start a stopped, exited or gave up dcmd after its dependencies are ready.
+// A dcmd waiting to restart is started immediately.
+// The Limiter is reset, so the dcmd is restarted by its restart policy again
+func (d *Daemon) StartCmd(dcmd *DaemonCmd) error {
+	if err := dcmd.reset(); err != nil {
+		return err
+	}
+	dcmd.Limiter.Reset()
+	d.Logger.Info("Starting command", "cmd", dcmd.String())
+	d.start(dcmd)
+	return nil
+}
+
+// RestartCmd stop dcmd gracefully, see DaemonCmd.Stop, then start it again, see StartCmd
+func (d *Daemon) RestartCmd(ctx context.Context, dcmd *DaemonCmd) error {
+	if err := dcmd.Stop(ctx); err != nil {
+		return err
+	}
+	return d.StartCmd(dcmd)
+}
+
 func (d *Daemon) RegisterMetrics(r prometheus.Registerer) error {
 	if r == nil {
 		return errors.New("prometheus registerer is nil")
@@ -228,11 +509,74 @@ func (d *Daemon) RegisterMetrics(r prometheus.Registerer) error {
 
 type DaemonFunc func(d *Daemon)
 
+// WithDefaults set the defaults of the config file, applied to cmds added by AddCmd
+func WithDefaults(defaults config.Defaults) DaemonFunc {
+	return func(d *Daemon) {
+		if d == nil {
+			return
+		}
+		d.defaults = defaults
+	}
+}
+
+// Events return the EventBus of the lifecycle events of the daemon and its dcmds
+func (d *Daemon) Events() *EventBus {
+	return d.events
+}
+
+// WithEventHistory replace the EventBus with a new one keeping the latest size events, see NewEventBus
+func WithEventHistory(size int) DaemonFunc {
+	return func(d *Daemon) {
+		if d == nil {
+			return
+		}
+		d.events = NewEventBus(size)
+		for _, dcmd := range d.DCmds {
+			withEvents(d.events)(dcmd)
+		}
+	}
+}
+
+// WithStateFile load the run history saved in file, and save the history of later runs to it,
+// so the history survives daemon restarts, see DaemonCmd.History.
+// The runs of cmds no longer in d are dropped, so apply it after the dcmds are created
+func WithStateFile(file string) DaemonFunc {
+	return func(d *Daemon) {
+		if d == nil {
+			return
+		}
+		if err := d.history.load(file); err != nil {
+			d.Logger.Error("Load state file failed", "file", file, "error", err)
+		}
+		// 守护进程停止期间从配置中删除或修改的cmd不再保留
+		var ids []string
+		for _, dcmd := range d.GetDCmds() {
+			ids = append(ids, dcmd.ID())
+		}
+		d.history.prune(ids)
+	}
+}
+
+// WithLoki push the output lines of all dcmds to Loki through c, labeled by the name, app,
+// hostname and ip annotations and the stream. c is shared by the dcmds and stopped by the caller after Stop
+func WithLoki(c *loki.Client) DaemonFunc {
+	return func(d *Daemon) {
+		if d == nil {
+			return
+		}
+		d.loki = c
+		for _, dcmd := range d.DCmds {
+			withLoki(c)(dcmd)
+		}
+	}
+}
+
 func WithCmdLogDir(logDir string) DaemonFunc {
 	return func(d *Daemon) {
 		if d == nil {
 			return
 		}
+		d.logDir = logDir
 		for _, dcmd := range d.DCmds {
 			withLogDir(logDir)(dcmd)
 		}
@@ -2,13 +2,19 @@ package daemon
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"slices"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/sq325/cmdDaemon/config"
+	"github.com/sq325/cmdDaemon/internal/logfile"
+	"github.com/sq325/cmdDaemon/internal/loki"
 	"github.com/sq325/cmdDaemon/internal/tool"
 )
 
@@ -37,103 +43,642 @@ type DaemonCmd struct {
 	// 	 ip: "12.12.12.12" // 默认/etc/hosts中根据hostname查找
 	// 	 metricsPath: "/metrics" // 需填写，如果为""，表示该cmd不提供metrics
 	Annotations map[string]string // cmd的注释信息, name, hostName, ip, port
-	Status      int               // running: 1, exited: 0
 	Err         error             // 退出原因
 
-	logDir string // 日志文件路径
+	state      State     // 生命周期状态, 通过setState修改
+	stateSince time.Time // 进入当前状态的时间
+
+	logDir    string              // 日志文件路径
+	logOpts   logfile.Options     // 日志文件的轮转配置
+	logSplit  bool                // stdout和stderr写入不同的文件
+	logPrefix bool                // 每行前加时间戳、流名称和cmd名称
+	logFiles  []*logfile.File     // 当前运行的日志文件, 未运行或不写日志时为空
+	logErr    error               // 当前运行首次写日志文件失败的原因
+	logs      *logBuffer          // 内存中最近的输出行, 跨重启保留
+	logSink   *config.LogSinkConf // 发送输出到syslog或journald, nil表示不发送
+	loki      *loki.Client        // 推送输出到Loki, nil表示不推送
+
+	restartPolicy    config.RestartPolicy // 重启策略, 默认always
+	successExitCodes []int                // on-failure策略下视为成功的退出码
+	umask            int                  // 子进程的umask, -1表示继承守护进程的umask
+
+	stopSignal  syscall.Signal // 停止时发送给进程组的信号, 默认SIGTERM
+	stopTimeout time.Duration  // 发送stopSignal后等待退出的时间, 超时后发送SIGKILL
+	exited      chan struct{}  // 每次启动时创建, startAndWait返回时关闭
+	gen         int            // 每次Stop或reset时递增, 等待依赖期间被停止的cmd不再启动
+
+	starts       int  // 进程成功启动的次数
+	autoRestarts int  // 守护进程按重启策略重启的次数, 不包括手动重启
+	exitCode     int  // 最近一次退出的退出码, 被信号终止时为-1
+	exitedOk     bool // 是否退出过, 为false时exitCode无意义
+
+	dependsOn []string // 依赖的cmd名称, 依赖就绪后才启动
+
+	health       *healthChecker // 主动健康检查, nil表示不检查
+	healthStatus HealthStatus   // 健康检查状态
+	healthErr    error          // 最近一次健康检查失败的原因
+
+	critical bool // daemon就绪需要此cmd就绪
+
+	events *EventBus // 发布生命周期事件, nil表示不发布
+
+	history     *historyStore // 运行记录, nil表示不记录
+	startReason StartReason   // 下次启动的原因, 为空表示StartReasonStart
+
+	id   string         // 配置中的稳定标识, 用于reload时对比新旧配置
+	conf config.CmdConf // 生成此cmd的配置
+
+	// 重启时Cmd被替换, 但cmd和args不变, 缓存以便无锁读取
+	cmdline string
+	hash    string
 }
 
-func NewDaemonCmd(ctx context.Context, cmd *exec.Cmd, anotations map[string]string) *DaemonCmd {
-	return &DaemonCmd{
-		ctx:         ctx,
-		Cmd:         cmd,
-		Annotations: anotations,
-		Limiter:     NewLimiter(),
+// killWait 发送SIGKILL后等待进程退出的时间
+const killWait = 5 * time.Second
+
+// waitDelay 主进程退出后等待stderr关闭的时间, 防止残留的子进程持有stderr导致Wait阻塞
+const waitDelay = time.Second
+
+func NewDaemonCmd(ctx context.Context, cmd *exec.Cmd, anotations map[string]string, opts ...DaemonCmdFunc) *DaemonCmd {
+	dcmd := &DaemonCmd{
+		ctx:              ctx,
+		Cmd:              cmd,
+		Annotations:      anotations,
+		Limiter:          NewLimiter(config.LimiterConf{}),
+		restartPolicy:    config.RestartAlways,
+		successExitCodes: []int{0},
+		umask:            -1,
+		healthStatus:     HealthUnknown,
+		stopSignal:       config.DefaultStopSignal,
+		stopTimeout:      config.DefaultStopTimeout,
+		state:            Stopped,
+		stateSince:       time.Now(),
+		cmdline:          cmd.String(),
+		hash:             tool.HashCmd(cmd),
+		logs:             newLogBuffer(DefaultLogBuffer),
+	}
+	for _, opt := range opts {
+		opt(dcmd)
 	}
+	return dcmd
 }
 
-// update reset the cmd, status and err fields for restarting
-func (dcmd *DaemonCmd) update() {
+// NewDaemonCmds generate dcmds from conf, one dcmd for each conf.Cmds
+func NewDaemonCmds(ctx context.Context, conf *config.Conf) ([]*DaemonCmd, error) {
+	cmds, annotationsList, err := config.GenerateCmds(conf)
+	if err != nil {
+		return nil, err
+	}
+	ids := conf.CmdIDs()
+	dcmds := make([]*DaemonCmd, 0, len(cmds))
+	for i, cmd := range cmds {
+		dcmds = append(dcmds, NewDaemonCmd(ctx, cmd, annotationsList[i], WithCmdConf(conf.Cmds[i]), withID(ids[i])))
+	}
+	return dcmds, nil
+}
+
+// update reset the cmd, status and err fields for a restart scheduled at generation gen.
+// Return false and keep dcmd unchanged if dcmd was stopped or started manually since,
+// or is no longer waiting to restart, e.g. the manual start is running the cmd
+func (dcmd *DaemonCmd) update(gen int) bool {
 	dcmd.mu.Lock()
 	defer dcmd.mu.Unlock()
+	if dcmd.gen != gen || dcmd.state != Backoff {
+		return false
+	}
+
+	dcmd.Cmd = cloneCmd(dcmd.Cmd)
+	dcmd.Err = nil
+	dcmd.startReason = StartReasonRestart
+	dcmd.autoRestarts++
+	return true
+}
+
+// restartPending return whether dcmd is still waiting for the restart scheduled at generation gen
+func (dcmd *DaemonCmd) restartPending(gen int) bool {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	return dcmd.gen == gen && dcmd.state == Backoff
+}
 
-	newCmd := exec.Command(dcmd.Cmd.Path, dcmd.Cmd.Args[1:]...)
-	dcmd.Cmd = newCmd
+// reset prepare a stopped, waiting to restart, exited or gave up dcmd for a manual start.
+// Return ErrInvalidTransition if dcmd is starting, running or stopping
+func (dcmd *DaemonCmd) reset() error {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	switch dcmd.state {
+	case Stopped, Backoff, Exited, Fatal:
+	default:
+		return fmt.Errorf("%w: %s is %s", ErrInvalidTransition, dcmd.String(), dcmd.state)
+	}
+	if dcmd.Cmd.Process != nil {
+		dcmd.Cmd = cloneCmd(dcmd.Cmd)
+	}
 	dcmd.Err = nil
+	dcmd.startReason = StartReasonManual
+	dcmd.gen++
+	return nil
+}
+
+// generation return the number of times dcmd was stopped or reset
+func (dcmd *DaemonCmd) generation() int {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	return dcmd.gen
+}
+
+// cloneCmd return a new unstarted cmd with the same settings as cmd.
+// Args are kept as is, so the CmdHash does not change after restart
+func cloneCmd(cmd *exec.Cmd) *exec.Cmd {
+	newCmd := &exec.Cmd{
+		Path: cmd.Path,
+		Args: slices.Clone(cmd.Args),
+		Env:  cmd.Env,
+		Dir:  cmd.Dir,
+	}
+	if cmd.SysProcAttr != nil {
+		attr := *cmd.SysProcAttr
+		newCmd.SysProcAttr = &attr
+	}
+	return newCmd
+}
+
+// State return the current state of dcmd
+func (dcmd *DaemonCmd) State() State {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	return dcmd.state
+}
+
+// StateSince return the time when dcmd entered the current state
+func (dcmd *DaemonCmd) StateSince() time.Time {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	return dcmd.stateSince
+}
+
+// Pid return the pid of the running process, 0 if not running
+func (dcmd *DaemonCmd) Pid() int {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	if dcmd.state != Running || dcmd.Cmd.Process == nil {
+		return 0
+	}
+	return dcmd.Cmd.Process.Pid
+}
+
+// Uptime return how long the process has been running, 0 if not running
+func (dcmd *DaemonCmd) Uptime() time.Duration {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	if dcmd.state != Running {
+		return 0
+	}
+	return time.Since(dcmd.stateSince)
+}
+
+// Restarts return the number of times the process was started after the first start,
+// including restarts by the daemon and manual restarts
+func (dcmd *DaemonCmd) Restarts() int {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	return max(dcmd.starts-1, 0)
+}
+
+// autoRestartCount return the number of restarts by the daemon according to the restart policy
+func (dcmd *DaemonCmd) autoRestartCount() int {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	return dcmd.autoRestarts
+}
+
+// ExitCode return the exit code of the last exit, -1 if killed by a signal.
+// ok is false if the process never exited
+func (dcmd *DaemonCmd) ExitCode() (code int, ok bool) {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	return dcmd.exitCode, dcmd.exitedOk
+}
+
+// ID return the stable identity of dcmd in the config, see config.Conf.CmdIDs.
+// Return the CmdHash if dcmd is not generated from config
+func (dcmd *DaemonCmd) ID() string {
+	if dcmd.id != "" {
+		return dcmd.id
+	}
+	return dcmd.CmdHash()
+}
+
+// Critical report whether dcmd must be ready for the daemon to be ready
+func (dcmd *DaemonCmd) Critical() bool {
+	return dcmd.critical
+}
+
+// Finished report whether dcmd is not expected to run: stopped after it was started,
+// e.g. by hand, or exited and not restarted according to its restart policy
+func (dcmd *DaemonCmd) Finished() bool {
+	dcmd.mu.Lock()
+	state, started := dcmd.state, dcmd.starts > 0
+	dcmd.mu.Unlock()
+	switch state {
+	case Stopped:
+		return started
+	case Exited:
+		return !dcmd.shouldRestart()
+	default:
+		return false
+	}
+}
+
+func (dcmd *DaemonCmd) setErr(err error) {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	dcmd.Err = err
+}
+
+// LastErr return the reason of the last exit, nil if none
+func (dcmd *DaemonCmd) LastErr() error {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	return dcmd.Err
+}
+
+// setState transit dcmd to state to, return ErrInvalidTransition if not allowed
+func (dcmd *DaemonCmd) setState(to State) error {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	return dcmd.setStateLocked(to)
+}
+
+func (dcmd *DaemonCmd) setStateLocked(to State) error {
+	if !dcmd.state.canTransitTo(to) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, dcmd.state, to)
+	}
+	e := NewCmdEvent(dcmd, EventState)
+	e.From, e.To = dcmd.state.String(), to.String()
+	switch to {
+	case Backoff, Exited, Fatal:
+		if dcmd.Err != nil {
+			e.Err = dcmd.Err.Error()
+		}
+	}
+	dcmd.state = to
+	dcmd.stateSince = time.Now()
+	dcmd.events.Publish(e)
+	return nil
 }
 
 // startAndWait run the cmd and update runningCmds, then wait for it to exit
 // startAndWait is producer of exitedCmdCh
 func (dcmd *DaemonCmd) startAndWait(ch chan<- *DaemonCmd) {
+	dcmd.mu.Lock()
+	if err := dcmd.setStateLocked(Starting); err != nil {
+		dcmd.mu.Unlock()
+		return
+	}
+	exited := make(chan struct{})
+	dcmd.exited = exited
 	cmd := dcmd.Cmd
+	run := RunRecord{StartReason: dcmd.startReason, StartTime: time.Now()}
+	if run.StartReason == "" {
+		run.StartReason = StartReasonStart
+	}
+	dcmd.startReason = ""
+	dcmd.mu.Unlock()
+	defer close(exited)
 
-	// log
-	if dcmd.logDir != "" {
-		// 确保日志目录存在
-		if err := os.MkdirAll(dcmd.logDir, 0755); err != nil {
-			dcmd.Err = fmt.Errorf("create log dir %s err: %v", dcmd.logDir, err)
-			return
-		}
+	// 保留最后几行stderr, 写入运行记录
+	tail := newTailWriter(DefaultStderrTail)
+	cmd.WaitDelay = waitDelay
 
-		logfilePath := filepath.Join(dcmd.logDir, fmt.Sprintf("%s_%s_%s.log", dcmd.Annotations[AnnotationsNameKey],
-			dcmd.Annotations[AnnotationsPortKey], dcmd.CmdHash()))
+	// log: 子进程通过管道写入, 由守护进程保留最近的行, 写日志文件并轮转
+	rl, err := dcmd.openLog()
+	if err != nil {
+		dcmd.setErr(err)
+		dcmd.record(run, nil, ExitReasonStartFailed, err)
+		dcmd.exit()
+		return
+	}
+	// 确保在函数结束时关闭日志文件, 此时cmd.Wait已等待管道复制结束
+	defer dcmd.closeLog(rl)
+	cmd.Stdout = rl.stdout
+	cmd.Stderr = io.MultiWriter(rl.stderr, tail)
 
-		// 以追加模式打开日志文件，如果不存在则创建
-		f, err := os.OpenFile(logfilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-		if err != nil {
-			dcmd.Err = fmt.Errorf("open log file %s err: %v", logfilePath, err)
-			return
+	// 启动前被Stop, 不再启动
+	dcmd.mu.Lock()
+	if dcmd.state == Stopping {
+		dcmd.setStateLocked(Stopped)
+		dcmd.mu.Unlock()
+		return
+	}
+	err = dcmd.start(cmd)
+	if err == nil {
+		run.Pid = cmd.Process.Pid
+		rl.pid.Store(int64(cmd.Process.Pid))
+		dcmd.setStateLocked(Running)
+		dcmd.starts++
+		if dcmd.health != nil {
+			dcmd.healthStatus, dcmd.healthErr = HealthStarting, nil
 		}
-		// 确保在函数结束时关闭日志文件
-		defer func() {
-			if f != nil {
-				f.Close()
-			}
-		}()
-
-		cmd.Stdout = f
-		cmd.Stderr = f
 	}
-
-	err := cmd.Start()
+	dcmd.mu.Unlock()
+	if err == nil && dcmd.health != nil {
+		go dcmd.watchHealth(exited)
+	}
 	if err != nil {
 		err = fmt.Errorf("%s start err: %v", cmd.String(), err)
-		dcmd.Err = err
-		select {
-		case <-dcmd.ctx.Done():
-			return
-		default:
-			ch <- dcmd
+		dcmd.setErr(err)
+		dcmd.record(run, nil, ExitReasonStartFailed, err)
+		if dcmd.exit() {
+			dcmd.notify(ch)
 		}
 		return
 	}
-	dcmd.Status = Running
 
 	err = cmd.Wait()
+	// 主进程已正常退出, 只是残留的子进程仍持有stderr
+	if errors.Is(err, exec.ErrWaitDelay) {
+		err = nil
+	}
+	dcmd.mu.Lock()
+	dcmd.exitCode, dcmd.exitedOk = cmd.ProcessState.ExitCode(), true
+	reason := ExitReasonExited
+	if dcmd.state == Stopping {
+		reason = ExitReasonStopped
+	}
+	dcmd.mu.Unlock()
 	if err != nil {
-		err := fmt.Errorf("cmd: %s exited with err: %v, exitCode: %d", dcmd.Cmd.String(), dcmd.Err, cmd.ProcessState.ExitCode())
-		dcmd.Err = err
+		err = fmt.Errorf("cmd: %s exited with err: %v, exitCode: %d", dcmd.String(), err, cmd.ProcessState.ExitCode())
+		dcmd.setErr(err)
+	}
+	if status, herr := dcmd.Health(); status == HealthUnhealthy {
+		err = fmt.Errorf("%w: cmd: %s killed: %v", ErrUnhealthy, dcmd.String(), herr)
+		dcmd.setErr(err)
+		reason = ExitReasonUnhealthy
+	}
+	// 被停止、重启或因健康检查失败被终止时, 清理进程组中残留的子进程, 防止重启后端口冲突.
+	// 主动退出时不清理, 保留包装脚本有意留在后台的进程
+	if reason != ExitReasonExited {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 	}
-	dcmd.Status = Exited
+	run.Stderr = tail.Lines()
+	dcmd.record(run, cmd.ProcessState, reason, err)
+	if dcmd.exit() {
+		dcmd.notify(ch)
+	}
+}
+
+// record finish run and add it to the history of dcmd
+func (dcmd *DaemonCmd) record(run RunRecord, state *os.ProcessState, reason ExitReason, err error) {
+	run.finish(state, reason, err)
+	dcmd.history.add(dcmd.ID(), run)
+}
+
+// History return the finished runs of dcmd, oldest first
+func (dcmd *DaemonCmd) History() []RunRecord {
+	return dcmd.history.get(dcmd.ID())
+}
+
+// exit transit dcmd to Exited after the process exited.
+// If dcmd is being stopped, transit to Stopped and return false, the daemon should not restart it
+func (dcmd *DaemonCmd) exit() bool {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	if dcmd.healthStatus != HealthUnhealthy {
+		dcmd.healthStatus = HealthUnknown
+	}
+	if dcmd.state == Stopping {
+		dcmd.setStateLocked(Stopped)
+		return false
+	}
+	dcmd.setStateLocked(Exited)
+	return true
+}
+
+// notify send dcmd to ch unless the daemon is canceled
+func (dcmd *DaemonCmd) notify(ch chan<- *DaemonCmd) {
 	// 防止ch已经close，send导致panic
 	select {
 	case <-dcmd.ctx.Done(): // cancel
-		return
 	default:
 		ch <- dcmd
 	}
 }
 
+// Stop stop dcmd gracefully: send stopSignal to its process group and wait for it to exit.
+// If it does not exit within stopTimeout or ctx is done, send SIGKILL to the group.
+// A stopped dcmd is not restarted by the daemon.
+func (dcmd *DaemonCmd) Stop(ctx context.Context) error {
+	dcmd.mu.Lock()
+	dcmd.gen++
+	switch dcmd.state {
+	case Stopped:
+		dcmd.mu.Unlock()
+		return nil
+	case Backoff, Exited, Fatal:
+		// 没有运行中的进程, 取消等待中的重启
+		err := dcmd.setStateLocked(Stopped)
+		dcmd.mu.Unlock()
+		return err
+	case Starting, Running:
+		dcmd.setStateLocked(Stopping)
+	}
+	exited, sig, timeout := dcmd.exited, dcmd.stopSignal, dcmd.stopTimeout
+	dcmd.mu.Unlock()
+
+	// Starting状态下进程可能还未启动, startAndWait不会再启动它
+	return dcmd.terminate(ctx, exited, sig, timeout)
+}
+
+// terminate send sig to the process group and wait for exited to be closed.
+// If the process does not exit within timeout or ctx is done, send SIGKILL to the group
+func (dcmd *DaemonCmd) terminate(ctx context.Context, exited <-chan struct{}, sig syscall.Signal, timeout time.Duration) error {
+	if err := dcmd.Signal(sig); err != nil && !errors.Is(err, ErrNotRunning) {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-exited:
+		return nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	// 超时后kill整个进程组
+	if err := dcmd.Signal(syscall.SIGKILL); err != nil && !errors.Is(err, ErrNotRunning) {
+		return err
+	}
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(killWait):
+		return fmt.Errorf("%w: %s did not exit after SIGKILL", ErrStopTimeout, dcmd.String())
+	}
+}
+
+// shouldRestart report whether the exited cmd should be restarted according to its restart policy
+func (dcmd *DaemonCmd) shouldRestart() bool {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+
+	switch dcmd.restartPolicy {
+	case config.RestartNever:
+		return false
+	case config.RestartOnFailure:
+		// 因健康检查失败被kill时, 进程可能以0退出
+		if errors.Is(dcmd.Err, ErrUnhealthy) {
+			return true
+		}
+		// start失败或被信号终止都视为failure
+		state := dcmd.Cmd.ProcessState
+		if state == nil {
+			return true
+		}
+		return !slices.Contains(dcmd.successExitCodes, state.ExitCode())
+	default:
+		return true
+	}
+}
+
+// start start cmd in a new process group with the umask of dcmd.
+// umask是进程级别的属性, 守护进程中修改会影响其他goroutine同时创建的文件,
+// 因此由sh在子进程中设置umask后exec cmd, pid和进程组不变. 启动后恢复cmd的Path和Args
+func (dcmd *DaemonCmd) start(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	setProcAttr(cmd.SysProcAttr)
+	if dcmd.umask < 0 {
+		return cmd.Start()
+	}
+	path, args := cmd.Path, cmd.Args
+	defer func() { cmd.Path, cmd.Args = path, args }()
+	cmd.Path = "/bin/sh"
+	cmd.Args = append([]string{"sh", "-c", fmt.Sprintf(`umask %04o && exec "$@"`, dcmd.umask), "sh", path}, args[1:]...)
+	return cmd.Start()
+}
+
+// Signal send sig to the process group of the running cmd, including its children
+func (dcmd *DaemonCmd) Signal(sig syscall.Signal) error {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	if (dcmd.state != Running && dcmd.state != Stopping) || dcmd.Cmd.Process == nil {
+		return fmt.Errorf("%w: %s", ErrNotRunning, dcmd.String())
+	}
+	pid := dcmd.Cmd.Process.Pid
+	if err := killGroup(pid, sig); err != nil {
+		return fmt.Errorf("cmd: %s pid: %d signal %s err: %w", dcmd.String(), pid, sig, err)
+	}
+	return nil
+}
+
+// killGroup send sig to the process group led by pid.
+// If the group does not exist, e.g. the process changed its own group, send sig to pid only
+func killGroup(pid int, sig syscall.Signal) error {
+	err := syscall.Kill(-pid, sig)
+	if err == syscall.ESRCH {
+		err = syscall.Kill(pid, sig)
+	}
+	return err
+}
+
 // CmdHash return a hash of the cmd
 // the hash is computed by the name and args of the cmd
 // args are sorted
 func (dcmd *DaemonCmd) CmdHash() string {
-	return tool.HashCmd(dcmd.Cmd)
+	if dcmd.hash == "" {
+		return tool.HashCmd(dcmd.Cmd)
+	}
+	return dcmd.hash
 }
 
-type dcmdFunc func(dcmd *DaemonCmd)
+// String return the cmd line of dcmd, which does not change across restarts
+func (dcmd *DaemonCmd) String() string {
+	if dcmd.cmdline == "" {
+		return dcmd.Cmd.String()
+	}
+	return dcmd.cmdline
+}
+
+type DaemonCmdFunc func(dcmd *DaemonCmd)
+
+// WithCmdConf apply the per-cmd settings of c to dcmd
+func WithCmdConf(c config.CmdConf) DaemonCmdFunc {
+	return func(dcmd *DaemonCmd) {
+		if dcmd == nil {
+			return
+		}
+		if c.Restart != "" {
+			dcmd.restartPolicy = c.Restart
+		}
+		if len(c.SuccessExitCodes) > 0 {
+			dcmd.successExitCodes = c.SuccessExitCodes
+		}
+		dcmd.Limiter = NewLimiter(c.LimiterConf)
+		if umask, err := c.UmaskValue(); err == nil {
+			dcmd.umask = umask
+		}
+		if sig, err := c.StopSignalValue(); err == nil {
+			dcmd.stopSignal = sig
+		}
+		if c.StopTimeout > 0 {
+			dcmd.stopTimeout = c.StopTimeout
+		}
+		dcmd.dependsOn = c.DependsOn
+		if c.HealthCheck != nil {
+			dcmd.health = newHealthChecker(c.HealthCheck, dcmd.Annotations)
+		}
+		dcmd.critical = c.Critical
+		dcmd.logOpts = logOptions(c.Log)
+		dcmd.logSplit = c.Log.Split != nil && *c.Log.Split
+		dcmd.logPrefix = c.Log.Prefix != nil && *c.Log.Prefix
+		dcmd.logSink = c.LogSink
+		dcmd.conf = c
+	}
+}
+
+func withID(id string) DaemonCmdFunc {
+	return func(dcmd *DaemonCmd) {
+		if dcmd == nil {
+			return
+		}
+		dcmd.id = id
+	}
+}
+
+// withHistory set the store of the runs of dcmd
+func withHistory(history *historyStore) DaemonCmdFunc {
+	return func(dcmd *DaemonCmd) {
+		if dcmd == nil {
+			return
+		}
+		dcmd.history = history
+	}
+}
+
+// withEvents set the EventBus publishing the lifecycle events of dcmd
+func withEvents(events *EventBus) DaemonCmdFunc {
+	return func(dcmd *DaemonCmd) {
+		if dcmd == nil {
+			return
+		}
+		dcmd.events = events
+	}
+}
+
+// withLoki set the client pushing the output of dcmd to Loki
+func withLoki(c *loki.Client) DaemonCmdFunc {
+	return func(dcmd *DaemonCmd) {
+		if dcmd == nil {
+			return
+		}
+		dcmd.loki = c
+	}
+}
 
-func withLogDir(logDir string) dcmdFunc {
+func withLogDir(logDir string) DaemonCmdFunc {
 	return func(dcmd *DaemonCmd) {
 		if dcmd == nil {
 			return
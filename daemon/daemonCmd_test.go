@@ -1,14 +1,20 @@
 package daemon
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/sq325/cmdDaemon/config"
 	"github.com/sq325/cmdDaemon/internal/tool"
 )
 
@@ -64,8 +70,8 @@ func TestDaemonCmd_startAndWait(t *testing.T) {
 
 		select {
 		case result := <-ch:
-			if result.Status != Exited {
-				t.Errorf("Expected status %d, got %d", Exited, result.Status)
+			if result.State() != Exited {
+				t.Errorf("Expected state %s, got %s", Exited, result.State())
 			}
 			if result.Err != nil {
 				t.Errorf("Expected no error, got %v", result.Err)
@@ -127,8 +133,8 @@ func TestDaemonCmd_startAndWait(t *testing.T) {
 
 		select {
 		case result := <-ch:
-			if result.Status != Exited {
-				t.Errorf("Expected status %d, got %d", Exited, result.Status)
+			if result.State() != Exited {
+				t.Errorf("Expected state %s, got %s", Exited, result.State())
 			}
 			if result.Err != nil {
 				t.Errorf("Expected no error, got %v", result.Err)
@@ -150,8 +156,13 @@ func TestDaemonCmd_startAndWait(t *testing.T) {
 		annotations := map[string]string{"name": "test", "port": "8080"}
 		dcmd := NewDaemonCmd(ctx, cmd, annotations)
 
-		// Use an invalid path that cannot be created
-		dcmd.logDir = "/invalid/path/that/cannot/be/created"
+		// Use an invalid path that cannot be created, even by root:
+		// a directory below a regular file
+		file := filepath.Join(t.TempDir(), "file")
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		dcmd.logDir = filepath.Join(file, "log")
 
 		ch := make(chan *DaemonCmd, 1)
 
@@ -162,3 +173,328 @@ func TestDaemonCmd_startAndWait(t *testing.T) {
 		}
 	})
 }
+
+func TestDaemonCmd_shouldRestart(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmdArgs []string
+		conf    config.CmdConf
+		start   bool // false: simulate start failure
+		want    bool
+	}{
+		{
+			name:    "always restarts on success",
+			cmdArgs: []string{"true"},
+			conf:    config.CmdConf{Restart: config.RestartAlways},
+			start:   true,
+			want:    true,
+		},
+		{
+			name:    "never does not restart on failure",
+			cmdArgs: []string{"false"},
+			conf:    config.CmdConf{Restart: config.RestartNever},
+			start:   true,
+			want:    false,
+		},
+		{
+			name:    "on-failure does not restart on success",
+			cmdArgs: []string{"true"},
+			conf:    config.CmdConf{Restart: config.RestartOnFailure},
+			start:   true,
+			want:    false,
+		},
+		{
+			name:    "on-failure restarts on failure",
+			cmdArgs: []string{"false"},
+			conf:    config.CmdConf{Restart: config.RestartOnFailure},
+			start:   true,
+			want:    true,
+		},
+		{
+			name:    "on-failure honors success exit codes",
+			cmdArgs: []string{"sh", "-c", "exit 3"},
+			conf:    config.CmdConf{Restart: config.RestartOnFailure, SuccessExitCodes: []int{0, 3}},
+			start:   true,
+			want:    false,
+		},
+		{
+			name:    "on-failure restarts on start failure",
+			cmdArgs: []string{"nonexistent-command"},
+			conf:    config.CmdConf{Restart: config.RestartOnFailure},
+			start:   false,
+			want:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(tt.cmdArgs[0], tt.cmdArgs[1:]...)
+			dcmd := NewDaemonCmd(context.Background(), cmd, nil, WithCmdConf(tt.conf))
+			if tt.start {
+				cmd.Run()
+			}
+			if got := dcmd.shouldRestart(); got != tt.want {
+				t.Errorf("DaemonCmd.shouldRestart() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDaemonCmd_update(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "pwd; echo $FOO")
+	cmd.Env = []string{"FOO=bar"}
+	cmd.Dir = t.TempDir()
+	dcmd := NewDaemonCmd(context.Background(), cmd, nil)
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if dcmd.update(dcmd.generation()) {
+		t.Fatal("update() of a dcmd not waiting to restart")
+	}
+	dcmd.state = Backoff // 退出后等待重启
+	gen := dcmd.generation()
+	if dcmd.update(gen + 1) {
+		t.Fatal("update() of a stale generation")
+	}
+	if !dcmd.update(gen) {
+		t.Fatal("update() = false")
+	}
+	if dcmd.Cmd == cmd {
+		t.Fatal("update() did not create a new cmd")
+	}
+	if dcmd.Cmd.Dir != cmd.Dir {
+		t.Errorf("update() Dir = %s, want %s", dcmd.Cmd.Dir, cmd.Dir)
+	}
+	if len(dcmd.Cmd.Env) != 1 || dcmd.Cmd.Env[0] != "FOO=bar" {
+		t.Errorf("update() Env = %v, want [FOO=bar]", dcmd.Cmd.Env)
+	}
+	if dcmd.CmdHash() != tool.HashCmd(cmd) {
+		t.Errorf("update() changed CmdHash")
+	}
+	out, err := dcmd.Cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := cmd.Dir + "\nbar\n"; string(out) != want {
+		t.Errorf("restarted cmd output = %q, want %q", out, want)
+	}
+}
+
+func TestDaemonCmd_start(t *testing.T) {
+	tests := []struct {
+		name  string
+		umask string
+		want  string
+	}{
+		{name: "umask 027", umask: "027", want: "0027\n"},
+		{name: "umask 077", umask: "077", want: "0077\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command("sh", "-c", "umask")
+			var out bytes.Buffer
+			cmd.Stdout = &out
+			dcmd := NewDaemonCmd(context.Background(), cmd, nil, WithCmdConf(config.CmdConf{Umask: tt.umask}))
+			if err := dcmd.start(cmd); err != nil {
+				t.Fatal(err)
+			}
+			// umask在子进程中设置, 启动后cmd不变
+			if !slices.Equal(cmd.Args, []string{"sh", "-c", "umask"}) {
+				t.Errorf("Args after start = %q", cmd.Args)
+			}
+			if err := cmd.Wait(); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("umask = %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+
+	t.Run("credential", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("switching user requires root")
+		}
+		c := config.CmdConf{User: "65534", Group: "65534", Groups: []string{"65534"}}
+		cred, err := c.Credential()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("id", "-u")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+		dcmd := NewDaemonCmd(context.Background(), cmd, nil, WithCmdConf(c))
+		dcmd.state = Backoff
+		dcmd.update(dcmd.generation()) // 重启后的cmd也应以该用户运行
+		out, err := dcmd.Cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "65534\n" {
+			t.Errorf("uid = %q, want 65534", out)
+		}
+	})
+}
+
+func TestDaemonCmd_Signal(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 100 & echo $!; wait")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcmd := NewDaemonCmd(context.Background(), cmd, nil)
+	if err := dcmd.Signal(syscall.SIGTERM); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Signal() before start error = %v, want %v", err, ErrNotRunning)
+	}
+
+	dcmd.setState(Starting)
+	if err := dcmd.start(cmd); err != nil {
+		t.Fatal(err)
+	}
+	dcmd.setState(Running)
+	var child int
+	if _, err := fmt.Fscan(stdout, &child); err != nil {
+		t.Fatal(err)
+	}
+
+	// 子进程与孙进程在同一个独立的进程组中
+	pgid, err := syscall.Getpgid(child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pgid != cmd.Process.Pid || pgid == syscall.Getpgrp() {
+		t.Errorf("pgid = %d, want %d", pgid, cmd.Process.Pid)
+	}
+
+	if err := dcmd.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+	deadline := time.Now().Add(3 * time.Second)
+	for alive(child) {
+		if time.Now().After(deadline) {
+			syscall.Kill(child, syscall.SIGKILL)
+			t.Fatalf("grandchild %d still alive after Signal()", child)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// alive report whether pid exists and is not a zombie
+func alive(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return syscall.Kill(pid, 0) == nil
+	}
+	// pid (comm) state ...
+	i := bytes.LastIndexByte(stat, ')')
+	return i < 0 || i+2 >= len(stat) || stat[i+2] != 'Z'
+}
+
+func TestDaemonCmd_Stop(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		conf     config.CmdConf
+		minTime  time.Duration // Stop至少耗时, 用于确认升级为SIGKILL
+		maxTime  time.Duration
+		wantKill bool
+	}{
+		{
+			name:    "exit on SIGTERM",
+			script:  "sleep 100 & wait",
+			conf:    config.CmdConf{StopTimeout: 5 * time.Second},
+			maxTime: 2 * time.Second,
+		},
+		{
+			name:    "custom stop signal",
+			script:  "trap 'exit 0' INT; sleep 100 & wait",
+			conf:    config.CmdConf{StopSignal: "SIGINT", StopTimeout: 5 * time.Second},
+			maxTime: 2 * time.Second,
+		},
+		{
+			name:     "escalate to SIGKILL after stopTimeout",
+			script:   "trap '' TERM; while :; do sleep 0.05; done",
+			conf:     config.CmdConf{StopTimeout: 300 * time.Millisecond},
+			minTime:  300 * time.Millisecond,
+			maxTime:  3 * time.Second,
+			wantKill: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := make(chan *DaemonCmd, 1)
+			dcmd := NewDaemonCmd(context.Background(), exec.Command("sh", "-c", tt.script), nil, WithCmdConf(tt.conf))
+			done := make(chan struct{})
+			go func() {
+				dcmd.startAndWait(ch)
+				close(done)
+			}()
+			waitState(t, dcmd, Running)
+			time.Sleep(50 * time.Millisecond) // 等待shell设置trap
+
+			start := time.Now()
+			if err := dcmd.Stop(context.Background()); err != nil {
+				t.Fatalf("Stop() error = %v", err)
+			}
+			elapsed := time.Since(start)
+			<-done
+
+			if elapsed < tt.minTime || elapsed > tt.maxTime {
+				t.Errorf("Stop() took %v, want between %v and %v", elapsed, tt.minTime, tt.maxTime)
+			}
+			if got := dcmd.State(); got != Stopped {
+				t.Errorf("State() = %v, want %v", got, Stopped)
+			}
+			if killed := dcmd.Cmd.ProcessState.String() == "signal: killed"; killed != tt.wantKill {
+				t.Errorf("ProcessState = %v, wantKill %v", dcmd.Cmd.ProcessState, tt.wantKill)
+			}
+			select {
+			case <-ch:
+				t.Error("stopped cmd was sent to exitedCmdCh")
+			default:
+			}
+		})
+	}
+
+	t.Run("cancel backoff", func(t *testing.T) {
+		dcmd := NewDaemonCmd(context.Background(), exec.Command("true"), nil)
+		dcmd.state = Backoff
+		if err := dcmd.Stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := dcmd.State(); got != Stopped {
+			t.Errorf("State() = %v, want %v", got, Stopped)
+		}
+	})
+}
+
+func TestDaemonCmd_exitKeepsBackground(t *testing.T) {
+	// 包装脚本有意留在后台的进程在主进程正常退出后保留
+	dcmd := NewDaemonCmd(context.Background(), exec.Command("sh", "-c", "sleep 100 >/dev/null 2>&1 & echo $!"), nil)
+	dcmd.startAndWait(make(chan *DaemonCmd, 1))
+	lines := dcmd.Logs(StreamStdout, 1)
+	if len(lines) != 1 {
+		t.Fatalf("Logs() = %v, want the pid of the background process", lines)
+	}
+	pid, err := strconv.Atoi(lines[0].Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+	if !alive(pid) {
+		t.Errorf("background process %d killed after the cmd exited", pid)
+	}
+}
+
+// waitState wait until dcmd enter state want
+func waitState(t *testing.T, dcmd *DaemonCmd, want State) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for dcmd.State() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("State() = %v, want %v", dcmd.State(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
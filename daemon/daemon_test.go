@@ -2,10 +2,16 @@ package daemon
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"net"
+	"os/exec"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sq325/cmdDaemon/config"
 )
 
 func TestDaemon_RegisterMetrics(t *testing.T) {
@@ -69,3 +75,332 @@ func TestDaemon_RegisterMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestDaemonCollector_removedCmd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conf, err := config.Unmarshal([]byte(`cmds:
+  - cmd: sleep
+    args: ["100"]
+    annotations:
+      name: keep
+  - cmd: sleep
+    args: ["101"]
+    annotations:
+      name: gone
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcmds, err := NewDaemonCmds(ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDaemon(ctx, dcmds, slog.Default())
+	WithCmdLogDir("")(d)
+	reg := prometheus.NewRegistry()
+	if err := d.RegisterMetrics(reg); err != nil {
+		t.Fatal(err)
+	}
+	names := func() map[string]bool {
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make(map[string]bool)
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "name" {
+						names[mf.GetName()+"/"+l.GetValue()] = true
+					}
+				}
+			}
+		}
+		return names
+	}
+	for _, metric := range []string{"daemon_cmd_status", "daemon_cmd_restart_total", "daemon_cmd_limiter_state", "daemon_cmd_limiter_restarts", "daemon_cmd_health"} {
+		if got := names(); !got[metric+"/keep"] || !got[metric+"/gone"] {
+			t.Fatalf("%s not exported for both cmds: %v", metric, got)
+		}
+	}
+
+	gone, err := d.GetDCmdByID("gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RemoveCmd(context.Background(), gone); err != nil {
+		t.Fatal(err)
+	}
+	got := names()
+	for name := range got {
+		if strings.HasSuffix(name, "/gone") {
+			t.Errorf("series of removed cmd still exported: %s", name)
+		}
+	}
+	if !got["daemon_cmd_status/keep"] {
+		t.Errorf("series of kept cmd missing: %v", got)
+	}
+}
+
+func TestDaemon_dependsOn(t *testing.T) {
+	dependencyPollInterval = 20 * time.Millisecond
+
+	// 预留一个端口, 依赖监听该端口后才就绪
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, port, _ := net.SplitHostPort(addr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := NewDaemonCmd(ctx, exec.Command("sleep", "100"), map[string]string{
+		AnnotationsNameKey: "cache",
+		AnnotationsIPKey:   "127.0.0.1",
+		AnnotationsPortKey: port,
+	})
+	app := NewDaemonCmd(ctx, exec.Command("sleep", "100"), map[string]string{AnnotationsNameKey: "app"},
+		WithCmdConf(config.CmdConf{DependsOn: []string{"cache"}}))
+	d := NewDaemon(ctx, []*DaemonCmd{app, cache}, slog.Default())
+	WithCmdLogDir("")(d)
+	d.run()
+
+	waitState(t, cache, Running)
+	time.Sleep(100 * time.Millisecond)
+	if got := app.State(); got != Stopped {
+		t.Fatalf("app started before cache is ready, state = %v", got)
+	}
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	waitState(t, app, Running)
+
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if app.State() != Stopped || cache.State() != Stopped {
+		t.Fatalf("states after Stop() = %v, %v, want stopped", app.State(), cache.State())
+	}
+	if cache.StateSince().Before(app.StateSince()) {
+		t.Errorf("cache stopped at %v before its dependent app at %v", cache.StateSince(), app.StateSince())
+	}
+}
+
+func TestDaemon_Reload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	unmarshal := func(yml string) *config.Conf {
+		conf, err := config.Unmarshal([]byte(yml))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conf
+	}
+
+	conf := unmarshal(`cmds:
+  - cmd: sleep
+    args: ["100"]
+    annotations:
+      name: keep
+  - cmd: sleep
+    args: ["101"]
+    annotations:
+      name: change
+  - cmd: sleep
+    args: ["102"]
+    annotations:
+      name: remove
+`)
+	dcmds, err := NewDaemonCmds(ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDaemon(ctx, dcmds, slog.Default())
+	WithCmdLogDir("")(d)
+	d.run()
+	defer d.Stop(context.Background())
+	for _, dcmd := range d.DCmds {
+		waitState(t, dcmd, Running)
+	}
+	keep, change, remove := d.DCmds[0], d.DCmds[1], d.DCmds[2]
+	keepPid := keep.Pid()
+	keep.Limiter.Inc()
+
+	diff, err := d.Reload(context.Background(), unmarshal(`cmds:
+  - cmd: sleep
+    args: ["100"]
+    annotations:
+      name: keep
+  - cmd: sleep
+    args: ["201"]
+    annotations:
+      name: change
+  - cmd: sleep
+    args: ["103"]
+    annotations:
+      name: add
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Added) != 1 || len(diff.Removed) != 1 || len(diff.Changed) != 1 || len(diff.Unchanged) != 1 {
+		t.Fatalf("Reload() diff = %+v", diff)
+	}
+
+	if len(d.DCmds) != 3 || d.DCmds[0] != keep {
+		t.Fatalf("unchanged cmd was replaced: %v", d.DCmds)
+	}
+	if keep.Pid() != keepPid || keep.Limiter.Status().Restarts != 1 {
+		t.Errorf("unchanged cmd restarted or limiter reset: pid %d -> %d, restarts %d", keepPid, keep.Pid(), keep.Limiter.Status().Restarts)
+	}
+	if change.State() != Stopped || remove.State() != Stopped {
+		t.Errorf("old cmds not stopped: change %v, remove %v", change.State(), remove.State())
+	}
+	for _, dcmd := range d.DCmds[1:] {
+		waitState(t, dcmd, Running)
+	}
+	if got := d.DCmds[1].Cmd.Args; got[1] != "201" {
+		t.Errorf("changed cmd args = %v, want 201", got)
+	}
+	if got := d.DCmds[2].ID(); got != "add" {
+		t.Errorf("added cmd ID() = %s, want add", got)
+	}
+}
+
+func TestDaemon_StartCmd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conf, err := config.Unmarshal([]byte(`cmds:
+  - cmd: sleep
+    args: ["100"]
+    annotations:
+      name: sleeper
+  - cmd: sleep
+    args: ["101"]
+    annotations:
+      name: dup
+  - cmd: sleep
+    args: ["102"]
+    annotations:
+      name: dup
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcmds, err := NewDaemonCmds(ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDaemon(ctx, dcmds, slog.Default())
+	WithCmdLogDir("")(d)
+
+	sleeper, err := d.GetDCmdByID("sleeper")
+	if err != nil || sleeper != d.DCmds[0] {
+		t.Fatalf("GetDCmdByID(sleeper) = %v, %v", sleeper, err)
+	}
+	if dcmd, err := d.GetDCmdByID(d.DCmds[1].CmdHash()); err != nil || dcmd != d.DCmds[1] {
+		t.Errorf("GetDCmdByID(hash) = %v, %v", dcmd, err)
+	}
+	if _, err := d.GetDCmdByID("dup"); !errors.Is(err, ErrAmbiguousCmd) {
+		t.Errorf("GetDCmdByID(dup) error = %v, want ErrAmbiguousCmd", err)
+	}
+	if _, err := d.GetDCmdByID("nope"); !errors.Is(err, ErrNoCmdFound) {
+		t.Errorf("GetDCmdByID(nope) error = %v, want ErrNoCmdFound", err)
+	}
+
+	if _, ok := sleeper.ExitCode(); ok || sleeper.Uptime() != 0 {
+		t.Error("ExitCode() or Uptime() of a never started cmd")
+	}
+	if err := d.StartCmd(sleeper); err != nil {
+		t.Fatal(err)
+	}
+	defer sleeper.Stop(context.Background())
+	waitState(t, sleeper, Running)
+	if err := d.StartCmd(sleeper); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("StartCmd(running) error = %v, want ErrInvalidTransition", err)
+	}
+
+	pid := sleeper.Pid()
+	sleeper.Limiter.Inc()
+	if err := d.RestartCmd(context.Background(), sleeper); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, sleeper, Running)
+	if sleeper.Pid() == pid || alive(pid) {
+		t.Errorf("RestartCmd() pid %d -> %d, old alive %v", pid, sleeper.Pid(), alive(pid))
+	}
+	if restarts := sleeper.Limiter.Status().Restarts; restarts != 0 {
+		t.Errorf("Limiter restarts after RestartCmd() = %d, want 0", restarts)
+	}
+	if code, ok := sleeper.ExitCode(); !ok || code != -1 {
+		t.Errorf("ExitCode() after RestartCmd() = %d, %v, want -1 (killed by signal)", code, ok)
+	}
+	if sleeper.Restarts() != 1 || sleeper.Uptime() <= 0 {
+		t.Errorf("Restarts() = %d, Uptime() = %v after RestartCmd()", sleeper.Restarts(), sleeper.Uptime())
+	}
+}
+
+func TestDaemon_AddCmd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conf, err := config.Unmarshal([]byte(`defaults:
+  restartLimit: 2
+cmds:
+  - cmd: sleep
+    args: ["100"]
+    annotations:
+      name: base
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcmds, err := NewDaemonCmds(ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDaemon(ctx, dcmds, slog.Default())
+	WithCmdLogDir("")(d)
+	WithDefaults(conf.Defaults)(d)
+	d.run()
+	defer d.Stop(context.Background())
+	base := d.DCmds[0]
+
+	app, err := d.AddCmd(config.CmdConf{Cmd: "sleep", Args: []string{"101"}, DependsOn: []string{"base"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, app, Running)
+	if len(d.DCmds) != 2 || d.DCmds[1] != app || app.ID() != "sleep" {
+		t.Errorf("DCmds after AddCmd() = %v, ID() = %s", d.DCmds, app.ID())
+	}
+	if limit := app.Limiter.Status().Limit; limit != 2 {
+		t.Errorf("added cmd restart limit = %d, want 2 from defaults", limit)
+	}
+
+	if _, err := d.AddCmd(config.CmdConf{Cmd: "sleep", Args: []string{"102"}}); !errors.Is(err, ErrCmdExists) {
+		t.Errorf("AddCmd(same name) error = %v, want ErrCmdExists", err)
+	}
+	if _, err := d.AddCmd(config.CmdConf{Cmd: "sleep", DependsOn: []string{"nope"},
+		Annotations: map[string]string{AnnotationsNameKey: "other"}}); !errors.Is(err, ErrInvalidConf) {
+		t.Errorf("AddCmd(unknown dependency) error = %v, want ErrInvalidConf", err)
+	}
+
+	if err := d.RemoveCmd(context.Background(), base); !errors.Is(err, ErrInvalidConf) {
+		t.Errorf("RemoveCmd(dependency) error = %v, want ErrInvalidConf", err)
+	}
+	if err := d.RemoveCmd(context.Background(), app); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.DCmds) != 1 || d.DCmds[0] != base || app.State() != Stopped {
+		t.Errorf("after RemoveCmd() DCmds = %v, removed state %v", d.DCmds, app.State())
+	}
+	if err := d.RemoveCmd(context.Background(), app); !errors.Is(err, ErrNoCmdFound) {
+		t.Errorf("RemoveCmd(removed) error = %v, want ErrNoCmdFound", err)
+	}
+}
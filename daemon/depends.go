@@ -0,0 +1,82 @@
+package daemon
+
+import (
+	"net"
+	"time"
+)
+
+// dependencyPollInterval 等待依赖就绪时的检查间隔
+var dependencyPollInterval = 500 * time.Millisecond
+
+// Ready report whether dcmd is ready to serve its dependents:
+// it is running and healthy if health check is configured,
+// otherwise if the port annotation is set, the port accepts tcp connections
+func (dcmd *DaemonCmd) Ready() bool {
+	if dcmd.State() != Running {
+		return false
+	}
+	if dcmd.health != nil {
+		status, _ := dcmd.Health()
+		return status == HealthHealthy
+	}
+	port := dcmd.Annotations[AnnotationsPortKey]
+	if port == "" {
+		return true
+	}
+	hosts := []string{"127.0.0.1"}
+	if ip := dcmd.Annotations[AnnotationsIPKey]; ip != "" && ip != "127.0.0.1" {
+		hosts = append([]string{ip}, hosts...)
+	}
+	for _, host := range hosts {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), time.Second)
+		if err == nil {
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// dependencies return the dcmds that dcmd depends on, matched by the name annotation
+func (d *Daemon) dependencies(dcmd *DaemonCmd) []*DaemonCmd {
+	var deps []*DaemonCmd
+	for _, name := range dcmd.dependsOn {
+		for _, dep := range d.GetDCmds() {
+			if dep != dcmd && dep.Annotations[AnnotationsNameKey] == name {
+				deps = append(deps, dep)
+			}
+		}
+	}
+	return deps
+}
+
+// waitDependencies block until all dependencies of dcmd are ready.
+// Return false if the daemon is canceled while waiting
+func (d *Daemon) waitDependencies(dcmd *DaemonCmd) bool {
+	deps := d.dependencies(dcmd)
+	if len(deps) == 0 {
+		return true
+	}
+	d.Logger.Info("Waiting for dependencies", "cmd", dcmd.String(), "dependsOn", dcmd.dependsOn)
+
+	ticker := time.NewTicker(dependencyPollInterval)
+	defer ticker.Stop()
+	for {
+		ready := true
+		for _, dep := range deps {
+			if !dep.Ready() {
+				ready = false
+				break
+			}
+		}
+		if ready {
+			d.Logger.Info("Dependencies ready", "cmd", dcmd.String())
+			return true
+		}
+		select {
+		case <-d.ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
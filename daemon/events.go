@@ -0,0 +1,194 @@
+package daemon
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of an Event
+type EventType string
+
+const (
+	EventState        EventType = "state"        // DaemonCmd状态转换
+	EventRestart      EventType = "restart"      // 守护进程按重启策略重启cmd
+	EventLimitReached EventType = "limitReached" // 超过重启限制, 进入cooldown或不再重启
+	EventHealth       EventType = "health"       // 健康检查连续失败, cmd被终止
+	EventReload       EventType = "reload"       // 重载配置的结果
+	EventAction       EventType = "action"       // 通过API对cmd的操作
+)
+
+// DefaultEventHistory is the number of events kept by the EventBus of a Daemon
+const DefaultEventHistory = 1000
+
+// eventSubBuffer 订阅者的缓冲区大小, 缓冲区满时断开订阅者, 客户端可以从上次的Seq重新订阅
+const eventSubBuffer = 256
+
+// Event is a lifecycle event of the daemon or a dcmd
+type Event struct {
+	Seq     uint64    `json:"seq"` // 递增序号, 由EventBus.Publish设置
+	Time    time.Time `json:"time"`
+	Type    EventType `json:"type"`
+	Cmd     string    `json:"cmd,omitempty"` // DaemonCmd.ID, daemon级别的事件为空
+	Name    string    `json:"name,omitempty"`
+	App     string    `json:"app,omitempty"`
+	From    string    `json:"from,omitempty"`   // EventState的原状态
+	To      string    `json:"to,omitempty"`     // EventState的新状态
+	Action  string    `json:"action,omitempty"` // EventAction的操作, 例如start、stop、restart
+	Message string    `json:"message,omitempty"`
+	Err     string    `json:"err,omitempty"`
+}
+
+// NewCmdEvent return an event of dcmd with its id, name and app set
+func NewCmdEvent(dcmd *DaemonCmd, typ EventType) Event {
+	return Event{
+		Type: typ,
+		Cmd:  dcmd.ID(),
+		Name: dcmd.Annotations[AnnotationsNameKey],
+		App:  dcmd.Annotations[AnnotationsAppKey],
+	}
+}
+
+// EventFilter select events, zero fields match all
+type EventFilter struct {
+	Cmd   string      // DaemonCmd.ID或name注释
+	App   string      // app注释
+	Types []EventType // 事件类型
+}
+
+// Match report whether e matches f
+func (f EventFilter) Match(e Event) bool {
+	if f.Cmd != "" && f.Cmd != e.Cmd && f.Cmd != e.Name {
+		return false
+	}
+	if f.App != "" && f.App != e.App {
+		return false
+	}
+	return len(f.Types) == 0 || slices.Contains(f.Types, e.Type)
+}
+
+// ParseEventTypes parse a comma separated list of event types, unknown types never match
+func ParseEventTypes(s string) []EventType {
+	var types []EventType
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, EventType(t))
+		}
+	}
+	return types
+}
+
+// EventBus keep the latest events in a ring buffer and fan them out to subscribers.
+// A nil EventBus discards events. 并发安全
+type EventBus struct {
+	mu     sync.Mutex
+	events []Event // 环形缓冲区
+	next   int     // 下一个事件写入的位置
+	full   bool    // 缓冲区已写满, 最旧的事件在next
+	seq    uint64
+
+	subs map[*eventSub]struct{}
+}
+
+type eventSub struct {
+	filter EventFilter
+	ch     chan Event
+}
+
+// NewEventBus create an EventBus keeping the latest size events, DefaultEventHistory if size <= 0
+func NewEventBus(size int) *EventBus {
+	if size <= 0 {
+		size = DefaultEventHistory
+	}
+	return &EventBus{
+		events: make([]Event, size),
+		subs:   make(map[*eventSub]struct{}),
+	}
+}
+
+// Publish set the Seq and Time of e, add it to the history and send it to matching subscribers.
+// A subscriber falling behind by eventSubBuffer events is unsubscribed, its channel is closed
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	e.Seq = b.seq
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.events[b.next] = e
+	b.next = (b.next + 1) % len(b.events)
+	if b.next == 0 {
+		b.full = true
+	}
+	for sub := range b.subs {
+		if !sub.filter.Match(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			delete(b.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// History return the events matching filter with Seq greater than after, oldest first.
+// If limit > 0, only the latest limit events are returned
+func (b *EventBus) History(filter EventFilter, after uint64, limit int) []Event {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.history(filter, after, limit)
+}
+
+func (b *EventBus) history(filter EventFilter, after uint64, limit int) []Event {
+	events := []Event{}
+	if b.full {
+		events = appendMatched(events, b.events[b.next:], filter, after)
+	}
+	events = appendMatched(events, b.events[:b.next], filter, after)
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events
+}
+
+func appendMatched(dst, events []Event, filter EventFilter, after uint64) []Event {
+	for _, e := range events {
+		if e.Seq > after && filter.Match(e) {
+			dst = append(dst, e)
+		}
+	}
+	return dst
+}
+
+// Subscribe return the events in the history matching filter with Seq greater than after,
+// and a channel receiving the matching events published later, without gaps or duplicates.
+// The channel is closed by cancel, or when the subscriber falls behind, see Publish
+func (b *EventBus) Subscribe(filter EventFilter, after uint64) (history []Event, events <-chan Event, cancel func()) {
+	sub := &eventSub{filter: filter, ch: make(chan Event, eventSubBuffer)}
+	if b == nil {
+		close(sub.ch)
+		return nil, sub.ch, func() {}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	history = b.history(filter, after, 0)
+	b.subs[sub] = struct{}{}
+	return history, sub.ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[sub]; ok {
+			delete(b.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
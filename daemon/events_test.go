@@ -0,0 +1,136 @@
+package daemon
+
+import (
+	"context"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sq325/cmdDaemon/config"
+	"github.com/sq325/cmdDaemon/internal/tool"
+)
+
+func TestEventBus(t *testing.T) {
+	b := NewEventBus(3)
+	b.Publish(Event{Type: EventState, Cmd: "a", App: "web"})
+	_, ch, cancel := b.Subscribe(EventFilter{App: "web"}, 0)
+	for i, cmd := range []string{"b", "a", "c", "a"} {
+		b.Publish(Event{Type: EventAction, Cmd: cmd, Name: "n" + cmd, App: map[bool]string{true: "web"}[i%2 == 1]})
+	}
+
+	// 只保留最近3个事件
+	seqs := func(events []Event) (s []uint64) {
+		for _, e := range events {
+			s = append(s, e.Seq)
+		}
+		return s
+	}
+	tests := []struct {
+		filter EventFilter
+		after  uint64
+		limit  int
+		want   []uint64
+	}{
+		{EventFilter{}, 0, 0, []uint64{3, 4, 5}},
+		{EventFilter{}, 3, 0, []uint64{4, 5}},
+		{EventFilter{}, 0, 2, []uint64{4, 5}},
+		{EventFilter{Cmd: "a"}, 0, 0, []uint64{3, 5}},
+		{EventFilter{Cmd: "nc"}, 0, 0, []uint64{4}},
+		{EventFilter{App: "web"}, 0, 0, []uint64{3, 5}},
+		{EventFilter{Types: []EventType{EventState}}, 0, 0, nil},
+		{EventFilter{Types: ParseEventTypes("state, action")}, 4, 0, []uint64{5}},
+	}
+	for _, tt := range tests {
+		got := seqs(b.History(tt.filter, tt.after, tt.limit))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("History(%+v, %d, %d) = %v, want %v", tt.filter, tt.after, tt.limit, got, tt.want)
+		}
+	}
+
+	// 订阅后只收到匹配的新事件
+	for _, want := range []uint64{3, 5} {
+		if e := <-ch; e.Seq != want || e.Time.IsZero() {
+			t.Errorf("subscribed event = %+v, want seq %d", e, want)
+		}
+	}
+	cancel()
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Error("channel not closed after cancel")
+	}
+
+	history, ch, cancel := b.Subscribe(EventFilter{}, 4)
+	defer cancel()
+	if len(history) != 1 || history[0].Seq != 5 {
+		t.Errorf("Subscribe() history = %v", history)
+	}
+	// 落后的订阅者被断开
+	for range eventSubBuffer + 1 {
+		b.Publish(Event{Type: EventReload})
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != eventSubBuffer {
+		t.Errorf("slow subscriber received %d events, want %d", n, eventSubBuffer)
+	}
+
+	var nilBus *EventBus
+	nilBus.Publish(Event{})
+	if _, ch, _ := nilBus.Subscribe(EventFilter{}, 0); ch == nil {
+		t.Error("nil EventBus Subscribe() channel is nil")
+	}
+}
+
+func TestDaemon_Events(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	failing := NewDaemonCmd(ctx, exec.Command("false"), map[string]string{AnnotationsNameKey: "failing", AnnotationsAppKey: "web"},
+		WithCmdConf(config.CmdConf{LimiterConf: config.LimiterConf{RestartLimit: tool.Ptr(1), BackoffBase: time.Millisecond, Cooldown: tool.Ptr(time.Duration(0))}}))
+	d := NewDaemon(ctx, []*DaemonCmd{failing}, slog.Default())
+	WithCmdLogDir("")(d)
+	_, events, stop := d.Events().Subscribe(EventFilter{App: "web"}, 0)
+	defer stop()
+	go d.Run()
+	waitState(t, failing, Fatal)
+
+	var got []string
+	timeout := time.After(3 * time.Second)
+	for len(got) == 0 || got[len(got)-1] != "state:backoff->fatal" {
+		select {
+		case e := <-events:
+			if e.Cmd != failing.ID() || e.App != "web" {
+				t.Errorf("event = %+v", e)
+			}
+			s := string(e.Type)
+			if e.Type == EventState {
+				s += ":" + e.From + "->" + e.To
+			}
+			got = append(got, s)
+		case <-timeout:
+			t.Fatalf("events = %v", got)
+		}
+	}
+	want := []string{"state:stopped->starting", "state:starting->running", "state:running->exited", "state:exited->backoff",
+		"restart", "state:backoff->starting", "state:starting->running", "state:running->exited", "state:exited->backoff",
+		"limitReached", "state:backoff->fatal"}
+	if len(got) != len(want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("events[%d] = %s, want %s", i, got[i], want[i])
+		}
+	}
+
+	if _, err := d.Reload(context.Background(), &config.Conf{}); err != nil {
+		t.Fatal(err)
+	}
+	reloads := d.Events().History(EventFilter{Types: []EventType{EventReload}}, 0, 0)
+	if len(reloads) != 1 || reloads[0].Message != "added: 0, removed: 1, changed: 0, unchanged: 0" {
+		t.Errorf("reload events = %+v", reloads)
+	}
+}
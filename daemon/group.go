@@ -0,0 +1,157 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidSelector = errors.New("invalid selector")
+	ErrRolloutAborted  = errors.New("rollout aborted")
+)
+
+// Selector select dcmds by annotations, e.g. app=xieCloud,name=prometheus.
+// A dcmd matches if all its annotations in the selector are equal
+type Selector map[string]string
+
+// ParseSelector parse a comma separated list of key=value
+func ParseSelector(s string) (Selector, error) {
+	sel := make(Selector)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("%w: %q, want key=value", ErrInvalidSelector, kv)
+		}
+		if old, ok := sel[k]; ok && old != v {
+			return nil, fmt.Errorf("%w: %s=%s conflicts with %s=%s", ErrInvalidSelector, k, v, k, old)
+		}
+		sel[k] = v
+	}
+	return sel, nil
+}
+
+// Matches report whether annotations match all key=value of s, an empty selector matches all
+func (s Selector) Matches(annotations map[string]string) bool {
+	for k, v := range s {
+		if annotations[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	kvs := make([]string, 0, len(s))
+	for _, k := range slices.Sorted(maps.Keys(s)) {
+		kvs = append(kvs, k+"="+s[k])
+	}
+	return strings.Join(kvs, ",")
+}
+
+// Select return the dcmds matching sel in config order
+func (d *Daemon) Select(sel Selector) []*DaemonCmd {
+	var dcmds []*DaemonCmd
+	for _, dcmd := range d.GetDCmds() {
+		if sel.Matches(dcmd.Annotations) {
+			dcmds = append(dcmds, dcmd)
+		}
+	}
+	return dcmds
+}
+
+// StartCmds start the stopped, exited or gave up dcmds, see StartCmd. Starting or running dcmds are skipped
+func (d *Daemon) StartCmds(dcmds []*DaemonCmd) error {
+	var errs error
+	for _, dcmd := range dcmds {
+		if err := d.StartCmd(dcmd); err != nil && !errors.Is(err, ErrInvalidTransition) {
+			errs = errors.Join(errs, err)
+		}
+	}
+	return errs
+}
+
+// StopCmds stop dcmds in reverse dependency order, see Stop
+func (d *Daemon) StopCmds(ctx context.Context, dcmds []*DaemonCmd) error {
+	return d.stop(ctx, dcmds)
+}
+
+// RollingRestart restart dcmds in batches of batchSize in config order, see RestartCmd.
+// The dcmds of a batch are restarted concurrently, the next batch is restarted after
+// all dcmds of the batch are ready, see DaemonCmd.Ready.
+// The rollout is aborted with ErrRolloutAborted if a dcmd of the batch fails to restart,
+// exits or is not ready within readyTimeout, the remaining batches are not restarted
+func (d *Daemon) RollingRestart(ctx context.Context, dcmds []*DaemonCmd, batchSize int, readyTimeout time.Duration) error {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	for i := 0; i < len(dcmds); i += batchSize {
+		batch := dcmds[i:min(i+batchSize, len(dcmds))]
+		var (
+			wg   sync.WaitGroup
+			mu   sync.Mutex
+			errs error
+		)
+		for _, dcmd := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := d.RestartCmd(ctx, dcmd)
+				if err == nil {
+					err = d.waitReady(ctx, dcmd, readyTimeout)
+				}
+				if err != nil {
+					mu.Lock()
+					errs = errors.Join(errs, err)
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if errs != nil {
+			d.Logger.Error("Rolling restart aborted", "batch", i/batchSize+1, "error", errs)
+			return fmt.Errorf("%w at batch %d, %d of %d cmds restarted: %w",
+				ErrRolloutAborted, i/batchSize+1, i, len(dcmds), errs)
+		}
+		d.Logger.Info("Rolling restart batch ready", "batch", i/batchSize+1, "restarted", i+len(batch), "total", len(dcmds))
+	}
+	return nil
+}
+
+// waitReady block until dcmd is ready, see DaemonCmd.Ready.
+// Return an error if dcmd exits, is stopped, or is not ready within timeout
+func (d *Daemon) waitReady(ctx context.Context, dcmd *DaemonCmd, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	gen := dcmd.generation()
+	ticker := time.NewTicker(dependencyPollInterval)
+	defer ticker.Stop()
+	for {
+		if dcmd.Ready() {
+			return nil
+		}
+		// 等待依赖时仍为Stopped状态, 通过generation判断是否被停止
+		if dcmd.generation() != gen {
+			return fmt.Errorf("%s stopped while waiting for ready", dcmd.ID())
+		}
+		switch state := dcmd.State(); state {
+		case Backoff, Exited, Fatal:
+			return fmt.Errorf("%s is %s: %v", dcmd.ID(), state, dcmd.LastErr())
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s not ready within %s", dcmd.ID(), timeout)
+		case <-ticker.C:
+		}
+	}
+}
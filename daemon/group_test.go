@@ -0,0 +1,146 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/sq325/cmdDaemon/config"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{"app=xieCloud,name=prometheus", "app=xieCloud,name=prometheus", false},
+		{" name = node , app=a,", "app=a,name=node", false},
+		{"app=", "app=", false},
+		{"", "", false},
+		{"app", "", true},
+		{"=a", "", true},
+		{"app=a,app=b", "", true},
+	}
+	for _, tt := range tests {
+		sel, err := ParseSelector(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSelector(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, ErrInvalidSelector) {
+				t.Errorf("ParseSelector(%q) error = %v, want ErrInvalidSelector", tt.s, err)
+			}
+			continue
+		}
+		if sel.String() != tt.want {
+			t.Errorf("ParseSelector(%q) = %s, want %s", tt.s, sel, tt.want)
+		}
+	}
+
+	sel, _ := ParseSelector("app=a,name=x")
+	if !sel.Matches(map[string]string{"app": "a", "name": "x", "port": "1"}) || sel.Matches(map[string]string{"app": "a"}) {
+		t.Error("Matches() mismatch")
+	}
+}
+
+func TestDaemon_RollingRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conf, err := config.Unmarshal([]byte(`cmds:
+  - cmd: sleep
+    args: ["100"]
+    annotations: {name: a, app: web}
+  - cmd: sleep
+    args: ["101"]
+    annotations: {name: b, app: web}
+  - cmd: sleep
+    args: ["102"]
+    annotations: {name: c, app: web}
+  - cmd: sleep
+    args: ["103"]
+    annotations: {name: other, app: db}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcmds, err := NewDaemonCmds(ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDaemon(ctx, dcmds, slog.Default())
+	WithCmdLogDir("")(d)
+	go d.Run()
+	defer d.Stop(context.Background())
+	for _, dcmd := range d.GetDCmds() {
+		waitState(t, dcmd, Running)
+	}
+
+	web := d.Select(Selector{"app": "web"})
+	if len(web) != 3 {
+		t.Fatalf("Select(app=web) = %v", web)
+	}
+	pids := make([]int, len(web))
+	for i, dcmd := range web {
+		pids[i] = dcmd.Pid()
+	}
+	other := d.GetDCmds()[3]
+	otherPid := other.Pid()
+
+	if err := d.RollingRestart(context.Background(), web, 2, 3*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i, dcmd := range web {
+		if dcmd.State() != Running || dcmd.Pid() == pids[i] {
+			t.Errorf("%s after RollingRestart() state %v pid %d -> %d", dcmd.ID(), dcmd.State(), pids[i], dcmd.Pid())
+		}
+	}
+	if other.Pid() != otherPid {
+		t.Error("unselected cmd restarted")
+	}
+	// 第一批(a, b)就绪后才重启第二批(c)
+	if c, b := web[2].StateSince(), web[1].StateSince(); c.Before(b) {
+		t.Errorf("batch 2 running at %v before batch 1 at %v", c, b)
+	}
+
+	if err := d.StopCmds(context.Background(), web); err != nil {
+		t.Fatal(err)
+	}
+	for _, dcmd := range web {
+		if dcmd.State() != Stopped {
+			t.Errorf("%s after StopCmds() state %v", dcmd.ID(), dcmd.State())
+		}
+	}
+	if err := d.StartCmds(append(web, other)); err != nil {
+		t.Fatal(err)
+	}
+	for _, dcmd := range web {
+		waitState(t, dcmd, Running)
+	}
+}
+
+func TestDaemon_RollingRestart_abort(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	failing := NewDaemonCmd(ctx, exec.Command("false"), map[string]string{AnnotationsNameKey: "failing"},
+		WithCmdConf(config.CmdConf{Restart: config.RestartNever}))
+	next := NewDaemonCmd(ctx, exec.Command("sleep", "100"), map[string]string{AnnotationsNameKey: "next"})
+	d := NewDaemon(ctx, []*DaemonCmd{failing, next}, slog.Default())
+	WithCmdLogDir("")(d)
+	go d.Run()
+	defer d.Stop(context.Background())
+	waitState(t, next, Running)
+	pid := next.Pid()
+
+	err := d.RollingRestart(context.Background(), []*DaemonCmd{failing, next}, 1, 3*time.Second)
+	if !errors.Is(err, ErrRolloutAborted) {
+		t.Fatalf("RollingRestart() error = %v, want ErrRolloutAborted", err)
+	}
+	if next.Pid() != pid {
+		t.Errorf("cmd after aborted batch restarted: pid %d -> %d", pid, next.Pid())
+	}
+}
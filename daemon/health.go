@@ -0,0 +1,230 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sq325/cmdDaemon/config"
+)
+
+// HealthStatus is the active health check status of a DaemonCmd
+type HealthStatus string
+
+const (
+	HealthUnknown   HealthStatus = "unknown"   // 未配置健康检查或未运行
+	HealthStarting  HealthStatus = "starting"  // 启动后尚未检查成功
+	HealthHealthy   HealthStatus = "healthy"   // 最近一次检查成功, 或连续失败未达到failureThreshold
+	HealthUnhealthy HealthStatus = "unhealthy" // 连续失败达到failureThreshold, cmd将被重启
+)
+
+// HealthStatuses is all health statuses in order
+var HealthStatuses = []HealthStatus{HealthUnknown, HealthStarting, HealthHealthy, HealthUnhealthy}
+
+// prober probe the cmd once, return nil if healthy
+type prober interface {
+	probe(ctx context.Context) error
+}
+
+type httpProber struct {
+	url      string
+	expected int // 0表示2xx或3xx
+}
+
+func (p httpProber) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http probe %s err: %w", p.url, err)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	ok := resp.StatusCode >= 200 && resp.StatusCode < 400
+	if p.expected != 0 {
+		ok = resp.StatusCode == p.expected
+	}
+	if !ok {
+		return fmt.Errorf("http probe %s: unexpected status %d", p.url, resp.StatusCode)
+	}
+	return nil
+}
+
+type tcpProber struct {
+	address string
+}
+
+func (p tcpProber) probe(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		return fmt.Errorf("tcp probe %s err: %w", p.address, err)
+	}
+	return conn.Close()
+}
+
+type execProber struct {
+	cmd  string
+	args []string
+}
+
+func (p execProber) probe(ctx context.Context) error {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.cmd, p.args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// 超时后kill整个进程组, 孙进程持有输出管道时最多再等待waitDelay, 不阻塞健康检查
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	setProcAttr(cmd.SysProcAttr)
+	cmd.Cancel = func() error {
+		return killGroup(cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = waitDelay
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(out.String())
+		if len(output) > 256 {
+			output = output[:256]
+		}
+		return fmt.Errorf("exec probe %s err: %w, output: %s", cmd.String(), err, output)
+	}
+	return nil
+}
+
+// healthChecker run the probes of a DaemonCmd periodically
+type healthChecker struct {
+	probes      []prober
+	interval    time.Duration
+	timeout     time.Duration
+	threshold   int
+	startPeriod time.Duration
+}
+
+// newHealthChecker create a healthChecker from c.
+// If no probe is configured, derive one from annotations: http if metricsPath is set, otherwise tcp
+func newHealthChecker(c *config.HealthCheckConf, annotations map[string]string) *healthChecker {
+	h := &healthChecker{
+		interval:    c.Interval,
+		timeout:     c.Timeout,
+		threshold:   c.FailureThreshold,
+		startPeriod: c.StartPeriod,
+	}
+	if h.interval <= 0 {
+		h.interval = config.DefaultHealthInterval
+	}
+	if h.timeout <= 0 {
+		h.timeout = config.DefaultHealthTimeout
+	}
+	if h.threshold <= 0 {
+		h.threshold = config.DefaultHealthFailureThreshold
+	}
+
+	if c.HTTP != nil {
+		h.probes = append(h.probes, httpProber{url: c.HTTP.URL, expected: c.HTTP.ExpectedStatus})
+	}
+	if c.TCP != nil {
+		h.probes = append(h.probes, tcpProber{address: c.TCP.Address})
+	}
+	if c.Exec != nil {
+		h.probes = append(h.probes, execProber{cmd: c.Exec.Cmd, args: c.Exec.Args})
+	}
+	if len(h.probes) == 0 && annotations[AnnotationsPortKey] != "" {
+		ip := annotations[AnnotationsIPKey]
+		if ip == "" {
+			ip = "127.0.0.1"
+		}
+		address := net.JoinHostPort(ip, annotations[AnnotationsPortKey])
+		if path := annotations[AnnotationsMetricsPathKey]; path != "" {
+			h.probes = append(h.probes, httpProber{url: "http://" + address + path})
+		} else {
+			h.probes = append(h.probes, tcpProber{address: address})
+		}
+	}
+	return h
+}
+
+// check run all probes once, return the joined errors
+func (h *healthChecker) check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	var errs error
+	for _, p := range h.probes {
+		errs = errors.Join(errs, p.probe(ctx))
+	}
+	return errs
+}
+
+// Health return the health status of dcmd and the error of the last failed probe
+func (dcmd *DaemonCmd) Health() (HealthStatus, error) {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	return dcmd.healthStatus, dcmd.healthErr
+}
+
+func (dcmd *DaemonCmd) setHealth(status HealthStatus, err error) {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	dcmd.healthStatus = status
+	dcmd.healthErr = err
+}
+
+// watchHealth probe the running cmd until it exits.
+// When the cmd stays unhealthy for failureThreshold probes, it is terminated,
+// then the daemon restarts it through the limiter like any other exited cmd
+func (dcmd *DaemonCmd) watchHealth(exited <-chan struct{}) {
+	h := dcmd.health
+	start := time.Now()
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	var (
+		failures  int
+		succeeded bool
+	)
+	for {
+		select {
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+
+		err := h.check()
+		if err == nil {
+			failures = 0
+			succeeded = true
+			dcmd.setHealth(HealthHealthy, nil)
+			continue
+		}
+		// startPeriod内首次成功之前的失败不计数
+		if !succeeded && time.Since(start) < h.startPeriod {
+			dcmd.setHealth(HealthStarting, err)
+			continue
+		}
+		failures++
+		if failures < h.threshold {
+			status, _ := dcmd.Health()
+			dcmd.setHealth(status, err)
+			continue
+		}
+
+		dcmd.setHealth(HealthUnhealthy, err)
+		e := NewCmdEvent(dcmd, EventHealth)
+		e.Message, e.Err = fmt.Sprintf("%d consecutive failures, terminating", failures), err.Error()
+		dcmd.events.Publish(e)
+		dcmd.mu.Lock()
+		sig, timeout := dcmd.stopSignal, dcmd.stopTimeout
+		dcmd.mu.Unlock()
+		dcmd.terminate(context.Background(), exited, sig, timeout)
+		return
+	}
+}
@@ -0,0 +1,159 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/sq325/cmdDaemon/config"
+)
+
+func TestProbers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name    string
+		prober  prober
+		wantErr bool
+	}{
+		{name: "http 2xx", prober: httpProber{url: srv.URL + "/up"}},
+		{name: "http 503", prober: httpProber{url: srv.URL + "/down"}, wantErr: true},
+		{name: "http expected status", prober: httpProber{url: srv.URL + "/down", expected: 503}},
+		{name: "http unexpected status", prober: httpProber{url: srv.URL + "/up", expected: 200}, wantErr: true},
+		{name: "tcp open", prober: tcpProber{address: srv.Listener.Addr().String()}},
+		{name: "tcp closed", prober: tcpProber{address: closed}, wantErr: true},
+		{name: "exec success", prober: execProber{cmd: "true"}},
+		{name: "exec failure", prober: execProber{cmd: "sh", args: []string{"-c", "echo boom; exit 1"}}, wantErr: true},
+		// 孙进程持有输出管道, 超时后kill整个进程组
+		{name: "exec timeout with grandchild", prober: execProber{cmd: "sh", args: []string{"-c", "sleep 30 & sleep 30"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			start := time.Now()
+			err := tt.prober.probe(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("probe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second+waitDelay+500*time.Millisecond {
+				t.Errorf("probe() took %v, not bounded by the timeout", elapsed)
+			}
+		})
+	}
+}
+
+func TestNewHealthChecker(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        prober
+	}{
+		{
+			name: "http from metricsPath",
+			annotations: map[string]string{
+				AnnotationsIPKey:          "10.0.0.1",
+				AnnotationsPortKey:        "9091",
+				AnnotationsMetricsPathKey: "/metrics",
+			},
+			want: httpProber{url: "http://10.0.0.1:9091/metrics"},
+		},
+		{
+			name:        "tcp without metricsPath",
+			annotations: map[string]string{AnnotationsPortKey: "9091"},
+			want:        tcpProber{address: "127.0.0.1:9091"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHealthChecker(&config.HealthCheckConf{}, tt.annotations)
+			if len(h.probes) != 1 || h.probes[0] != tt.want {
+				t.Errorf("probes = %+v, want [%+v]", h.probes, tt.want)
+			}
+			if h.interval != config.DefaultHealthInterval || h.timeout != config.DefaultHealthTimeout ||
+				h.threshold != config.DefaultHealthFailureThreshold {
+				t.Errorf("defaults not applied: %+v", h)
+			}
+		})
+	}
+}
+
+func TestDaemonCmd_watchHealth(t *testing.T) {
+	healthConf := func(probe string) config.CmdConf {
+		return config.CmdConf{
+			Restart:     config.RestartOnFailure,
+			StopTimeout: time.Second,
+			HealthCheck: &config.HealthCheckConf{
+				Exec:             &config.ExecProbeConf{Cmd: probe},
+				Interval:         20 * time.Millisecond,
+				Timeout:          time.Second,
+				FailureThreshold: 2,
+			},
+		}
+	}
+
+	t.Run("healthy", func(t *testing.T) {
+		dcmd := NewDaemonCmd(context.Background(), exec.Command("sleep", "100"), nil, WithCmdConf(healthConf("true")))
+		go dcmd.startAndWait(make(chan *DaemonCmd, 1))
+		waitState(t, dcmd, Running)
+		deadline := time.Now().Add(3 * time.Second)
+		for !dcmd.Ready() {
+			if time.Now().After(deadline) {
+				status, err := dcmd.Health()
+				t.Fatalf("Ready() = false, health = %v, %v", status, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := dcmd.Stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if status, _ := dcmd.Health(); status != HealthUnknown {
+			t.Errorf("Health() after Stop() = %v, want %v", status, HealthUnknown)
+		}
+	})
+
+	t.Run("unhealthy is restarted", func(t *testing.T) {
+		ch := make(chan *DaemonCmd, 1)
+		// 进程收到SIGTERM后以0退出, on-failure策略下仍应重启
+		cmd := exec.Command("sh", "-c", "trap 'exit 0' TERM; sleep 100 & wait")
+		dcmd := NewDaemonCmd(context.Background(), cmd, nil, WithCmdConf(healthConf("false")))
+		go dcmd.startAndWait(ch)
+
+		select {
+		case got := <-ch:
+			if got != dcmd {
+				t.Fatal("unexpected dcmd from exitedCmdCh")
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("unhealthy cmd was not terminated")
+		}
+		if !errors.Is(dcmd.Err, ErrUnhealthy) {
+			t.Errorf("Err = %v, want %v", dcmd.Err, ErrUnhealthy)
+		}
+		if status, _ := dcmd.Health(); status != HealthUnhealthy {
+			t.Errorf("Health() = %v, want %v", status, HealthUnhealthy)
+		}
+		if !dcmd.shouldRestart() {
+			t.Error("shouldRestart() = false, want true")
+		}
+	})
+}
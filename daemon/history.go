@@ -0,0 +1,239 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sq325/cmdDaemon/internal/tool"
+)
+
+// Default limits of the run history
+const (
+	DefaultRunHistory = 20   // 每个cmd保留的最近运行记录数
+	DefaultStderrTail = 20   // 每条运行记录保留的stderr行数
+	stderrLineMax     = 1024 // stderr单行最大长度, 超过部分丢弃
+)
+
+// StartReason is why a run was started
+type StartReason string
+
+const (
+	StartReasonStart   StartReason = "start"   // 守护进程启动、新增或重载配置后首次启动
+	StartReasonRestart StartReason = "restart" // 退出后按重启策略重启, 原因见上一条记录的ExitReason和Err
+	StartReasonManual  StartReason = "manual"  // 通过API启动或重启
+)
+
+// ExitReason is why a run ended
+type ExitReason string
+
+const (
+	ExitReasonExited      ExitReason = "exited"      // 进程自行退出
+	ExitReasonStopped     ExitReason = "stopped"     // 被守护进程或API停止
+	ExitReasonUnhealthy   ExitReason = "unhealthy"   // 健康检查失败被终止
+	ExitReasonStartFailed ExitReason = "startFailed" // 启动失败
+)
+
+// RunRecord is a finished run of a dcmd
+type RunRecord struct {
+	Pid         int         `json:"pid,omitempty"`
+	StartReason StartReason `json:"startReason"`
+	StartTime   time.Time   `json:"startTime"`
+	ExitTime    time.Time   `json:"exitTime"`
+	Runtime     string      `json:"runtime"`
+	ExitReason  ExitReason  `json:"exitReason"`
+	ExitCode    int         `json:"exitCode"`         // 被信号终止时为-1
+	Signal      string      `json:"signal,omitempty"` // 终止进程的信号
+	Err         string      `json:"err,omitempty"`
+	Stderr      []string    `json:"stderr,omitempty"` // 最后几行stderr
+}
+
+// finish set the exit fields of r from the process state of the run
+func (r *RunRecord) finish(state *os.ProcessState, reason ExitReason, err error) {
+	r.ExitTime = time.Now()
+	r.Runtime = r.ExitTime.Sub(r.StartTime).Round(time.Millisecond).String()
+	r.ExitReason = reason
+	r.ExitCode = -1
+	if state != nil {
+		r.ExitCode = state.ExitCode()
+		if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			r.Signal = tool.SignalName(ws.Signal())
+		}
+	}
+	if err != nil {
+		r.Err = err.Error()
+	}
+}
+
+// tailWriter keep the last lines written to it. 并发安全
+type tailWriter struct {
+	mu      sync.Mutex
+	lines   []string
+	max     int
+	partial []byte // 未结束的行
+}
+
+func newTailWriter(max int) *tailWriter {
+	return &tailWriter{max: max}
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.appendPartial(p)
+			break
+		}
+		w.appendPartial(p[:i])
+		w.addLine(string(w.partial))
+		w.partial = w.partial[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (w *tailWriter) appendPartial(p []byte) {
+	if room := stderrLineMax - len(w.partial); room < len(p) {
+		p = p[:max(room, 0)]
+	}
+	w.partial = append(w.partial, p...)
+}
+
+func (w *tailWriter) addLine(line string) {
+	w.lines = append(w.lines, line)
+	if len(w.lines) > w.max {
+		w.lines = w.lines[len(w.lines)-w.max:]
+	}
+}
+
+// Lines return the last lines, including an unterminated last line
+func (w *tailWriter) Lines() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	lines := append([]string(nil), w.lines...)
+	if len(w.partial) > 0 {
+		lines = append(lines, string(w.partial))
+		lines = lines[max(len(lines)-w.max, 0):]
+	}
+	return lines
+}
+
+// historyStore keep the latest runs of each dcmd by DaemonCmd.ID,
+// and save them to a state file so the history survives daemon restarts.
+// A nil historyStore discards runs. 并发安全
+type historyStore struct {
+	mu     sync.Mutex
+	file   string // 状态文件, 为空时不保存
+	size   int
+	runs   map[string][]RunRecord
+	logger *slog.Logger
+}
+
+// historyState is the content of the state file
+type historyState struct {
+	Runs map[string][]RunRecord `json:"runs"`
+}
+
+func newHistoryStore(size int, logger *slog.Logger) *historyStore {
+	if size <= 0 {
+		size = DefaultRunHistory
+	}
+	return &historyStore{size: size, runs: make(map[string][]RunRecord), logger: logger}
+}
+
+// load read the runs saved in file, and save later runs to it. A missing file is not an error
+func (s *historyStore) load(file string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file = file
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state historyState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("parse state file %s: %w", file, err)
+	}
+	for id, runs := range state.Runs {
+		s.runs[id] = runs[max(len(runs)-s.size, 0):]
+	}
+	return nil
+}
+
+// prune forget the runs of the ids not in keep and save the state file if any is removed,
+// e.g. the cmds were edited or removed from the config while the daemon was down
+func (s *historyStore) prune(keep []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.runs)
+	maps.DeleteFunc(s.runs, func(id string, _ []RunRecord) bool {
+		return !slices.Contains(keep, id)
+	})
+	if len(s.runs) != n {
+		s.save()
+	}
+}
+
+// add append r to the runs of id and save the state file
+func (s *historyStore) add(id string, r RunRecord) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runs := append(s.runs[id], r)
+	s.runs[id] = runs[max(len(runs)-s.size, 0):]
+	s.save()
+}
+
+// remove forget the runs of id, e.g. the dcmd is removed from the config
+func (s *historyStore) remove(id string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.runs[id]; !ok {
+		return
+	}
+	delete(s.runs, id)
+	s.save()
+}
+
+// get return the runs of id, oldest first
+func (s *historyStore) get(id string) []RunRecord {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]RunRecord{}, s.runs[id]...)
+}
+
+// save write the runs to the state file atomically, s.mu must be held
+func (s *historyStore) save() {
+	if s.file == "" {
+		return
+	}
+	b, err := json.Marshal(historyState{Runs: s.runs})
+	if err == nil {
+		err = tool.WriteFileAtomic(s.file, b)
+	}
+	if err != nil {
+		s.logger.Error("Save state file failed", "file", s.file, "error", err)
+	}
+}
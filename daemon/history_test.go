@@ -0,0 +1,119 @@
+package daemon
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sq325/cmdDaemon/config"
+	"github.com/sq325/cmdDaemon/internal/tool"
+)
+
+func TestTailWriter(t *testing.T) {
+	w := newTailWriter(3)
+	w.Write([]byte("a\nb"))
+	w.Write([]byte("c\nd\n"))
+	if got := w.Lines(); !slices.Equal(got, []string{"a", "bc", "d"}) {
+		t.Errorf("Lines() = %q", got)
+	}
+	w.Write([]byte("e\nf"))
+	if got := w.Lines(); !slices.Equal(got, []string{"d", "e", "f"}) {
+		t.Errorf("Lines() with partial line = %q", got)
+	}
+	w.Write([]byte(strings.Repeat("x", 2*stderrLineMax) + "\n"))
+	if got := w.Lines(); len(got[2]) != stderrLineMax || !strings.HasPrefix(got[2], "fx") {
+		t.Errorf("long line truncated to %d bytes", len(got[2]))
+	}
+}
+
+func TestDaemonCmd_History(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stateFile := filepath.Join(t.TempDir(), "daemon.state.json")
+	failing := NewDaemonCmd(ctx, exec.Command("sh", "-c", "echo starting; echo boom >&2; exit 3"),
+		map[string]string{AnnotationsNameKey: "failing"},
+		WithCmdConf(config.CmdConf{LimiterConf: config.LimiterConf{RestartLimit: tool.Ptr(1), BackoffBase: time.Millisecond, Cooldown: tool.Ptr(time.Duration(0))}}))
+	sleeper := NewDaemonCmd(ctx, exec.Command("sleep", "100"), map[string]string{AnnotationsNameKey: "sleeper"})
+	d := NewDaemon(ctx, []*DaemonCmd{failing, sleeper}, slog.Default())
+	logDir := t.TempDir()
+	WithCmdLogDir(logDir)(d)
+	WithStateFile(stateFile)(d)
+	go d.Run()
+	defer d.Stop(context.Background())
+	waitState(t, failing, Fatal)
+	waitState(t, sleeper, Running)
+
+	runs := failing.History()
+	if len(runs) != 2 {
+		t.Fatalf("History() = %+v, want 2 runs", runs)
+	}
+	for i, reason := range []StartReason{StartReasonStart, StartReasonRestart} {
+		r := runs[i]
+		if r.StartReason != reason || r.ExitReason != ExitReasonExited || r.ExitCode != 3 || r.Signal != "" || r.Pid == 0 {
+			t.Errorf("runs[%d] = %+v", i, r)
+		}
+		if !slices.Equal(r.Stderr, []string{"boom"}) || !strings.Contains(r.Err, "exit status 3") || r.ExitTime.Before(r.StartTime) {
+			t.Errorf("runs[%d] stderr %q, err %q", i, r.Stderr, r.Err)
+		}
+	}
+
+	// stderr仍然写入日志文件
+	logs, _ := filepath.Glob(filepath.Join(logDir, "failing_*.log"))
+	if len(logs) != 1 {
+		t.Fatalf("log files = %v", logs)
+	}
+	// stdout和stderr通过不同的管道写入, 两者之间的顺序不保证
+	if b, _ := os.ReadFile(logs[0]); strings.Count(string(b), "starting\n") != 2 || strings.Count(string(b), "boom\n") != 2 || len(b) != 28 {
+		t.Errorf("log file = %q", b)
+	}
+
+	if err := d.RestartCmd(context.Background(), sleeper); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, sleeper, Running)
+	if err := sleeper.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	runs = sleeper.History()
+	if len(runs) != 2 {
+		t.Fatalf("History() = %+v, want 2 runs", runs)
+	}
+	if r := runs[0]; r.StartReason != StartReasonStart || r.ExitReason != ExitReasonStopped || r.ExitCode != -1 || r.Signal != "SIGTERM" {
+		t.Errorf("stopped run = %+v", r)
+	}
+	if r := runs[1]; r.StartReason != StartReasonManual || r.ExitReason != ExitReasonStopped {
+		t.Errorf("manually started run = %+v", r)
+	}
+
+	// 守护进程重启后从状态文件恢复
+	d2 := NewDaemon(ctx, []*DaemonCmd{NewDaemonCmd(ctx, exec.Command("sleep", "100"), map[string]string{AnnotationsNameKey: "sleeper"})}, slog.Default())
+	WithStateFile(stateFile)(d2)
+	if runs := d2.GetDCmds()[0].History(); len(runs) != 2 || runs[1].StartReason != StartReasonManual {
+		t.Errorf("History() after reload from state file = %+v", runs)
+	}
+	// failing不在d2中, 其运行记录从状态文件中删除
+	if runs := d2.history.get(failing.ID()); len(runs) != 0 {
+		t.Errorf("runs of removed cmd kept after reload: %+v", runs)
+	}
+	if b, _ := os.ReadFile(stateFile); strings.Contains(string(b), `"`+failing.ID()+`"`) {
+		t.Errorf("runs of removed cmd kept in state file: %s", b)
+	}
+
+	store := newHistoryStore(2, slog.Default())
+	for i := range 3 {
+		store.add("a", RunRecord{Pid: i})
+	}
+	if runs := store.get("a"); len(runs) != 2 || runs[0].Pid != 1 {
+		t.Errorf("bounded history = %+v", runs)
+	}
+	store.remove("a")
+	if runs := store.get("a"); len(runs) != 0 {
+		t.Errorf("history after remove = %+v", runs)
+	}
+}
@@ -9,6 +9,9 @@ import (
 // It is a slice of TargetGroup objects.
 type HttpSDResponse []TargetGroup
 
+// StateLabel is the target label of DaemonCmd state, available in relabeling only
+const StateLabel = "__meta_daemon_cmd_state"
+
 // TargetGroup is a collection of targets that share a common set of labels.
 type TargetGroup struct {
 	Targets []string          `json:"targets"`
@@ -20,14 +23,16 @@ func HttpSDHandler(d *Daemon) http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 
 		var response HttpSDResponse
-		for _, dcmd := range d.DCmds {
+		for _, dcmd := range d.GetDCmds() {
 			if dcmd.Annotations == nil {
 				continue
 			}
 			if dcmd.Annotations[AnnotationsMetricsPathKey] == "" || dcmd.Annotations[AnnotationsIPKey] == "" || dcmd.Annotations[AnnotationsPortKey] == "" {
 				continue // Skip commands that do not provide metrics
 			}
-			if dcmd.Status == Running {
+			// 手动停止或按重启策略退出的cmd不再作为target
+			state := dcmd.State()
+			if state != Stopped && state != Exited {
 				targets := []string{dcmd.Annotations[AnnotationsIPKey] + ":" + dcmd.Annotations[AnnotationsPortKey]}
 				labels := map[string]string{
 					AnnotationsNameKey:        dcmd.Annotations[AnnotationsNameKey],
@@ -35,6 +40,8 @@ func HttpSDHandler(d *Daemon) http.HandlerFunc {
 					AnnotationsMetricsPathKey: dcmd.Annotations[AnnotationsMetricsPathKey],
 					AnnotationsHostnameKey:    dcmd.Annotations[AnnotationsHostnameKey],
 					AnnotationsAppKey:         dcmd.Annotations[AnnotationsAppKey],
+					// __meta_前缀的label只在relabel阶段可见, 状态变化不会产生新的时间序列
+					StateLabel: state.String(),
 				}
 				response = append(response, TargetGroup{Targets: targets, Labels: labels})
 			}
@@ -87,7 +87,7 @@ func TestHttpSDHandler(t *testing.T) {
 				DCmds: []*DaemonCmd{
 					{
 						Annotations: nil,
-						Status:      Running,
+						state:       Running,
 					},
 				},
 			},
@@ -101,7 +101,7 @@ func TestHttpSDHandler(t *testing.T) {
 						Annotations: map[string]string{
 							AnnotationsNameKey: "test-service",
 						},
-						Status: Running,
+						state: Running,
 					},
 				},
 			},
@@ -118,12 +118,41 @@ func TestHttpSDHandler(t *testing.T) {
 							AnnotationsPortKey:        "8080",
 							AnnotationsMetricsPathKey: "/metrics",
 						},
-						Status: Exited,
+						state: Exited,
 					},
 				},
 			},
 			expected: HttpSDResponse{},
 		},
+		{
+			name: "daemon with backoff status",
+			daemon: &Daemon{
+				DCmds: []*DaemonCmd{
+					{
+						Annotations: map[string]string{
+							AnnotationsNameKey:        "test-service",
+							AnnotationsIPKey:          "192.168.1.100",
+							AnnotationsPortKey:        "8080",
+							AnnotationsMetricsPathKey: "/metrics",
+						},
+						state: Backoff,
+					},
+				},
+			},
+			expected: HttpSDResponse{
+				{
+					Targets: []string{"192.168.1.100:8080"},
+					Labels: map[string]string{
+						"name":                 "test-service",
+						"hostAdmIp":            "192.168.1.100",
+						"metricsPath":          "/metrics",
+						AnnotationsHostnameKey: "",
+						AnnotationsAppKey:      "",
+						StateLabel:             "backoff",
+					},
+				},
+			},
+		},
 		{
 			name: "daemon with valid running service",
 			daemon: &Daemon{
@@ -136,7 +165,7 @@ func TestHttpSDHandler(t *testing.T) {
 							AnnotationsMetricsPathKey: "/metrics",
 							AnnotationsHostnameKey:    "proxy-a",
 						},
-						Status: Running,
+						state: Running,
 					},
 				},
 			},
@@ -149,6 +178,7 @@ func TestHttpSDHandler(t *testing.T) {
 						"metricsPath":          "/metrics",
 						AnnotationsHostnameKey: "proxy-a",
 						AnnotationsAppKey:      "",
+						StateLabel:             "running",
 					},
 				},
 			},
@@ -166,7 +196,7 @@ func TestHttpSDHandler(t *testing.T) {
 							AnnotationsHostnameKey:    "proxy-a",
 							AnnotationsAppKey:         "app1",
 						},
-						Status: Running,
+						state: Running,
 					},
 					{
 						Annotations: map[string]string{
@@ -176,7 +206,7 @@ func TestHttpSDHandler(t *testing.T) {
 							AnnotationsMetricsPathKey: "/metrics",
 							AnnotationsHostnameKey:    "proxy-b",
 						},
-						Status: Running,
+						state: Running,
 					},
 				},
 			},
@@ -189,6 +219,7 @@ func TestHttpSDHandler(t *testing.T) {
 						"metricsPath":          "/metrics",
 						AnnotationsHostnameKey: "proxy-a",
 						AnnotationsAppKey:      "app1",
+						StateLabel:             "running",
 					},
 				},
 				{
@@ -199,6 +230,7 @@ func TestHttpSDHandler(t *testing.T) {
 						"metricsPath":          "/metrics",
 						AnnotationsHostnameKey: "proxy-b",
 						AnnotationsAppKey:      "",
+						StateLabel:             "running",
 					},
 				},
 			},
@@ -2,51 +2,119 @@ package daemon
 
 import (
 	"math"
+	"math/rand/v2"
 	"sync"
 	"time"
+
+	"github.com/sq325/cmdDaemon/config"
+	"github.com/sq325/cmdDaemon/internal/tool"
+)
+
+// LimiterState is the circuit breaker state of a Limiter
+type LimiterState string
+
+const (
+	LimiterOK        LimiterState = "ok"        // 允许重启
+	LimiterCooldown  LimiterState = "cooldown"  // 超过重启限制, 等待cooldown结束后再重启
+	LimiterExhausted LimiterState = "exhausted" // 超过重启限制且未配置cooldown, 不再重启
 )
 
+// LimiterStatus is a snapshot of a Limiter
+type LimiterStatus struct {
+	State         LimiterState `json:"state"`
+	Restarts      int          `json:"restarts"` // restartWindow内的重启次数
+	Limit         int          `json:"limit"`
+	Window        string       `json:"window"`
+	CooldownUntil *time.Time   `json:"cooldownUntil,omitempty"`
+}
+
+// Limiter 限制restartWindow内的重启次数, 超过限制后进入cooldown状态
 // 并发安全
 type Limiter struct {
 	mu           sync.Mutex
-	count, limit int
+	count, limit int // count: 连续重启次数, 用于计算重启间隔
+
+	restarts []time.Time   // restartWindow内每次restart的时间
+	window   time.Duration // 重启次数的滑动窗口
 
-	interval time.Duration  // 限制restart时间间隔
-	last     time.Time      // 上次restart时间
-	location *time.Location // 时区
+	interval    time.Duration        // 限制restart时间间隔
+	maxInterval time.Duration        // restart时间间隔上限, 0表示不限制
+	jitter      config.BackoffJitter // restart时间间隔抖动策略
+	resetAfter  time.Duration        // 距上次restart超过resetAfter后重置count, 0表示不重置
+	last        time.Time            // 上次restart时间, 带单调时钟读数, 不受时区和系统时间调整影响
+	prevDelay   time.Duration        // 上次restart时间间隔, 用于decorrelated抖动
+	nextAt      time.Time            // 缓存的下次restart时间, 每次restart后重新计算
 
+	cooldown      time.Duration // 超过限制后的等待时间, 0表示不再重启
+	cooldownUntil time.Time     // cooldown结束时间, zero表示不在cooldown中
+	exhausted     bool          // 超过限制且cooldown为0
 }
 
-func NewLimiter() *Limiter {
-	location, _ := time.LoadLocation("Asia/Shanghai")
+// NewLimiter create a Limiter from c, zero fields of c use config.DefaultLimiterConf
+func NewLimiter(c config.LimiterConf) *Limiter {
+	c = c.WithDefaults(config.DefaultLimiterConf)
 	return &Limiter{
-		limit:    5,
-		interval: time.Second,
-		location: location,
+		limit:       tool.Deref(c.RestartLimit),
+		window:      c.RestartWindow,
+		interval:    c.BackoffBase,
+		maxInterval: tool.Deref(c.BackoffMax),
+		jitter:      c.BackoffJitter,
+		resetAfter:  tool.Deref(c.ResetAfter),
+		cooldown:    tool.Deref(c.Cooldown),
 	}
 }
 
+// Inc record a restart, return false if the restart budget is used up.
+// When the budget is used up, the Limiter enters cooldown if configured.
 func (l *Limiter) Inc() bool {
-	return l.add(1)
-}
-
-func (l *Limiter) add(n int) bool {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	// 限制重启时间间隔, 每次重启时间间隔增加2的count次方
-	if !l.last.Before(l.next()) {
+
+	now := time.Now()
+	if l.exhausted {
 		return false
 	}
-	if l.count+n > l.limit || l.count+n < 0 {
+	if !l.cooldownUntil.IsZero() {
+		if now.Before(l.cooldownUntil) {
+			return false
+		}
+		// cooldown结束, 重新开始计数
+		l.cooldownUntil = time.Time{}
+		l.restarts = nil
+		l.count = 0
+	}
+	// 距上次重启足够久, 说明cmd已稳定运行, 重置重启间隔
+	if l.expired() {
+		l.count = 0
+		l.prevDelay = 0
+	}
+
+	l.prune(now)
+	if len(l.restarts)+1 > l.limit {
+		if l.cooldown > 0 {
+			l.cooldownUntil = now.Add(l.cooldown)
+		} else {
+			l.exhausted = true
+		}
 		return false
 	}
-	l.count += n
-	l.last = time.Now().In(l.location)
+	l.restarts = append(l.restarts, now)
+	l.count++
+	l.last = now
+	l.nextAt = time.Time{}
 	return true
 }
 
+// Dec revert the last restart
 func (l *Limiter) Dec() bool {
-	return l.add(-1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.restarts) == 0 || l.count == 0 {
+		return false
+	}
+	l.restarts = l.restarts[:len(l.restarts)-1]
+	l.count--
+	return true
 }
 
 func (l *Limiter) Reset() {
@@ -54,12 +122,107 @@ func (l *Limiter) Reset() {
 	defer l.mu.Unlock()
 	l.count = 0
 	l.last = time.Time{}
+	l.prevDelay = 0
+	l.nextAt = time.Time{}
+	l.restarts = nil
+	l.cooldownUntil = time.Time{}
+	l.exhausted = false
+}
+
+// Status return a snapshot of the limiter
+func (l *Limiter) Status() LimiterStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(time.Now())
+	status := LimiterStatus{
+		State:    LimiterOK,
+		Restarts: len(l.restarts),
+		Limit:    l.limit,
+		Window:   l.window.String(),
+	}
+	switch {
+	case l.exhausted:
+		status.State = LimiterExhausted
+	case !l.cooldownUntil.IsZero():
+		status.State = LimiterCooldown
+		until := l.cooldownUntil
+		status.CooldownUntil = &until
+	}
+	return status
+}
+
+// CooldownUntil return the end of the cooldown and true if the limiter is in cooldown
+func (l *Limiter) CooldownUntil() (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cooldownUntil, !l.cooldownUntil.IsZero()
+}
+
+// Next return the time when the cmd can be restarted next
+func (l *Limiter) Next() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next()
+}
+
+// prune drop restarts out of the sliding window
+func (l *Limiter) prune(now time.Time) {
+	if l.window <= 0 {
+		return
+	}
+	i := 0
+	for i < len(l.restarts) && now.Sub(l.restarts[i]) >= l.window {
+		i++
+	}
+	l.restarts = l.restarts[i:]
+}
+
+// expired report whether resetAfter has elapsed since the last restart
+func (l *Limiter) expired() bool {
+	return l.resetAfter > 0 && !l.last.IsZero() && time.Since(l.last) >= l.resetAfter
 }
 
 // 计算cmd下次可以启动的时间
 func (l *Limiter) next() time.Time {
-	if l.last.IsZero() {
-		return time.Now().In(l.location)
+	if !l.cooldownUntil.IsZero() {
+		return l.cooldownUntil
+	}
+	if l.last.IsZero() || l.expired() {
+		return time.Now()
+	}
+	// 每次restart只计算一次, 保证抖动后的时间稳定
+	if l.nextAt.IsZero() {
+		delay := l.backoff()
+		l.prevDelay = delay
+		l.nextAt = l.last.Add(delay)
+	}
+	return l.nextAt
+}
+
+// backoff return the delay before next restart:
+// interval*2^count capped by maxInterval, then randomized by jitter
+func (l *Limiter) backoff() time.Duration {
+	if l.jitter == config.JitterDecorrelated {
+		// min(maxInterval, random_between(interval, prevDelay*3))
+		prev := max(l.prevDelay, l.interval)
+		return l.capped(float64(l.interval) + rand.Float64()*float64(3*prev-l.interval))
+	}
+	d := l.capped(math.Pow(2, float64(l.count)) * float64(l.interval))
+	if l.jitter == config.JitterFull {
+		// random_between(0, min(maxInterval, interval*2^count))
+		return time.Duration(rand.Float64() * float64(d))
+	}
+	return d
+}
+
+// capped convert d to time.Duration, no more than maxInterval
+func (l *Limiter) capped(d float64) time.Duration {
+	if l.maxInterval > 0 && d > float64(l.maxInterval) {
+		return l.maxInterval
+	}
+	if d > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
 	}
-	return l.last.Add(time.Duration(math.Pow(2, float64(l.count))) * l.interval)
+	return time.Duration(d)
 }
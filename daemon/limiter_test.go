@@ -3,25 +3,28 @@ package daemon
 import (
 	"testing"
 	"time"
+
+	"github.com/sq325/cmdDaemon/config"
+	"github.com/sq325/cmdDaemon/internal/tool"
 )
 
 func TestLimiter_next(t *testing.T) {
 	tests := []struct {
-		name     string
-		count    int
-		last     time.Time
-		interval time.Duration
-		location *time.Location
-		wantFunc func(time.Time) bool
+		name        string
+		count       int
+		last        time.Time
+		interval    time.Duration
+		maxInterval time.Duration
+		resetAfter  time.Duration
+		wantFunc    func(time.Time) bool
 	}{
 		{
 			name:     "zero last time returns current time",
 			count:    0,
 			last:     time.Time{},
 			interval: time.Second,
-			location: time.UTC,
 			wantFunc: func(result time.Time) bool {
-				now := time.Now().In(time.UTC)
+				now := time.Now()
 				return result.Sub(now) < time.Millisecond && result.Sub(now) > -time.Millisecond
 			},
 		},
@@ -30,7 +33,6 @@ func TestLimiter_next(t *testing.T) {
 			count:    0,
 			last:     time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC),
 			interval: time.Second,
-			location: time.UTC,
 			wantFunc: func(result time.Time) bool {
 				expected := time.Date(2023, 1, 1, 12, 0, 1, 0, time.UTC)
 				return result.Equal(expected)
@@ -41,7 +43,6 @@ func TestLimiter_next(t *testing.T) {
 			count:    1,
 			last:     time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC),
 			interval: time.Second,
-			location: time.UTC,
 			wantFunc: func(result time.Time) bool {
 				expected := time.Date(2023, 1, 1, 12, 0, 2, 0, time.UTC)
 				return result.Equal(expected)
@@ -52,7 +53,6 @@ func TestLimiter_next(t *testing.T) {
 			count:    3,
 			last:     time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC),
 			interval: time.Second,
-			location: time.UTC,
 			wantFunc: func(result time.Time) bool {
 				expected := time.Date(2023, 1, 1, 12, 0, 8, 0, time.UTC)
 				return result.Equal(expected)
@@ -63,21 +63,43 @@ func TestLimiter_next(t *testing.T) {
 			count:    2,
 			last:     time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC),
 			interval: time.Minute,
-			location: time.UTC,
 			wantFunc: func(result time.Time) bool {
 				expected := time.Date(2023, 1, 1, 12, 4, 0, 0, time.UTC)
 				return result.Equal(expected)
 			},
 		},
+		{
+			name:        "capped by max interval",
+			count:       10,
+			last:        time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC),
+			interval:    time.Second,
+			maxInterval: time.Minute,
+			wantFunc: func(result time.Time) bool {
+				expected := time.Date(2023, 1, 1, 12, 1, 0, 0, time.UTC)
+				return result.Equal(expected)
+			},
+		},
+		{
+			name:       "expired by reset after returns current time",
+			count:      3,
+			last:       time.Now().Add(-time.Hour),
+			interval:   time.Second,
+			resetAfter: 30 * time.Minute,
+			wantFunc: func(result time.Time) bool {
+				now := time.Now()
+				return result.Sub(now) < time.Millisecond && result.Sub(now) > -time.Millisecond
+			},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			l := &Limiter{
-				count:    tt.count,
-				last:     tt.last,
-				interval: tt.interval,
-				location: tt.location,
+				count:       tt.count,
+				last:        tt.last,
+				interval:    tt.interval,
+				maxInterval: tt.maxInterval,
+				resetAfter:  tt.resetAfter,
 			}
 			got := l.next()
 			if !tt.wantFunc(got) {
@@ -86,3 +108,139 @@ func TestLimiter_next(t *testing.T) {
 		})
 	}
 }
+
+func TestLimiter_Inc(t *testing.T) {
+	t.Run("limit reached", func(t *testing.T) {
+		l := NewLimiter(config.LimiterConf{RestartLimit: tool.Ptr(2), BackoffBase: time.Nanosecond, Cooldown: tool.Ptr(time.Duration(0))})
+		for i := 0; i < 2; i++ {
+			if !l.Inc() {
+				t.Fatalf("Inc() #%d = false, want true", i+1)
+			}
+		}
+		if l.Inc() {
+			t.Error("Inc() over limit = true, want false")
+		}
+		if got := l.Status().State; got != LimiterExhausted {
+			t.Errorf("state = %s, want %s", got, LimiterExhausted)
+		}
+	})
+
+	t.Run("reset backoff after stable running", func(t *testing.T) {
+		l := NewLimiter(config.LimiterConf{RestartLimit: tool.Ptr(5), BackoffBase: time.Nanosecond, ResetAfter: tool.Ptr(time.Minute)})
+		if !l.Inc() || !l.Inc() {
+			t.Fatal("Inc() = false, want true")
+		}
+		l.last = time.Now().Add(-2 * time.Minute)
+		if !l.Inc() {
+			t.Error("Inc() after resetAfter = false, want true")
+		}
+		if l.count != 1 {
+			t.Errorf("count = %d, want 1", l.count)
+		}
+	})
+
+	t.Run("sliding window", func(t *testing.T) {
+		l := NewLimiter(config.LimiterConf{RestartLimit: tool.Ptr(2), RestartWindow: time.Minute})
+		l.restarts = []time.Time{time.Now().Add(-2 * time.Minute), time.Now().Add(-30 * time.Second)}
+		if got := l.Status().Restarts; got != 1 {
+			t.Errorf("restarts in window = %d, want 1", got)
+		}
+		if !l.Inc() {
+			t.Error("Inc() = false, want true: restart out of window should not count")
+		}
+		if l.Inc() {
+			t.Error("Inc() = true, want false: window budget used up")
+		}
+	})
+
+	t.Run("cooldown", func(t *testing.T) {
+		l := NewLimiter(config.LimiterConf{RestartLimit: tool.Ptr(1), Cooldown: tool.Ptr(time.Hour)})
+		if !l.Inc() {
+			t.Fatal("Inc() = false, want true")
+		}
+		if l.Inc() {
+			t.Fatal("Inc() over limit = true, want false")
+		}
+		until, ok := l.CooldownUntil()
+		if !ok {
+			t.Fatal("CooldownUntil() ok = false, want true")
+		}
+		if !l.Next().Equal(until) {
+			t.Errorf("Next() = %v, want cooldown end %v", l.Next(), until)
+		}
+		if got := l.Status().State; got != LimiterCooldown {
+			t.Errorf("state = %s, want %s", got, LimiterCooldown)
+		}
+		if l.Inc() {
+			t.Error("Inc() during cooldown = true, want false")
+		}
+
+		// cooldown结束后允许重启
+		l.cooldownUntil = time.Now().Add(-time.Second)
+		if !l.Inc() {
+			t.Error("Inc() after cooldown = false, want true")
+		}
+		if got := l.Status(); got.State != LimiterOK || got.Restarts != 1 {
+			t.Errorf("status = %+v, want ok with 1 restart", got)
+		}
+	})
+
+	t.Run("default cooldown", func(t *testing.T) {
+		l := NewLimiter(config.LimiterConf{RestartLimit: tool.Ptr(1)})
+		if !l.Inc() || l.Inc() {
+			t.Fatal("Inc() should allow exactly 1 restart")
+		}
+		until, ok := l.CooldownUntil()
+		if !ok {
+			t.Fatal("CooldownUntil() ok = false, want true: limiter exhausted without cooldown by default")
+		}
+		if d := time.Until(until); d <= config.DefaultCooldown-time.Minute || d > config.DefaultCooldown {
+			t.Errorf("cooldown = %v, want %v", d, config.DefaultCooldown)
+		}
+	})
+}
+
+func TestLimiter_backoffJitter(t *testing.T) {
+	base, maxInterval := time.Second, 10*time.Second
+
+	t.Run("full jitter within [0, cap]", func(t *testing.T) {
+		l := &Limiter{count: 3, interval: base, maxInterval: maxInterval, jitter: config.JitterFull}
+		for i := 0; i < 100; i++ {
+			if d := l.backoff(); d < 0 || d > 8*time.Second {
+				t.Fatalf("backoff() = %v, want within [0, 8s]", d)
+			}
+		}
+		l.count = 10
+		for i := 0; i < 100; i++ {
+			if d := l.backoff(); d < 0 || d > maxInterval {
+				t.Fatalf("backoff() = %v, want within [0, %v]", d, maxInterval)
+			}
+		}
+	})
+
+	t.Run("decorrelated jitter within [base, min(cap, prev*3)]", func(t *testing.T) {
+		l := &Limiter{interval: base, maxInterval: maxInterval, jitter: config.JitterDecorrelated, prevDelay: 2 * time.Second}
+		for i := 0; i < 100; i++ {
+			if d := l.backoff(); d < base || d > 6*time.Second {
+				t.Fatalf("backoff() = %v, want within [%v, 6s]", d, base)
+			}
+		}
+		l.prevDelay = time.Minute
+		for i := 0; i < 100; i++ {
+			if d := l.backoff(); d < base || d > maxInterval {
+				t.Fatalf("backoff() = %v, want within [%v, %v]", d, base, maxInterval)
+			}
+		}
+	})
+
+	t.Run("next is stable until next restart", func(t *testing.T) {
+		l := NewLimiter(config.LimiterConf{BackoffBase: time.Minute, BackoffJitter: config.JitterFull})
+		l.Inc()
+		first := l.Next()
+		for i := 0; i < 10; i++ {
+			if got := l.Next(); !got.Equal(first) {
+				t.Fatalf("Next() = %v, want %v", got, first)
+			}
+		}
+	})
+}
@@ -0,0 +1,359 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/sq325/cmdDaemon/config"
+	"github.com/sq325/cmdDaemon/internal/logfile"
+	"github.com/sq325/cmdDaemon/internal/logsink"
+	"github.com/sq325/cmdDaemon/internal/loki"
+)
+
+// Names of the output streams of a process
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+const (
+	logTimeFormat = "2006-01-02T15:04:05.000Z07:00" // RFC3339, 精确到毫秒
+	logLineMax    = 64 << 10                        // 加前缀时单行最大长度, 超过时拆分为多行
+)
+
+// logOptions convert the LogConf of a cmd to logfile.Options
+func logOptions(c config.LogConf) logfile.Options {
+	return logfile.Options{
+		MaxSize:     int64(c.MaxSize),
+		RotateEvery: c.RotateEvery,
+		MaxBackups:  c.MaxBackups,
+		Compress:    c.Compress != nil && *c.Compress,
+	}
+}
+
+// logWriter write the output of a process to its log file and ignore write errors.
+// The output is copied from a pipe by exec.Cmd, an error would stop the copy and the process
+// would get SIGPIPE or block on a full pipe, e.g. when the disk is full.
+// The first error is kept, see DaemonCmd.LogErr
+type logWriter struct {
+	dcmd *DaemonCmd
+	lf   *logfile.File
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	if _, err := w.lf.Write(p); err != nil {
+		w.dcmd.setLogErr(err)
+	}
+	return len(p), nil
+}
+
+// lineWriter split the output of a process into lines and pass each line, without the newline, to emit.
+// A line longer than logLineMax is split. Not safe for concurrent use, exec.Cmd copies each pipe
+// in its own goroutine
+type lineWriter struct {
+	emit func(line []byte)
+	buf  []byte // 未结束的行
+}
+
+func newLineWriter(emit func(line []byte)) *lineWriter {
+	return &lineWriter{emit: emit}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.buf = append(w.buf, p...)
+		} else {
+			w.buf = append(w.buf, p[:i]...)
+		}
+		for len(w.buf) > logLineMax {
+			w.emit(w.buf[:logLineMax])
+			w.buf = w.buf[:copy(w.buf, w.buf[logLineMax:])]
+		}
+		if i < 0 {
+			break
+		}
+		w.emit(w.buf)
+		w.buf = w.buf[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Flush emit the unterminated line
+func (w *lineWriter) Flush() {
+	if len(w.buf) == 0 {
+		return
+	}
+	w.emit(w.buf)
+	w.buf = w.buf[:0]
+}
+
+// prefixer write lines to w prefixed with the time, the stream name and the cmd name.
+// Each line is written by a single Write, so lines of stdout and stderr sharing a file are not mixed
+type prefixer struct {
+	w      io.Writer
+	prefix string // " <stream> <name>: "
+	now    func() time.Time
+}
+
+func newPrefixer(w io.Writer, stream, name string) *prefixer {
+	return &prefixer{w: w, prefix: " " + stream + " " + name + ": ", now: time.Now}
+}
+
+func (p *prefixer) emit(line []byte) {
+	b := make([]byte, 0, len(logTimeFormat)+len(p.prefix)+len(line)+1)
+	b = p.now().AppendFormat(b, logTimeFormat)
+	b = append(b, p.prefix...)
+	b = append(b, line...)
+	p.w.Write(append(b, '\n'))
+}
+
+// runLog is the log files and the sink of a run and the writers of the stdout and stderr pipes
+type runLog struct {
+	files  []*logfile.File
+	sink   *logsink.Sink // 为nil表示不发送到syslog或journald
+	pid    atomic.Int64  // 进程启动后设置, 发送到sink
+	stdout io.Writer
+	stderr io.Writer
+	lines  []*lineWriter // 进程退出后写入未结束的行
+}
+
+func (rl *runLog) lineWriter(emit func(line []byte)) *lineWriter {
+	w := newLineWriter(emit)
+	rl.lines = append(rl.lines, w)
+	return w
+}
+
+// logFilePath return the log file of dcmd in dcmd.logDir,
+// stream is empty if stdout and stderr share the file
+func (dcmd *DaemonCmd) logFilePath(stream string) string {
+	base := fmt.Sprintf("%s_%s_%s", dcmd.Annotations[AnnotationsNameKey], dcmd.Annotations[AnnotationsPortKey], dcmd.CmdHash())
+	if stream != "" {
+		base += "." + stream
+	}
+	return filepath.Join(dcmd.logDir, base+".log")
+}
+
+// openLog return the writers of the output of the run. The lines are kept in dcmd.logs,
+// sent to the log sink if configured, pushed to Loki if the daemon has a Loki client, and written to the log files if dcmd.logDir is set
+// and the sink keeps the file. The process writes to them through pipes
+func (dcmd *DaemonCmd) openLog() (*runLog, error) {
+	dcmd.mu.Lock()
+	sinkConf, lokiClient := dcmd.logSink, dcmd.loki
+	dcmd.mu.Unlock()
+
+	rl := &runLog{}
+	// 内存中保留最近的行, 未配置日志目录时也保留
+	stdout := []io.Writer{rl.lineWriter(func(line []byte) { dcmd.logs.add(StreamStdout, line) })}
+	stderr := []io.Writer{rl.lineWriter(func(line []byte) { dcmd.logs.add(StreamStderr, line) })}
+	if sinkConf != nil {
+		sink, err := dcmd.openSink(sinkConf)
+		if err != nil {
+			return nil, err
+		}
+		rl.sink = sink
+		stdout = append(stdout, rl.lineWriter(rl.sinkEmit(StreamStdout)))
+		stderr = append(stderr, rl.lineWriter(rl.sinkEmit(StreamStderr)))
+	}
+	if lokiClient != nil {
+		stdout = append(stdout, rl.lineWriter(dcmd.lokiEmit(lokiClient, StreamStdout)))
+		stderr = append(stderr, rl.lineWriter(dcmd.lokiEmit(lokiClient, StreamStderr)))
+	}
+	if dcmd.logDir != "" && (sinkConf == nil || sinkConf.File == nil || *sinkConf.File) {
+		fout, ferr, err := dcmd.openLogFiles(rl)
+		if err != nil {
+			rl.close()
+			return nil, err
+		}
+		stdout, stderr = append(stdout, fout), append(stderr, ferr)
+	}
+	rl.stdout, rl.stderr = io.MultiWriter(stdout...), io.MultiWriter(stderr...)
+
+	dcmd.mu.Lock()
+	dcmd.logFiles, dcmd.logErr = rl.files, nil
+	dcmd.mu.Unlock()
+	return rl, nil
+}
+
+// openLogFiles open the log files of the run in dcmd.logDir and return the writers of stdout and stderr
+func (dcmd *DaemonCmd) openLogFiles(rl *runLog) (stdout, stderr io.Writer, err error) {
+	// 确保日志目录存在
+	if err := os.MkdirAll(dcmd.logDir, 0755); err != nil {
+		return nil, nil, fmt.Errorf("create log dir %s err: %v", dcmd.logDir, err)
+	}
+	dcmd.mu.Lock()
+	opts, split, prefix := dcmd.logOpts, dcmd.logSplit, dcmd.logPrefix
+	dcmd.mu.Unlock()
+
+	open := func(stream string) (io.Writer, error) {
+		path := dcmd.logFilePath(stream)
+		// 以追加模式打开日志文件，如果不存在则创建
+		lf, err := logfile.Open(path, opts)
+		if err != nil {
+			return nil, fmt.Errorf("open log file %s err: %v", path, err)
+		}
+		rl.files = append(rl.files, lf)
+		return logWriter{dcmd: dcmd, lf: lf}, nil
+	}
+	if split {
+		if stdout, err = open(StreamStdout); err == nil {
+			stderr, err = open(StreamStderr)
+		}
+	} else if stdout, err = open(""); err == nil {
+		stderr = stdout
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if prefix {
+		name := dcmd.Annotations[AnnotationsNameKey]
+		stdout = rl.lineWriter(newPrefixer(stdout, StreamStdout, name).emit)
+		stderr = rl.lineWriter(newPrefixer(stderr, StreamStderr, name).emit)
+	}
+	return stdout, stderr, nil
+}
+
+// openSink create the sink of the run, the structured fields are the name, app, port and hostname annotations
+func (dcmd *DaemonCmd) openSink(c *config.LogSinkConf) (*logsink.Sink, error) {
+	facility, err := logsink.ParseFacility(c.Facility)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string)
+	for _, k := range []string{AnnotationsNameKey, AnnotationsAppKey, AnnotationsPortKey, AnnotationsHostnameKey} {
+		if v := dcmd.Annotations[k]; v != "" {
+			fields[k] = v
+		}
+	}
+	tag := c.Tag
+	if tag == "" {
+		tag = dcmd.Annotations[AnnotationsNameKey]
+	}
+	hostname := dcmd.Annotations[AnnotationsHostnameKey]
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	return logsink.New(c.Type, c.Address, logsink.Options{
+		Tag:      tag,
+		Hostname: hostname,
+		Facility: facility,
+		Fields:   fields,
+		OnError:  dcmd.setLogErr,
+	})
+}
+
+// sinkEmit return an emit func sending the lines of stream to rl.sink
+func (rl *runLog) sinkEmit(stream string) func(line []byte) {
+	return func(line []byte) {
+		rl.sink.Send(logsink.Entry{Time: time.Now(), Stream: stream, Pid: int(rl.pid.Load()), Line: string(line)})
+	}
+}
+
+// lokiEmit return an emit func pushing the lines of stream to Loki, the labels are
+// the name, app, hostname and ip annotations and the stream
+func (dcmd *DaemonCmd) lokiEmit(c *loki.Client, stream string) func(line []byte) {
+	labels := loki.Labels{"stream": stream}
+	for _, k := range []string{AnnotationsNameKey, AnnotationsAppKey, AnnotationsHostnameKey, AnnotationsIPKey} {
+		if v := dcmd.Annotations[k]; v != "" {
+			labels[k] = v
+		}
+	}
+	if labels[AnnotationsHostnameKey] == "" {
+		labels[AnnotationsHostnameKey], _ = os.Hostname()
+	}
+	return func(line []byte) {
+		c.Push(labels, time.Now(), string(line))
+	}
+}
+
+// close flush the unterminated lines, close the sink and the files after the process exited
+func (rl *runLog) close() {
+	for _, w := range rl.lines {
+		w.Flush()
+	}
+	if rl.sink != nil {
+		rl.sink.Close()
+	}
+	for _, lf := range rl.files {
+		lf.Close()
+	}
+}
+
+// closeLog close the log files of the run after the process exited
+func (dcmd *DaemonCmd) closeLog(rl *runLog) {
+	dcmd.mu.Lock()
+	if len(dcmd.logFiles) > 0 && len(rl.files) > 0 && dcmd.logFiles[0] == rl.files[0] {
+		dcmd.logFiles = nil
+	}
+	dcmd.mu.Unlock()
+	rl.close()
+}
+
+func (dcmd *DaemonCmd) setLogErr(err error) {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	if dcmd.logErr == nil {
+		dcmd.logErr = err
+	}
+}
+
+// LogErr return the first error writing the log file or sending to the log sink of the current run,
+// the output is dropped until the file is writable or the collector is reachable again
+func (dcmd *DaemonCmd) LogErr() error {
+	dcmd.mu.Lock()
+	defer dcmd.mu.Unlock()
+	return dcmd.logErr
+}
+
+// ReopenLog close and reopen the log files without restarting the process,
+// e.g. after they are moved by logrotate. Return ErrNoLogFile if the process has no open log file
+func (dcmd *DaemonCmd) ReopenLog() error {
+	dcmd.mu.Lock()
+	files := dcmd.logFiles
+	dcmd.logErr = nil
+	dcmd.mu.Unlock()
+	if len(files) == 0 {
+		return fmt.Errorf("%w: %s", ErrNoLogFile, dcmd.String())
+	}
+	var errs []error
+	for _, lf := range files {
+		errs = append(errs, lf.Reopen())
+	}
+	return errors.Join(errs...)
+}
+
+// RotateLog rotate the log files now without restarting the process, see logfile.File.Rotate.
+// Return ErrNoLogFile if the process has no open log file
+func (dcmd *DaemonCmd) RotateLog() error {
+	dcmd.mu.Lock()
+	files := dcmd.logFiles
+	dcmd.mu.Unlock()
+	if len(files) == 0 {
+		return fmt.Errorf("%w: %s", ErrNoLogFile, dcmd.String())
+	}
+	var errs []error
+	for _, lf := range files {
+		errs = append(errs, lf.Rotate())
+	}
+	return errors.Join(errs...)
+}
+
+// ReopenLogs reopen the log files of all running dcmds, see DaemonCmd.ReopenLog
+func (d *Daemon) ReopenLogs() error {
+	var errs []error
+	for _, dcmd := range d.GetDCmds() {
+		if err := dcmd.ReopenLog(); err != nil && !errors.Is(err, ErrNoLogFile) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
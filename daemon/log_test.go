@@ -0,0 +1,319 @@
+package daemon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sq325/cmdDaemon/config"
+	"github.com/sq325/cmdDaemon/internal/logfile"
+	"github.com/sq325/cmdDaemon/internal/loki"
+)
+
+func TestDaemonCmd_logRotation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	compress := false
+	dcmd := NewDaemonCmd(ctx, exec.Command("sh", "-c", "while true; do echo 0123456789; sleep 0.01; done"),
+		map[string]string{AnnotationsNameKey: "writer"},
+		WithCmdConf(config.CmdConf{Log: config.LogConf{MaxSize: 50, MaxBackups: 2, Compress: &compress}}))
+	d := NewDaemon(ctx, []*DaemonCmd{dcmd}, slog.Default())
+	logDir := t.TempDir()
+	WithCmdLogDir(logDir)(d)
+	go d.Run()
+	defer d.Stop(context.Background())
+	waitState(t, dcmd, Running)
+	pid := dcmd.Cmd.Process.Pid
+	path := dcmd.logFilePath("")
+
+	// 按大小轮转, 只保留2个轮转文件
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		backups, _ := filepath.Glob(path + ".*")
+		if len(backups) == 2 {
+			time.Sleep(100 * time.Millisecond) // 继续轮转, 旧文件被清理
+			if backups, _ = filepath.Glob(path + ".*"); len(backups) <= 3 {
+				break
+			}
+			t.Fatalf("backups = %v, want at most 2", backups)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("log file not rotated, backups = %v", backups)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() > 50 {
+		t.Errorf("log file size = %v, err %v", info, err)
+	}
+
+	// logrotate移动文件后重新打开, 不重启子进程
+	moved := filepath.Join(t.TempDir(), "writer.log")
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ReopenLogs(); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("log file not reopened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := dcmd.RotateLog(); err != nil {
+		t.Fatal(err)
+	}
+	if dcmd.State() != Running || dcmd.Cmd.Process.Pid != pid {
+		t.Errorf("cmd restarted, state %s", dcmd.State())
+	}
+
+	if err := dcmd.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := dcmd.ReopenLog(); !errors.Is(err, ErrNoLogFile) {
+		t.Errorf("ReopenLog() of stopped cmd error = %v, want ErrNoLogFile", err)
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	dcmd := NewDaemonCmd(context.Background(), exec.Command("true"), map[string]string{})
+	lf, err := logfile.Open(filepath.Join(t.TempDir(), "a.log"), logfile.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.Close()
+	// 写入失败不返回错误, 否则子进程的输出管道被关闭
+	w := logWriter{dcmd: dcmd, lf: lf}
+	if n, err := w.Write([]byte("lost\n")); n != 5 || err != nil {
+		t.Errorf("Write() = %d, %v", n, err)
+	}
+	if err := dcmd.LogErr(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("LogErr() = %v", err)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var buf bytes.Buffer
+	p := newPrefixer(&buf, StreamStderr, "prometheus")
+	p.now = func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 6e6, time.UTC) }
+	w := newLineWriter(p.emit)
+	w.Write([]byte("a\nb"))
+	w.Write([]byte("c\n\nd"))
+	if got, want := buf.String(), "2026-01-02T03:04:05.006Z stderr prometheus: a\n"+
+		"2026-01-02T03:04:05.006Z stderr prometheus: bc\n"+
+		"2026-01-02T03:04:05.006Z stderr prometheus: \n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	buf.Reset()
+	w.Flush()
+	if got := buf.String(); got != "2026-01-02T03:04:05.006Z stderr prometheus: d\n" {
+		t.Errorf("Flush() output = %q", got)
+	}
+
+	var lines []string
+	w = newLineWriter(func(line []byte) { lines = append(lines, string(line)) })
+	w.Write(bytes.Repeat([]byte("x"), logLineMax+1))
+	w.Flush()
+	if len(lines) != 2 || len(lines[0]) != logLineMax || lines[1] != "x" {
+		t.Errorf("long line split into %d lines", len(lines))
+	}
+}
+
+func TestDaemonCmd_logSplitAndPrefix(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	split, prefix := true, true
+	dcmd := NewDaemonCmd(ctx, exec.Command("sh", "-c", "echo out; printf err >&2"),
+		map[string]string{AnnotationsNameKey: "echo"},
+		WithCmdConf(config.CmdConf{Restart: config.RestartNever, Log: config.LogConf{Split: &split, Prefix: &prefix}}))
+	d := NewDaemon(ctx, []*DaemonCmd{dcmd}, slog.Default())
+	WithCmdLogDir(t.TempDir())(d)
+	go d.Run()
+	defer d.Stop(context.Background())
+	waitState(t, dcmd, Exited)
+
+	for stream, want := range map[string]string{StreamStdout: " stdout echo: out\n", StreamStderr: " stderr echo: err\n"} {
+		b, err := os.ReadFile(dcmd.logFilePath(stream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, line, _ := strings.Cut(string(b), " ")
+		if _, err := time.Parse(time.RFC3339, ts); err != nil || " "+line != want {
+			t.Errorf("%s log file = %q, want %q", stream, b, want)
+		}
+	}
+	if _, err := os.Stat(dcmd.logFilePath("")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("shared log file created, err %v", err)
+	}
+	// 内存中的行和stderr的tail不加前缀
+	if lines := dcmd.Logs(StreamStdout, -1); len(lines) != 1 || lines[0].Line != "out" {
+		t.Errorf("Logs() = %+v", lines)
+	}
+	if runs := dcmd.History(); len(runs) != 1 || len(runs[0].Stderr) != 1 || runs[0].Stderr[0] != "err" {
+		t.Errorf("History() = %+v", runs)
+	}
+}
+
+func TestLogBuffer(t *testing.T) {
+	b := newLogBuffer(3)
+	for _, s := range []string{"a", "b", "c", "d"} {
+		stream := StreamStdout
+		if s == "c" {
+			stream = StreamStderr
+		}
+		b.add(stream, []byte(s))
+	}
+	text := func(lines []LogLine) string {
+		var s string
+		for _, l := range lines {
+			s += l.Line
+		}
+		return s
+	}
+	if got := text(b.tail("", -1)); got != "bcd" {
+		t.Errorf("tail(all) = %q, want bcd", got)
+	}
+	if got := text(b.tail(StreamStdout, 1)); got != "d" {
+		t.Errorf("tail(stdout, 1) = %q, want d", got)
+	}
+	if got := b.tail("", 0); len(got) != 0 {
+		t.Errorf("tail(0) = %+v", got)
+	}
+
+	lines, ch, cancel := b.subscribe(StreamStderr, 5)
+	defer cancel()
+	if text(lines) != "c" {
+		t.Errorf("subscribe() lines = %+v", lines)
+	}
+	b.add(StreamStdout, []byte("e"))
+	b.add(StreamStderr, []byte("f"))
+	if l := <-ch; l.Line != "f" || l.Seq != 6 {
+		t.Errorf("subscribed line = %+v", l)
+	}
+	// 落后过多的订阅者被关闭
+	for range logSubBuffer + 1 {
+		b.add(StreamStderr, []byte("x"))
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != logSubBuffer {
+		t.Errorf("received %d lines before close, want %d", n, logSubBuffer)
+	}
+}
+
+func TestDaemonCmd_logSink(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keepFile := false
+	dcmd := NewDaemonCmd(ctx, exec.Command("sh", "-c", "echo hello"),
+		map[string]string{AnnotationsNameKey: "echo", AnnotationsAppKey: "web", AnnotationsPortKey: "8080", AnnotationsHostnameKey: "proxy-a"},
+		WithCmdConf(config.CmdConf{Restart: config.RestartNever, LogSink: &config.LogSinkConf{
+			Type: "syslog", Address: "udp://" + pc.LocalAddr().String(), Facility: "local0", File: &keepFile,
+		}}))
+	d := NewDaemon(ctx, []*DaemonCmd{dcmd}, slog.Default())
+	WithCmdLogDir(t.TempDir())(d)
+	go d.Run()
+	defer d.Stop(context.Background())
+
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<134>1 ") || !strings.Contains(msg, " proxy-a echo ") ||
+		!strings.HasSuffix(msg, `[cmd@32473 app="web" hostname="proxy-a" name="echo" port="8080" stream="stdout"] hello`) {
+		t.Errorf("syslog message = %q", msg)
+	}
+	waitState(t, dcmd, Exited)
+	if _, err := os.Stat(dcmd.logFilePath("")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("log file written with file: false, err %v", err)
+	}
+}
+
+func TestDaemon_loki(t *testing.T) {
+	type push struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	pushes := make(chan push, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p push
+		zr, err := gzip.NewReader(r.Body)
+		if err == nil {
+			err = json.NewDecoder(zr).Decode(&p)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pushes <- p
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	client, err := loki.New(loki.Config{URL: srv.URL + "/loki/api/v1/push", BatchWait: 10 * time.Millisecond}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dcmd := NewDaemonCmd(ctx, exec.Command("sh", "-c", "echo hello; echo oops >&2"),
+		map[string]string{AnnotationsNameKey: "echo", AnnotationsAppKey: "web", AnnotationsIPKey: "10.0.0.1", AnnotationsHostnameKey: "proxy-a"},
+		WithCmdConf(config.CmdConf{Restart: config.RestartNever}))
+	d := NewDaemon(ctx, []*DaemonCmd{dcmd}, slog.Default())
+	WithCmdLogDir("")(d)
+	WithLoki(client)(d)
+	go d.Run()
+	defer d.Stop(context.Background())
+
+	got := make(map[string]string) // stream -> line
+	timeout := time.After(3 * time.Second)
+	for len(got) < 2 {
+		select {
+		case p := <-pushes:
+			for _, s := range p.Streams {
+				want := map[string]string{"name": "echo", "app": "web", "ip": "10.0.0.1", "hostname": "proxy-a", "stream": s.Stream["stream"]}
+				if !maps.Equal(s.Stream, want) {
+					t.Errorf("labels = %v, want %v", s.Stream, want)
+				}
+				for _, v := range s.Values {
+					got[s.Stream["stream"]] += v[1]
+				}
+			}
+		case <-timeout:
+			t.Fatalf("pushed %v, want stdout and stderr", got)
+		}
+	}
+	if got[StreamStdout] != "hello" || got[StreamStderr] != "oops" {
+		t.Errorf("pushed %v", got)
+	}
+}
@@ -0,0 +1,130 @@
+package daemon
+
+import (
+	"sync"
+	"time"
+)
+
+// Default limits of the in-memory log buffer of a dcmd
+const (
+	DefaultLogBuffer = 1000 // 每个cmd在内存中保留的最近日志行数
+	logBufferLineMax = 4096 // 内存中单行最大长度, 超过部分丢弃
+	logSubBuffer     = 1024 // 订阅者的缓冲, 落后超过此数量的订阅者被关闭
+)
+
+// LogLine is a line of the output of a dcmd
+type LogLine struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"` // stdout or stderr
+	Line   string    `json:"line"`
+}
+
+// logBuffer keep the latest lines of the output of a dcmd across restarts and send new lines
+// to subscribers. 并发安全
+type logBuffer struct {
+	mu    sync.Mutex
+	lines []LogLine // 环形缓冲区
+	next  int
+	full  bool
+	seq   uint64
+	subs  map[*logSub]struct{}
+}
+
+type logSub struct {
+	stream string // 为空表示所有流
+	ch     chan LogLine
+}
+
+func newLogBuffer(size int) *logBuffer {
+	if size <= 0 {
+		size = DefaultLogBuffer
+	}
+	return &logBuffer{lines: make([]LogLine, size), subs: make(map[*logSub]struct{})}
+}
+
+// add append a line of stream and send it to the matching subscribers.
+// A subscriber falling behind by logSubBuffer lines is unsubscribed, its channel is closed
+func (b *logBuffer) add(stream string, line []byte) {
+	if len(line) > logBufferLineMax {
+		line = line[:logBufferLineMax]
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	l := LogLine{Seq: b.seq, Time: time.Now(), Stream: stream, Line: string(line)}
+	b.lines[b.next] = l
+	b.next = (b.next + 1) % len(b.lines)
+	if b.next == 0 {
+		b.full = true
+	}
+	for sub := range b.subs {
+		if sub.stream != "" && sub.stream != stream {
+			continue
+		}
+		select {
+		case sub.ch <- l:
+		default:
+			delete(b.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// tail return the latest n lines of stream, all streams if stream is empty, oldest first.
+// All kept lines are returned if n < 0
+func (b *logBuffer) tail(stream string, n int) []LogLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tailLocked(stream, n)
+}
+
+func (b *logBuffer) tailLocked(stream string, n int) []LogLine {
+	lines := []LogLine{}
+	appendStream := func(src []LogLine) {
+		for _, l := range src {
+			if stream == "" || l.Stream == stream {
+				lines = append(lines, l)
+			}
+		}
+	}
+	if b.full {
+		appendStream(b.lines[b.next:])
+	}
+	appendStream(b.lines[:b.next])
+	if n >= 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// subscribe return the latest n lines of stream, see tail, and a channel receiving the lines
+// added later, without gaps or duplicates. The channel is closed by cancel, or when the subscriber
+// falls behind, see add
+func (b *logBuffer) subscribe(stream string, n int) (lines []LogLine, ch <-chan LogLine, cancel func()) {
+	sub := &logSub{stream: stream, ch: make(chan LogLine, logSubBuffer)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines = b.tailLocked(stream, n)
+	b.subs[sub] = struct{}{}
+	return lines, sub.ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[sub]; ok {
+			delete(b.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// Logs return the latest n lines of the output of dcmd in stream, all streams if stream is empty,
+// oldest first, all kept lines if n < 0. Lines of previous runs are kept until replaced by newer ones
+func (dcmd *DaemonCmd) Logs(stream string, n int) []LogLine {
+	return dcmd.logs.tail(stream, n)
+}
+
+// SubscribeLogs return the latest n lines of stream, see Logs, and a channel receiving the following lines.
+// The channel is closed by cancel, or when the subscriber falls behind by more than 1024 lines
+func (dcmd *DaemonCmd) SubscribeLogs(stream string, n int) ([]LogLine, <-chan LogLine, func()) {
+	return dcmd.logs.subscribe(stream, n)
+}
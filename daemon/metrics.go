@@ -1,23 +1,47 @@
 package daemon
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"strings"
 
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var dcmdLabels = []string{"name", "port", "hostname", "ip", "app"}
+
+// 以下指标在Collect时根据当前的dcmds生成, 删除的cmd不再导出
 var (
-	// 1 = running, 0 = stopped
-	dcmdStatus = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "daemon_cmd_status",
-			Help: "Status of daemon cmd",
-		},
-		[]string{"name", "port", "hostname", "ip", "app"},
+	// 1 = current state, 0 = other states
+	dcmdStatus = prometheus.NewDesc(
+		"daemon_cmd_status",
+		"Status of daemon cmd, 1 for the current state (stopped, starting, running, backoff, stopping, exited or fatal)",
+		append(dcmdLabels, "state"), nil,
+	)
+
+	// 1 = current limiter state, 0 = other states
+	dcmdLimiterState = prometheus.NewDesc(
+		"daemon_cmd_limiter_state",
+		"Restart limiter state of daemon cmd, 1 for the current state (ok, cooldown or exhausted)",
+		append(dcmdLabels, "state"), nil,
+	)
+
+	dcmdLimiterRestarts = prometheus.NewDesc(
+		"daemon_cmd_limiter_restarts",
+		"Number of restarts of daemon cmd within the limiter's sliding window",
+		dcmdLabels, nil,
+	)
+
+	// 1 = current health status, 0 = other statuses
+	dcmdHealth = prometheus.NewDesc(
+		"daemon_cmd_health",
+		"Health check status of daemon cmd, 1 for the current status (unknown, starting, healthy or unhealthy)",
+		append(dcmdLabels, "status"), nil,
 	)
 
-	dcmdRestartCount = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "daemon_cmd_restart_total",
-			Help: "Total number of restarts for each daemon cmd",
-		},
-		[]string{"name", "port", "hostname", "ip", "app"},
+	// 重载时被替换的cmd从0重新计数
+	dcmdRestartCount = prometheus.NewDesc(
+		"daemon_cmd_restart_total",
+		"Total number of restarts for each daemon cmd",
+		dcmdLabels, nil,
 	)
 )
 
@@ -28,20 +52,60 @@ type daemonCollector struct {
 var _ prometheus.Collector = (*daemonCollector)(nil)
 
 func (collector *daemonCollector) Describe(ch chan<- *prometheus.Desc) {
-	dcmdStatus.Describe(ch)
-	dcmdRestartCount.Describe(ch)
+	ch <- dcmdStatus
+	ch <- dcmdRestartCount
+	ch <- dcmdLimiterState
+	ch <- dcmdLimiterRestarts
+	ch <- dcmdHealth
 }
 
 func (collector *daemonCollector) Collect(ch chan<- prometheus.Metric) {
-	for _, dcmd := range collector.d.DCmds {
-		dcmdStatus.WithLabelValues(
+	seen := make(map[string]bool)
+	for _, dcmd := range collector.d.GetDCmds() {
+		labels := []string{
 			dcmd.Annotations[AnnotationsNameKey],
 			dcmd.Annotations[AnnotationsPortKey],
 			dcmd.Annotations[AnnotationsHostnameKey],
 			dcmd.Annotations[AnnotationsIPKey],
 			dcmd.Annotations[AnnotationsAppKey],
-		).Set(float64(dcmd.Status))
+		}
+		// 标签相同的cmd只导出第一个, 重复的序列会导致采集失败
+		key := strings.Join(labels, "\xff")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		gauge := func(desc *prometheus.Desc, v float64, extra ...string) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, append(labels, extra...)...)
+		}
+
+		current := dcmd.State()
+		for _, state := range States {
+			var v float64
+			if current == state {
+				v = 1
+			}
+			gauge(dcmdStatus, v, state.String())
+		}
+		ch <- prometheus.MustNewConstMetric(dcmdRestartCount, prometheus.CounterValue, float64(dcmd.autoRestartCount()), labels...)
+
+		limiter := dcmd.Limiter.Status()
+		for _, state := range []LimiterState{LimiterOK, LimiterCooldown, LimiterExhausted} {
+			var v float64
+			if limiter.State == state {
+				v = 1
+			}
+			gauge(dcmdLimiterState, v, string(state))
+		}
+		gauge(dcmdLimiterRestarts, float64(limiter.Restarts))
+
+		health, _ := dcmd.Health()
+		for _, status := range HealthStatuses {
+			var v float64
+			if health == status {
+				v = 1
+			}
+			gauge(dcmdHealth, v, string(status))
+		}
 	}
-	dcmdStatus.Collect(ch)
-	dcmdRestartCount.Collect(ch)
 }
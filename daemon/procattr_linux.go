@@ -0,0 +1,11 @@
+package daemon
+
+import "syscall"
+
+// setProcAttr 子进程使用独立的进程组, 便于向整个进程树发送信号.
+// 守护进程异常退出时内核向子进程发送SIGTERM, 避免子进程成为孤儿进程
+func setProcAttr(attr *syscall.SysProcAttr) {
+	attr.Setpgid = true
+	attr.Pgid = 0
+	attr.Pdeathsig = syscall.SIGTERM
+}
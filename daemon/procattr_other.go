@@ -0,0 +1,11 @@
+//go:build !linux
+
+package daemon
+
+import "syscall"
+
+// setProcAttr 子进程使用独立的进程组, 便于向整个进程树发送信号
+func setProcAttr(attr *syscall.SysProcAttr) {
+	attr.Setpgid = true
+	attr.Pgid = 0
+}
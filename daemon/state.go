@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"fmt"
+	"slices"
+)
+
+// State is the lifecycle state of a DaemonCmd
+type State int
+
+const (
+	Stopped  State = iota // 未启动或被手动停止, supervisor不会重启
+	Starting              // 正在启动
+	Running               // 运行中
+	Backoff               // 已退出, 等待重启
+	Stopping              // 正在停止
+	Exited                // 已退出, 根据重启策略不再重启
+	Fatal                 // 超过重启限制, 不再重启
+)
+
+// States is all states of DaemonCmd in order
+var States = []State{Stopped, Starting, Running, Backoff, Stopping, Exited, Fatal}
+
+var stateNames = map[State]string{
+	Stopped:  "stopped",
+	Starting: "starting",
+	Running:  "running",
+	Backoff:  "backoff",
+	Stopping: "stopping",
+	Exited:   "exited",
+	Fatal:    "fatal",
+}
+
+// transitions 每个状态允许转换到的状态
+var transitions = map[State][]State{
+	Stopped:  {Starting},
+	Starting: {Running, Exited, Stopping, Stopped},
+	Running:  {Exited, Stopping},
+	Backoff:  {Starting, Fatal, Stopping, Stopped},
+	Stopping: {Stopped},
+	Exited:   {Backoff, Fatal, Starting, Stopped},
+	Fatal:    {Starting, Stopped},
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *State) UnmarshalText(b []byte) error {
+	for state, name := range stateNames {
+		if name == string(b) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown state %q", b)
+}
+
+// canTransitTo report whether s can transit to to
+func (s State) canTransitTo(to State) bool {
+	return slices.Contains(transitions[s], to)
+}
@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestDaemonCmd_setState(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    []State // transitions from Stopped
+		wantErr bool
+	}{
+		{
+			name: "start and crash then restart",
+			path: []State{Starting, Running, Exited, Backoff, Starting, Running},
+		},
+		{
+			name: "limit reached",
+			path: []State{Starting, Running, Exited, Backoff, Fatal},
+		},
+		{
+			name: "manual stop",
+			path: []State{Starting, Running, Stopping, Stopped},
+		},
+		{
+			name:    "running from stopped",
+			path:    []State{Running},
+			wantErr: true,
+		},
+		{
+			name:    "backoff from stopping",
+			path:    []State{Starting, Running, Stopping, Backoff},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dcmd := NewDaemonCmd(context.Background(), exec.Command("true"), nil)
+			var err error
+			for _, state := range tt.path {
+				since := dcmd.StateSince()
+				if err = dcmd.setState(state); err != nil {
+					break
+				}
+				if dcmd.State() != state {
+					t.Fatalf("State() = %s, want %s", dcmd.State(), state)
+				}
+				if dcmd.StateSince().Before(since) {
+					t.Errorf("StateSince() not updated after transition to %s", state)
+				}
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidTransition) {
+					t.Errorf("setState() error = %v, want ErrInvalidTransition", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("setState() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestState_MarshalText(t *testing.T) {
+	for _, state := range States {
+		b, err := state.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != stateNames[state] {
+			t.Errorf("MarshalText() = %s, want %s", b, stateNames[state])
+		}
+		var got State
+		if err := got.UnmarshalText(b); err != nil || got != state {
+			t.Errorf("UnmarshalText(%s) = %v, %v, want %v", b, got, err, state)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Package logfile implement a log file rotated by size and time,
+// with a retention count of rotated files and optional gzip compression
+package logfile
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat 轮转文件名中的时间格式, 按字典序排序即按时间排序
+const backupTimeFormat = "20060102T150405.000"
+
+// Options of a File, zero values disable the corresponding feature
+type Options struct {
+	MaxSize     int64         // 文件超过MaxSize字节后轮转, 0表示不按大小轮转
+	RotateEvery time.Duration // 打开或轮转后每隔RotateEvery轮转, 0表示不按时间轮转
+	MaxBackups  int           // 保留的轮转文件数, 0表示全部保留
+	Compress    bool          // 使用gzip压缩轮转后的文件
+}
+
+// File is an io.WriteCloser appending to a log file.
+// Before a write makes the file exceed MaxSize or after RotateEvery, the file is renamed to
+// <path>.<time> and a new file is created. Rotated files are compressed and pruned in the background.
+// 并发安全
+type File struct {
+	mu       sync.Mutex
+	path     string
+	opts     Options
+	f        *os.File // 打开失败时为nil, 下次写入时重试
+	closed   bool
+	size     int64
+	rotateAt time.Time // 下次按时间轮转的时间, zero表示不按时间轮转
+
+	millMu sync.Mutex     // 串行化压缩和清理
+	millWg sync.WaitGroup // Close等待后台压缩和清理结束
+	now    func() time.Time
+}
+
+// Open open path for appending, creating it if not exists
+func Open(path string, opts Options) (*File, error) {
+	lf := &File{path: path, opts: opts, now: time.Now}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+// open open lf.path, lf.mu must be held or lf not shared yet
+func (lf *File) open() error {
+	f, err := os.OpenFile(lf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.f, lf.size = f, info.Size()
+	lf.rotateAt = time.Time{}
+	if lf.opts.RotateEvery > 0 {
+		lf.rotateAt = lf.now().Add(lf.opts.RotateEvery)
+	}
+	return nil
+}
+
+// Write append p to the file, rotating it first if needed
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.closed {
+		return 0, os.ErrClosed
+	}
+	if lf.f == nil {
+		if err := lf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if lf.shouldRotate(int64(len(p))) {
+		if err := lf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+func (lf *File) shouldRotate(n int64) bool {
+	if lf.size == 0 {
+		return false
+	}
+	if lf.opts.MaxSize > 0 && lf.size+n > lf.opts.MaxSize {
+		return true
+	}
+	return !lf.rotateAt.IsZero() && !lf.now().Before(lf.rotateAt)
+}
+
+// Rotate rename the file to <path>.<time> and create a new one, an empty file is not rotated
+func (lf *File) Rotate() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.closed {
+		return os.ErrClosed
+	}
+	if lf.f == nil || lf.size == 0 {
+		return nil
+	}
+	return lf.rotate()
+}
+
+// rotate lf.mu must be held
+func (lf *File) rotate() error {
+	if err := lf.f.Close(); err != nil {
+		return err
+	}
+	lf.f = nil
+	backup := lf.backupName()
+	if err := os.Rename(lf.path, backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+		// 无法轮转时继续写原文件, 避免丢失日志
+		if oerr := lf.open(); oerr != nil {
+			return errors.Join(err, oerr)
+		}
+		return fmt.Errorf("rotate %s: %w", lf.path, err)
+	}
+	if err := lf.open(); err != nil {
+		return err
+	}
+	lf.millWg.Add(1)
+	go func() {
+		defer lf.millWg.Done()
+		lf.mill()
+	}()
+	return nil
+}
+
+// backupName return <path>.<time> not used by an existing rotated file
+func (lf *File) backupName() string {
+	t := lf.now()
+	for {
+		backup := lf.path + "." + t.Format(backupTimeFormat)
+		_, err := os.Stat(backup)
+		_, gzErr := os.Stat(backup + ".gz")
+		if errors.Is(err, os.ErrNotExist) && errors.Is(gzErr, os.ErrNotExist) {
+			return backup
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+// Reopen close and reopen the file, e.g. after it is moved by an external tool like logrotate
+func (lf *File) Reopen() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.closed {
+		return os.ErrClosed
+	}
+	if lf.f != nil {
+		if err := lf.f.Close(); err != nil {
+			return err
+		}
+		lf.f = nil
+	}
+	return lf.open()
+}
+
+// Close close the file and wait for the background compression and pruning
+func (lf *File) Close() error {
+	lf.mu.Lock()
+	var err error
+	lf.closed = true
+	if lf.f != nil {
+		err = lf.f.Close()
+		lf.f = nil
+	}
+	lf.mu.Unlock()
+	lf.millWg.Wait()
+	return err
+}
+
+// mill compress the rotated files if Compress and remove the oldest ones beyond MaxBackups
+func (lf *File) mill() {
+	lf.millMu.Lock()
+	defer lf.millMu.Unlock()
+
+	backups := lf.backups()
+	if lf.opts.MaxBackups > 0 && len(backups) > lf.opts.MaxBackups {
+		for _, backup := range backups[:len(backups)-lf.opts.MaxBackups] {
+			os.Remove(backup)
+		}
+		backups = backups[len(backups)-lf.opts.MaxBackups:]
+	}
+	if !lf.opts.Compress {
+		return
+	}
+	for _, backup := range backups {
+		if !strings.HasSuffix(backup, ".gz") {
+			compress(backup)
+		}
+	}
+}
+
+// backups return the rotated files of lf, oldest first
+func (lf *File) backups() []string {
+	matches, _ := filepath.Glob(escapeGlob(lf.path) + ".*")
+	backups := make([]string, 0, len(matches))
+	prefix := lf.path + "."
+	for _, m := range matches {
+		ts := strings.TrimSuffix(strings.TrimPrefix(m, prefix), ".gz")
+		if _, err := time.Parse(backupTimeFormat, ts); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	slices.SortFunc(backups, func(a, b string) int {
+		return strings.Compare(strings.TrimSuffix(a, ".gz"), strings.TrimSuffix(b, ".gz"))
+	})
+	return backups
+}
+
+// compress gzip file to file.gz and remove file
+func compress(file string) error {
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(file+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(file + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(file + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(file + ".gz")
+		return err
+	}
+	return os.Remove(file)
+}
+
+// escapeGlob escape the glob meta characters in path
+func escapeGlob(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		switch r {
+		case '*', '?', '[', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
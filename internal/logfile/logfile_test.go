@@ -0,0 +1,126 @@
+package logfile
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFile_rotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a_[1]_x.log") // 文件名包含glob元字符
+	lf, err := Open(path, Options{MaxSize: 10, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+		if _, err := lf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lf.Write([]byte("x")); err == nil {
+		t.Error("Write() after Close() error = nil")
+	}
+
+	if b, _ := os.ReadFile(path); string(b) != "line4\n" {
+		t.Errorf("current file = %q, want line4", b)
+	}
+	backups := lf.backups()
+	if len(backups) != 2 {
+		t.Fatalf("backups = %v, want 2", backups)
+	}
+	for i, want := range []string{"line2\n", "line3\n"} {
+		if !strings.HasSuffix(backups[i], ".gz") {
+			t.Fatalf("backup %s not compressed", backups[i])
+		}
+		f, _ := os.Open(backups[i])
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(zr)
+		f.Close()
+		if string(b) != want {
+			t.Errorf("backup %s = %q, want %q", backups[i], b, want)
+		}
+	}
+}
+
+func TestFile_rotateEvery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.log")
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local)
+	lf := &File{path: path, opts: Options{RotateEvery: time.Hour}, now: func() time.Time { return now }}
+	if err := lf.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+
+	lf.Write([]byte("a\n"))
+	now = now.Add(59 * time.Minute)
+	lf.Write([]byte("b\n"))
+	now = now.Add(time.Minute)
+	lf.Write([]byte("c\n"))
+	lf.millWg.Wait()
+
+	backups := lf.backups()
+	if len(backups) != 1 || !strings.HasSuffix(backups[0], ".20260101T010000.000") {
+		t.Fatalf("backups = %v", backups)
+	}
+	if b, _ := os.ReadFile(backups[0]); string(b) != "a\nb\n" {
+		t.Errorf("backup = %q", b)
+	}
+	// 轮转后重新计时
+	now = now.Add(30 * time.Minute)
+	lf.Write([]byte("d\n"))
+	if b, _ := os.ReadFile(path); string(b) != "c\nd\n" {
+		t.Errorf("current file = %q", b)
+	}
+}
+
+func TestFile_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.log")
+	lf, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	lf.Write([]byte("before\n"))
+
+	// 模拟logrotate移动文件
+	moved := filepath.Join(dir, "a.log.1")
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal(err)
+	}
+	lf.Write([]byte("moved\n"))
+	if err := lf.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	lf.Write([]byte("after\n"))
+
+	if b, _ := os.ReadFile(moved); string(b) != "before\nmoved\n" {
+		t.Errorf("moved file = %q", b)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "after\n" {
+		t.Errorf("reopened file = %q", b)
+	}
+	if err := lf.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if backups := lf.backups(); len(backups) != 1 {
+		t.Errorf("backups after Rotate() = %v", backups)
+	}
+	if err := lf.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if backups := lf.backups(); len(backups) != 1 {
+		t.Errorf("empty file rotated, backups = %v", backups)
+	}
+}
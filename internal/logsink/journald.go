@@ -0,0 +1,53 @@
+package logsink
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// newJournaldEncoder return an encoder of the journald native protocol, the fields are sent as CMD_<FIELD>
+func newJournaldEncoder(opts Options) func(e Entry) []byte {
+	var common []byte
+	common = appendJournaldField(common, "SYSLOG_IDENTIFIER", opts.Tag)
+	common = appendJournaldField(common, "SYSLOG_FACILITY", strconv.Itoa(opts.Facility))
+	for k, v := range opts.Fields {
+		common = appendJournaldField(common, "CMD_"+journaldName(k), v)
+	}
+
+	return func(e Entry) []byte {
+		b := append([]byte(nil), common...)
+		b = appendJournaldField(b, "MESSAGE", e.Line)
+		b = appendJournaldField(b, "PRIORITY", strconv.Itoa(e.severity()))
+		b = appendJournaldField(b, "CMD_STREAM", e.Stream)
+		if e.Pid > 0 {
+			b = appendJournaldField(b, "SYSLOG_PID", strconv.Itoa(e.Pid))
+		}
+		return b
+	}
+}
+
+// appendJournaldField append KEY=value\n, or KEY\n<little endian uint64 length>value\n
+// if value contains a newline. Empty values are skipped
+func appendJournaldField(b []byte, key, value string) []byte {
+	if value == "" {
+		return b
+	}
+	if !strings.Contains(value, "\n") {
+		return append(append(append(append(b, key...), '='), value...), '\n')
+	}
+	b = append(append(b, key...), '\n')
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(value)))
+	return append(append(b, value...), '\n')
+}
+
+// journaldName return s as a journald field name of uppercase letters, digits and underscores
+func journaldName(s string) string {
+	b := []byte(strings.ToUpper(s))
+	for i, c := range b {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
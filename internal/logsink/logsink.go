@@ -0,0 +1,249 @@
+// Package logsink ship the output lines of a cmd to syslog (RFC5424 over unix, udp or tcp)
+// or to journald through its native protocol
+package logsink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Types of Sink
+const (
+	TypeSyslog   = "syslog"
+	TypeJournald = "journald"
+)
+
+// Default addresses of the sinks
+const (
+	DefaultSyslogAddress  = "unix:///dev/log"
+	DefaultJournaldSocket = "/run/systemd/journal/socket"
+)
+
+// Severities of the lines of stdout and stderr
+const (
+	SeverityErr  = 3
+	SeverityInfo = 6
+)
+
+const (
+	queueSize    = 1024            // 待发送的行数, 超过时丢弃新行
+	writeTimeout = 5 * time.Second // 单次连接和发送的超时时间
+	redialDelay  = time.Second     // 连接或发送失败后等待redialDelay再重连, 期间的行被丢弃
+)
+
+// Entry is a line of the output of a cmd
+type Entry struct {
+	Time   time.Time
+	Stream string // stdout or stderr
+	Pid    int    // 0 if unknown
+	Line   string
+}
+
+// severity return SeverityErr for stderr, SeverityInfo otherwise
+func (e Entry) severity() int {
+	if e.Stream == "stderr" {
+		return SeverityErr
+	}
+	return SeverityInfo
+}
+
+// Options of a Sink
+type Options struct {
+	Tag      string            // syslog APP-NAME或journald SYSLOG_IDENTIFIER
+	Hostname string            // syslog HOSTNAME, 为空时为"-"
+	Facility int               // syslog facility, 默认user(1)
+	Fields   map[string]string // 结构化字段, 例如name、app、port、hostname注释
+	OnError  func(err error)   // 发送失败时调用, 在发送goroutine中调用
+}
+
+// Sink send entries asynchronously, so a slow or unreachable collector never blocks the cmd.
+// Entries are dropped when the queue is full or the collector is unreachable,
+// the connection is redialed after redialDelay
+type Sink struct {
+	network, address string
+	encode           func(e Entry) []byte
+	frame            bool // tcp使用octet-counting分帧(RFC6587)
+	onError          func(err error)
+
+	mu      sync.Mutex
+	queue   chan Entry
+	closed  bool
+	dropped int
+	done    chan struct{}
+
+	conn     net.Conn  // 只在发送goroutine中使用
+	nextDial time.Time // 失败后下次重连的时间
+}
+
+// New create a Sink of typ sending to address, see ParseAddress. The connection is dialed lazily
+func New(typ, address string, opts Options) (*Sink, error) {
+	network, addr, err := ParseAddress(typ, address)
+	if err != nil {
+		return nil, err
+	}
+	s := &Sink{
+		network: network,
+		address: addr,
+		frame:   network == "tcp",
+		onError: opts.OnError,
+		queue:   make(chan Entry, queueSize),
+		done:    make(chan struct{}),
+	}
+	if opts.Facility == 0 {
+		opts.Facility = 1
+	}
+	switch typ {
+	case TypeSyslog:
+		s.encode = newSyslogEncoder(opts)
+	case TypeJournald:
+		s.encode = newJournaldEncoder(opts)
+	}
+	go s.run()
+	return s, nil
+}
+
+// ParseAddress return the network and address of a sink.
+// syslog: unix:///dev/log, udp://host:514 or tcp://host:601, default DefaultSyslogAddress.
+// journald: the path of the native socket, default DefaultJournaldSocket
+func ParseAddress(typ, address string) (network, addr string, err error) {
+	switch typ {
+	case TypeJournald:
+		if address == "" {
+			address = DefaultJournaldSocket
+		}
+		return "unixgram", address, nil
+	case TypeSyslog:
+		if address == "" {
+			address = DefaultSyslogAddress
+		}
+		u, err := url.Parse(address)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid syslog address %q: %w", address, err)
+		}
+		switch u.Scheme {
+		case "unix":
+			if u.Path == "" {
+				return "", "", fmt.Errorf("invalid syslog address %q, want unix:///path", address)
+			}
+			return "unixgram", u.Path, nil
+		case "udp", "tcp":
+			if _, _, err := net.SplitHostPort(u.Host); err != nil {
+				return "", "", fmt.Errorf("invalid syslog address %q: %w", address, err)
+			}
+			return u.Scheme, u.Host, nil
+		default:
+			return "", "", fmt.Errorf("invalid syslog address %q, scheme must be unix, udp or tcp", address)
+		}
+	default:
+		return "", "", fmt.Errorf("unknown log sink type %q, must be %s or %s", typ, TypeSyslog, TypeJournald)
+	}
+}
+
+var facilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp",
+	"ntp", "security", "console", "solaris-cron", "local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// ParseFacility parse a syslog facility name like local0, empty is user
+func ParseFacility(s string) (int, error) {
+	if s == "" {
+		return 1, nil
+	}
+	for i, f := range facilities {
+		if strings.EqualFold(s, f) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown syslog facility %q", s)
+}
+
+// Send queue e, e is dropped if the queue is full or the sink is closed
+func (s *Sink) Send(e Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- e:
+	default:
+		s.dropped++
+	}
+}
+
+// Dropped return the number of entries dropped because the queue was full or the collector was unreachable
+func (s *Sink) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Close send the queued entries and close the connection
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	for e := range s.queue {
+		if s.conn == nil && time.Now().Before(s.nextDial) {
+			s.mu.Lock()
+			s.dropped++
+			s.mu.Unlock()
+			continue
+		}
+		if err := s.write(s.encode(e)); err != nil {
+			s.nextDial = time.Now().Add(redialDelay)
+			s.mu.Lock()
+			s.dropped++
+			s.mu.Unlock()
+			if s.onError != nil {
+				s.onError(err)
+			}
+		}
+	}
+}
+
+// write send b, dialing if not connected. The connection is closed on error and redialed later
+func (s *Sink) write(b []byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, writeTimeout)
+		// /dev/log也可能是stream类型的unix socket
+		if err != nil && s.network == "unixgram" && errors.Is(err, syscall.EPROTOTYPE) {
+			conn, err = net.DialTimeout("unix", s.address, writeTimeout)
+		}
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	switch {
+	case s.frame:
+		b = append(fmt.Appendf(nil, "%d ", len(b)), b...)
+	case s.conn.RemoteAddr().Network() == "unix": // stream类型的unix socket以换行分隔
+		b = append(b, '\n')
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := s.conn.Write(b); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
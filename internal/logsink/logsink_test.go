@@ -0,0 +1,213 @@
+package logsink
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testOpts = Options{
+	Tag:      "prometheus",
+	Hostname: "proxy-a",
+	Facility: 16, // local0
+	Fields:   map[string]string{"name": "prometheus", "app": "xie\"Cloud]", "port": "9091", "hostname": "proxy-a"},
+}
+
+// shortTempDir return a temp dir with a short path, unix socket paths are limited to about 100 bytes
+func shortTempDir(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+var syslogRe = regexp.MustCompile(`^<(\d+)>1 (\S+) proxy-a prometheus (\S+) (stdout|stderr) ` +
+	`\[cmd@32473 app="xie\\"Cloud\\]" hostname="proxy-a" name="prometheus" port="9091" stream="(stdout|stderr)"\] (.*)$`)
+
+func checkSyslog(t *testing.T, msg, pri, procID, line string) {
+	t.Helper()
+	m := syslogRe.FindStringSubmatch(msg)
+	if m == nil {
+		t.Fatalf("message %q does not match RFC5424", msg)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, m[2]); err != nil {
+		t.Errorf("timestamp %q: %v", m[2], err)
+	}
+	if m[1] != pri || m[3] != procID || m[6] != line {
+		t.Errorf("pri %s, procid %s, msg %q, want %s, %s, %q", m[1], m[3], m[6], pri, procID, line)
+	}
+}
+
+func TestSink_syslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s, err := New(TypeSyslog, "udp://"+pc.LocalAddr().String(), testOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Send(Entry{Time: time.Now(), Stream: "stderr", Pid: 42, Line: "boom"})
+	s.Close()
+
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSyslog(t, string(buf[:n]), "131", "42", "boom") // local0*8 + err
+}
+
+func TestSink_syslogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s, err := New(TypeSyslog, "tcp://"+ln.Addr().String(), testOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Send(Entry{Time: time.Now(), Stream: "stdout", Line: "a b"})
+	s.Send(Entry{Time: time.Now(), Stream: "stdout", Line: "c"})
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s.Close()
+
+	// octet-counting分帧
+	r := bufio.NewReader(conn)
+	for _, line := range []string{"a b", "c"} {
+		var n int
+		if _, err := fmt.Fscanf(r, "%d ", &n); err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			t.Fatal(err)
+		}
+		checkSyslog(t, string(msg), "134", "-", line)
+	}
+}
+
+func TestSink_syslogUnix(t *testing.T) {
+	path := filepath.Join(shortTempDir(t), "log")
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s, err := New(TypeSyslog, "unix://"+path, testOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Send(Entry{Time: time.Now(), Stream: "stdout", Line: "hello"})
+	s.Close()
+
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSyslog(t, string(buf[:n]), "134", "-", "hello")
+}
+
+func TestSink_journald(t *testing.T) {
+	path := filepath.Join(shortTempDir(t), "socket")
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s, err := New(TypeJournald, path, testOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Send(Entry{Time: time.Now(), Stream: "stderr", Pid: 7, Line: "two\nlines"})
+	s.Close()
+
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	for _, field := range []string{"SYSLOG_IDENTIFIER=prometheus\n", "SYSLOG_FACILITY=16\n", "PRIORITY=3\n", "SYSLOG_PID=7\n",
+		"CMD_NAME=prometheus\n", "CMD_APP=xie\"Cloud]\n", "CMD_PORT=9091\n", "CMD_HOSTNAME=proxy-a\n", "CMD_STREAM=stderr\n"} {
+		if !strings.Contains(msg, field) {
+			t.Errorf("message %q does not contain %q", msg, field)
+		}
+	}
+	// 包含换行的值使用二进制格式
+	want := "MESSAGE\n" + string(binary.LittleEndian.AppendUint64(nil, 9)) + "two\nlines\n"
+	if !strings.Contains(msg, want) {
+		t.Errorf("message %q does not contain binary MESSAGE field", msg)
+	}
+}
+
+func TestSink_unreachable(t *testing.T) {
+	var errs int
+	opts := testOpts
+	opts.OnError = func(error) { errs++ }
+	s, err := New(TypeJournald, filepath.Join(shortTempDir(t), "missing"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 10 {
+		s.Send(Entry{Stream: "stdout", Line: "lost"})
+	}
+	start := time.Now()
+	s.Close()
+	if time.Since(start) > time.Second {
+		t.Errorf("Close() took %s", time.Since(start))
+	}
+	// 失败后redialDelay内不再重连
+	if s.Dropped() != 10 || errs != 1 {
+		t.Errorf("dropped %d, errors %d, want 10, 1", s.Dropped(), errs)
+	}
+	s.Send(Entry{Line: "after close"})
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		typ, address  string
+		network, addr string
+		wantErr       bool
+	}{
+		{typ: TypeSyslog, network: "unixgram", addr: "/dev/log"},
+		{typ: TypeSyslog, address: "udp://10.0.0.1:514", network: "udp", addr: "10.0.0.1:514"},
+		{typ: TypeSyslog, address: "tcp://logs:601", network: "tcp", addr: "logs:601"},
+		{typ: TypeSyslog, address: "tcp://logs", wantErr: true},
+		{typ: TypeSyslog, address: "tls://logs:6514", wantErr: true},
+		{typ: TypeJournald, network: "unixgram", addr: DefaultJournaldSocket},
+		{typ: "file", wantErr: true},
+	}
+	for _, tt := range tests {
+		network, addr, err := ParseAddress(tt.typ, tt.address)
+		if (err != nil) != tt.wantErr || network != tt.network || addr != tt.addr {
+			t.Errorf("ParseAddress(%s, %q) = %s, %s, %v", tt.typ, tt.address, network, addr, err)
+		}
+	}
+	if f, err := ParseFacility("LOCAL7"); f != 23 || err != nil {
+		t.Errorf("ParseFacility(LOCAL7) = %d, %v", f, err)
+	}
+	if _, err := ParseFacility("local8"); err == nil {
+		t.Error("ParseFacility(local8) error = nil")
+	}
+}
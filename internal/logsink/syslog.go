@@ -0,0 +1,66 @@
+package logsink
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// sdID is the SD-ID of the structured data of the syslog messages, 32473 is the example enterprise number of RFC5612
+const sdID = "cmd@32473"
+
+// newSyslogEncoder return an encoder of RFC5424 messages, the fields are sent as structured data
+func newSyslogEncoder(opts Options) func(e Entry) []byte {
+	hostname := headerField(opts.Hostname, 255)
+	appName := headerField(opts.Tag, 48)
+	var sd strings.Builder
+	sd.WriteString("[" + sdID)
+	for _, k := range slices.Sorted(maps.Keys(opts.Fields)) {
+		if v := opts.Fields[k]; v != "" {
+			fmt.Fprintf(&sd, ` %s="%s"`, sdName(k), sdEscaper.Replace(v))
+		}
+	}
+	prefix := sd.String()
+
+	return func(e Entry) []byte {
+		procID := "-"
+		if e.Pid > 0 {
+			procID = strconv.Itoa(e.Pid)
+		}
+		pri := opts.Facility*8 + e.severity()
+		// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG
+		return fmt.Appendf(nil, `<%d>1 %s %s %s %s %s %s stream="%s"] %s`,
+			pri, e.Time.Format("2006-01-02T15:04:05.000000Z07:00"), hostname, appName, procID, headerField(e.Stream, 32),
+			prefix, sdEscaper.Replace(e.Stream), e.Line)
+	}
+}
+
+// sdEscaper escape the characters not allowed in SD-PARAM values
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// headerField return s as a header field of at most max printable ASCII characters, "-" if empty
+func headerField(s string, max int) string {
+	if s == "" {
+		return "-"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if c <= ' ' || c > '~' {
+			b[i] = '_'
+		}
+	}
+	return string(b[:min(len(b), max)])
+}
+
+// sdName return s as a SD-NAME, which must not contain '=', ' ', ']' and '"'
+func sdName(s string) string {
+	b := []byte(headerField(s, 32))
+	for i, c := range b {
+		if c == '=' || c == ']' || c == '"' {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,429 @@
+// Package loki push log lines to a Loki-compatible /loki/api/v1/push endpoint in batches.
+// Batches which cannot be pushed are spooled to disk and retried with backoff, oldest first
+package loki
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default values of Config
+const (
+	DefaultBatchWait  = time.Second
+	DefaultBatchSize  = 1 << 20 // 1MiB
+	DefaultMaxSpool   = 100 << 20
+	DefaultTimeout    = 10 * time.Second
+	DefaultBackoffMin = 500 * time.Millisecond
+	DefaultBackoffMax = 5 * time.Minute
+)
+
+const (
+	entryQueue = 10000 // 待批量发送的行数, 超过时丢弃新行
+	batchQueue = 10    // 待发送的批次数, 超过时写入磁盘
+	spoolExt   = ".json.gz"
+)
+
+// Config of a Client, zero values are replaced by the defaults
+type Config struct {
+	URL        string        // push地址, 例如http://loki:3100/loki/api/v1/push
+	TenantID   string        // X-Scope-OrgID请求头, 为空时不发送
+	BatchWait  time.Duration // 批次最长等待时间
+	BatchSize  int           // 批次中行的最大字节数
+	SpoolDir   string        // 发送失败的批次保存的目录, 为空时丢弃发送失败的批次
+	MaxSpool   int64         // 磁盘缓冲的最大字节数, 超过时删除最旧的批次
+	Timeout    time.Duration // 单次push的超时时间
+	BackoffMin time.Duration // 发送失败后的最小重试间隔, 每次失败翻倍
+	BackoffMax time.Duration // 最大重试间隔
+}
+
+// Labels of a stream, e.g. name, app, hostname, ip and stream
+type Labels map[string]string
+
+// key return the canonical form of l, used to group entries by stream
+func (l Labels) key() string {
+	var b strings.Builder
+	for _, k := range slices.Sorted(maps.Keys(l)) {
+		b.WriteString(k + "=" + strconv.Quote(l[k]) + ",")
+	}
+	return b.String()
+}
+
+type entry struct {
+	labels Labels
+	time   time.Time
+	line   string
+}
+
+// Client batch the lines pushed by Push and send them to Loki in the background.
+// Push never blocks, lines are dropped when the queue is full
+type Client struct {
+	cfg    Config
+	http   *http.Client
+	logger *slog.Logger
+
+	entries chan entry
+	batches chan encoded // 编码后的批次
+	seq     atomic.Int64 // 磁盘中批次文件名的序号
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	stopped bool
+	dropped int
+}
+
+// New create a Client and start sending in the background, batches spooled before are sent first
+func New(cfg Config, logger *slog.Logger) (*Client, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("loki: url is empty")
+	}
+	if cfg.BatchWait <= 0 {
+		cfg.BatchWait = DefaultBatchWait
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.MaxSpool <= 0 {
+		cfg.MaxSpool = DefaultMaxSpool
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.BackoffMin <= 0 {
+		cfg.BackoffMin = DefaultBackoffMin
+	}
+	if cfg.BackoffMax < cfg.BackoffMin {
+		cfg.BackoffMax = max(DefaultBackoffMax, cfg.BackoffMin)
+	}
+	if cfg.SpoolDir != "" {
+		if err := os.MkdirAll(cfg.SpoolDir, 0755); err != nil {
+			return nil, fmt.Errorf("loki: create spool dir: %w", err)
+		}
+	}
+	c := &Client{
+		cfg:     cfg,
+		http:    &http.Client{Timeout: cfg.Timeout},
+		logger:  logger,
+		entries: make(chan entry, entryQueue),
+		batches: make(chan encoded, batchQueue),
+	}
+	c.wg.Add(2)
+	go c.batch()
+	go c.send()
+	return c, nil
+}
+
+// Push queue line of the stream labels, it is dropped if the queue is full or c is stopped
+func (c *Client) Push(labels Labels, t time.Time, line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return
+	}
+	select {
+	case c.entries <- entry{labels: labels, time: t, line: line}:
+	default:
+		c.dropped++
+	}
+}
+
+// Dropped return the number of lines dropped because the queue was full or the spool was full
+func (c *Client) Dropped() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dropped
+}
+
+func (c *Client) drop(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropped += n
+}
+
+// Stop flush the queued lines, unsent batches are spooled and sent by the next Client using the same SpoolDir
+func (c *Client) Stop() {
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return
+	}
+	c.stopped = true
+	close(c.entries)
+	c.mu.Unlock()
+	c.wg.Wait()
+}
+
+// batch group the entries by stream and pass a batch to send when it exceeds BatchSize or after BatchWait
+func (c *Client) batch() {
+	defer c.wg.Done()
+	defer close(c.batches)
+	b := newBatch()
+	ticker := time.NewTicker(c.cfg.BatchWait)
+	defer ticker.Stop()
+	flush := func() {
+		if b.lines == 0 {
+			return
+		}
+		body, err := b.encode()
+		if err != nil {
+			c.logger.Error("Encode loki batch failed", "error", err)
+			c.drop(b.lines)
+		} else {
+			select {
+			case c.batches <- encoded{body: body, lines: b.lines}:
+			default: // 发送落后时直接写入磁盘
+				c.spool(body, b.lines)
+			}
+		}
+		b = newBatch()
+	}
+	for {
+		select {
+		case e, ok := <-c.entries:
+			if !ok {
+				flush()
+				return
+			}
+			if b.bytes+len(e.line) > c.cfg.BatchSize {
+				flush()
+			}
+			b.add(e)
+		case <-ticker.C:
+			if time.Since(b.start) >= c.cfg.BatchWait {
+				flush()
+			}
+		}
+	}
+}
+
+// send push the spooled batches oldest first, then the new batches. A failed batch is spooled
+// and retried with backoff. New batches are spooled as long as there are spooled ones to keep the order
+func (c *Client) send() {
+	defer c.wg.Done()
+	backoff := c.cfg.BackoffMin
+	var retry <-chan time.Time
+	fail := func(err error) {
+		c.logger.Warn("Push logs to loki failed", "error", err, "retry", backoff)
+		retry = time.After(backoff)
+		backoff = min(backoff*2, c.cfg.BackoffMax)
+	}
+	// handle return false after the last batch
+	handle := func(e encoded, ok bool) bool {
+		if !ok {
+			return false
+		}
+		if retry != nil || c.hasSpool() {
+			c.spool(e.body, e.lines)
+			return true
+		}
+		if err := c.push(e.body); err != nil {
+			if !errors.Is(err, errPermanent) {
+				c.spool(e.body, e.lines)
+			}
+			fail(err)
+			return true
+		}
+		backoff = c.cfg.BackoffMin
+		return true
+	}
+	for {
+		if file, ok := c.oldestSpool(); ok && retry == nil {
+			// 新批次优先写入磁盘, 避免Stop等待磁盘中的批次全部发送
+			select {
+			case e, ok := <-c.batches:
+				if !handle(e, ok) {
+					return
+				}
+				continue
+			default:
+			}
+			if err := c.pushFile(file); err != nil {
+				fail(err)
+			} else {
+				backoff = c.cfg.BackoffMin
+			}
+			continue
+		}
+		select {
+		case e, ok := <-c.batches:
+			if !handle(e, ok) {
+				return
+			}
+		case <-retry:
+			retry = nil
+		}
+	}
+}
+
+// errPermanent is returned by push when Loki rejects the batch, e.g. 400, it is not retried
+var errPermanent = errors.New("rejected by loki")
+
+// push send a gzip compressed push request
+func (c *Client) push(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	if c.cfg.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", c.cfg.TenantID)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+		return fmt.Errorf("loki: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	default:
+		return fmt.Errorf("%w: %s: %s", errPermanent, resp.Status, bytes.TrimSpace(msg))
+	}
+}
+
+// pushFile push a spooled batch and remove it unless it should be retried
+func (c *Client) pushFile(file string) error {
+	body, err := os.ReadFile(file)
+	if err == nil {
+		err = c.push(body)
+	}
+	if err != nil && !errors.Is(err, errPermanent) && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err != nil {
+		c.logger.Error("Drop spooled loki batch", "file", file, "error", err)
+	}
+	os.Remove(file)
+	return nil
+}
+
+// spool write body to SpoolDir and remove the oldest batches beyond MaxSpool.
+// lines is the number of lines of body, counted as dropped if body cannot be spooled
+func (c *Client) spool(body []byte, lines int) {
+	if c.cfg.SpoolDir == "" {
+		c.drop(lines)
+		return
+	}
+	// 文件名按字典序排序即按写入顺序排序
+	name := filepath.Join(c.cfg.SpoolDir, fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), c.seq.Add(1)%1e6, spoolExt))
+	if err := os.WriteFile(name, body, 0644); err != nil {
+		c.logger.Error("Spool loki batch failed", "error", err)
+		c.drop(lines)
+		return
+	}
+	files := c.spoolFiles()
+	var total int64
+	sizes := make([]int64, len(files))
+	for i, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	for i := 0; total > c.cfg.MaxSpool && i < len(files)-1; i++ {
+		c.logger.Warn("Loki spool full, drop the oldest batch", "file", files[i])
+		os.Remove(files[i])
+		total -= sizes[i]
+	}
+}
+
+// spoolFiles return the spooled batches, oldest first
+func (c *Client) spoolFiles() []string {
+	if c.cfg.SpoolDir == "" {
+		return nil
+	}
+	files, _ := filepath.Glob(filepath.Join(c.cfg.SpoolDir, "*"+spoolExt))
+	slices.Sort(files)
+	return files
+}
+
+func (c *Client) oldestSpool() (string, bool) {
+	files := c.spoolFiles()
+	if len(files) == 0 {
+		return "", false
+	}
+	return files[0], true
+}
+
+func (c *Client) hasSpool() bool {
+	_, ok := c.oldestSpool()
+	return ok
+}
+
+// batch is the entries grouped by stream
+type batch struct {
+	streams map[string]*stream
+	start   time.Time // 第一行加入的时间
+	bytes   int
+	lines   int
+}
+
+// encoded is a gzip compressed push request of a batch
+type encoded struct {
+	body  []byte
+	lines int // 批次的行数, 无法发送或写入磁盘时计入dropped
+}
+
+type stream struct {
+	Stream Labels      `json:"stream"`
+	Values [][2]string `json:"values"` // [unix纳秒时间戳, 行]
+}
+
+func newBatch() *batch {
+	return &batch{streams: make(map[string]*stream)}
+}
+
+func (b *batch) add(e entry) {
+	if b.lines == 0 {
+		b.start = time.Now()
+	}
+	key := e.labels.key()
+	s, ok := b.streams[key]
+	if !ok {
+		s = &stream{Stream: e.labels}
+		b.streams[key] = s
+	}
+	s.Values = append(s.Values, [2]string{strconv.FormatInt(e.time.UnixNano(), 10), e.line})
+	b.bytes += len(e.line)
+	b.lines++
+}
+
+// encode return the gzip compressed JSON push request of b
+func (b *batch) encode() ([]byte, error) {
+	req := struct {
+		Streams []*stream `json:"streams"`
+	}{Streams: make([]*stream, 0, len(b.streams))}
+	for _, key := range slices.Sorted(maps.Keys(b.streams)) {
+		req.Streams = append(req.Streams, b.streams[key])
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(req); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
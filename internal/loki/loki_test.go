@@ -0,0 +1,225 @@
+package loki
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type pushed struct {
+	Streams []struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	} `json:"streams"`
+}
+
+// lokiServer record the pushed lines, it fail with 503 while down is true
+type lokiServer struct {
+	*httptest.Server
+	down   atomic.Bool
+	mu     sync.Mutex
+	lines  []string
+	labels []map[string]string
+	tenant string
+}
+
+func newLokiServer(t *testing.T) *lokiServer {
+	s := &lokiServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/loki/api/v1/push" || r.Header.Get("Content-Encoding") != "gzip" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if s.down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req pushed
+		if err := json.NewDecoder(zr).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.tenant = r.Header.Get("X-Scope-OrgID")
+		for _, st := range req.Streams {
+			s.labels = append(s.labels, st.Stream)
+			for _, v := range st.Values {
+				s.lines = append(s.lines, v[1])
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *lokiServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.lines...)
+}
+
+func waitLines(t *testing.T, s *lokiServer, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if lines := s.received(); len(lines) >= n {
+			return lines
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("received %v, want %d lines", s.received(), n)
+	return nil
+}
+
+func TestClient_push(t *testing.T) {
+	s := newLokiServer(t)
+	c, err := New(Config{URL: s.URL + "/loki/api/v1/push", TenantID: "team-a", BatchWait: 20 * time.Millisecond}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := Labels{"name": "web", "stream": "stdout"}
+	errs := Labels{"name": "web", "stream": "stderr"}
+	now := time.Now()
+	c.Push(out, now, "a")
+	c.Push(errs, now, "b")
+	c.Push(out, now.Add(time.Millisecond), "c")
+	lines := waitLines(t, s, 3)
+	c.Stop()
+	c.Push(out, now, "after stop")
+
+	// 按stream分组, 组内保持顺序
+	if got := len(s.labels); got < 2 {
+		t.Errorf("streams = %v, want stdout and stderr", s.labels)
+	}
+	if i, j := slices.Index(lines, "a"), slices.Index(lines, "c"); i < 0 || i > j || !slices.Contains(lines, "b") {
+		t.Errorf("lines = %v", lines)
+	}
+	if s.tenant != "team-a" {
+		t.Errorf("X-Scope-OrgID = %q", s.tenant)
+	}
+	if len(s.received()) != 3 {
+		t.Errorf("line pushed after Stop(): %v", s.received())
+	}
+}
+
+func TestClient_spool(t *testing.T) {
+	s := newLokiServer(t)
+	s.down.Store(true)
+	dir := t.TempDir()
+	cfg := Config{
+		URL:        s.URL + "/loki/api/v1/push",
+		BatchWait:  10 * time.Millisecond,
+		SpoolDir:   dir,
+		BackoffMin: 20 * time.Millisecond,
+		BackoffMax: 50 * time.Millisecond,
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	c, err := New(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := Labels{"name": "web"}
+	for _, line := range []string{"1", "2", "3"} {
+		c.Push(labels, time.Now(), line)
+		time.Sleep(30 * time.Millisecond) // 每行一个批次
+	}
+	c.Stop()
+	if n := len(c.spoolFiles()); n == 0 {
+		t.Fatal("no batch spooled while loki is down")
+	}
+
+	// 重启后先发送磁盘中的批次, 保持顺序
+	s.down.Store(false)
+	c, err = New(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Push(labels, time.Now(), "4")
+	lines := waitLines(t, s, 4)
+	c.Stop()
+	for i, want := range []string{"1", "2", "3", "4"} {
+		if lines[i] != want {
+			t.Fatalf("lines = %v, want in order", lines)
+		}
+	}
+	if files := c.spoolFiles(); len(files) != 0 {
+		t.Errorf("spool not drained: %v", files)
+	}
+}
+
+func TestClient_recover(t *testing.T) {
+	s := newLokiServer(t)
+	s.down.Store(true)
+	c, err := New(Config{
+		URL:        s.URL + "/loki/api/v1/push",
+		BatchWait:  10 * time.Millisecond,
+		SpoolDir:   t.TempDir(),
+		BackoffMin: 10 * time.Millisecond,
+		BackoffMax: 20 * time.Millisecond,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	c.Push(Labels{"name": "web"}, time.Now(), "while down")
+	time.Sleep(50 * time.Millisecond)
+	s.down.Store(false)
+	c.Push(Labels{"name": "web"}, time.Now(), "after up")
+	lines := waitLines(t, s, 2)
+	if lines[0] != "while down" || lines[1] != "after up" {
+		t.Errorf("lines = %v", lines)
+	}
+}
+
+func TestClient_maxSpool(t *testing.T) {
+	dir := t.TempDir()
+	c := &Client{cfg: Config{SpoolDir: dir, MaxSpool: 25}, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	for range 5 {
+		c.spool(make([]byte, 10), 1)
+	}
+	if files := c.spoolFiles(); len(files) != 2 {
+		t.Errorf("spool files = %v, want the newest 2", files)
+	}
+	c.cfg.SpoolDir = ""
+	c.spool(make([]byte, 10), 3)
+	if c.Dropped() != 3 {
+		t.Errorf("Dropped() = %d, want 3", c.Dropped())
+	}
+}
+
+func TestClient_dropWithoutSpool(t *testing.T) {
+	s := newLokiServer(t)
+	s.down.Store(true)
+	c, err := New(Config{
+		URL:        s.URL + "/loki/api/v1/push",
+		BatchWait:  10 * time.Millisecond,
+		BackoffMin: time.Hour,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := Labels{"name": "web"}
+	c.Push(labels, time.Now(), "1")
+	c.Push(labels, time.Now(), "2")
+	time.Sleep(50 * time.Millisecond)
+	c.Push(labels, time.Now(), "3") // 等待重试期间的新批次
+	c.Stop()
+	if c.Dropped() != 3 {
+		t.Errorf("Dropped() = %d, want 3", c.Dropped())
+	}
+}
@@ -20,13 +20,31 @@ import (
 	"hash/fnv"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
-// pidAddr return a map of pid: addr(host:port)
+// pidAddr return a map of pid: addr(host:port).
+// If a pid listens on several addrs, only the last one is kept, see PidAddrs
 func PidAddr() (map[string]string, error) {
+	pidAddrs, err := PidAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var pidAddr = make(map[string]string, len(pidAddrs))
+	for pid, addrs := range pidAddrs {
+		pidAddr[pid] = addrs[len(addrs)-1]
+	}
+	return pidAddr, nil
+}
+
+// PidAddrs return a map of pid: listening addrs(host:port) in lsof order, duplicates removed
+func PidAddrs() (map[string][]string, error) {
 	var spacePattern = regexp.MustCompile(`\s+`)
 
 	out, err := exec.Command("lsof", "-Pi", "TCP", "-s", "TCP:LISTEN").Output()
@@ -34,17 +52,19 @@ func PidAddr() (map[string]string, error) {
 		return nil, fmt.Errorf("lsof err: %v", err)
 	}
 	outS := strings.Split(string(out), "\n")
-	var pidAddr = make(map[string]string, len(outS))
-	for _, line := range outS {
+	var pidAddrs = make(map[string][]string, len(outS))
+	for i, line := range outS {
 		lineSlice := spacePattern.Split(line, -1)
-		if len(lineSlice) < 2 {
+		if i == 0 || len(lineSlice) < 2 { // header
 			continue
 		}
 		addr := lineSlice[len(lineSlice)-2]
 		pid := lineSlice[1]
-		pidAddr[pid] = addr
+		if !slices.Contains(pidAddrs[pid], addr) {
+			pidAddrs[pid] = append(pidAddrs[pid], addr)
+		}
 	}
-	return pidAddr, nil
+	return pidAddrs, nil
 }
 
 func Parseport(addr string) string {
@@ -110,3 +130,90 @@ func HashCmd(cmd *exec.Cmd) string {
 
 	return fmt.Sprintf("%x", hasher.Sum64())
 }
+
+var signals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"ABRT":  syscall.SIGABRT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// ParseSignal parse a signal name or number, e.g. "SIGTERM", "term", "15"
+func ParseSignal(s string) (syscall.Signal, error) {
+	name := strings.ToUpper(strings.TrimSpace(s))
+	if n, err := strconv.Atoi(name); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("invalid signal number %d", n)
+		}
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signals[strings.TrimPrefix(name, "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", s)
+}
+
+// SignalName return the name of sig, e.g. SIGUSR1, or its number if unknown
+func SignalName(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return strconv.Itoa(int(sig))
+}
+
+// WriteFileAtomic write b to a temp file in the same directory and rename it to file,
+// so readers never see a partially written file. The mode of file is kept
+func WriteFileAtomic(file string, b []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(file); err == nil {
+		mode = info.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // rename成功后tmp已不存在
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Ptr return a pointer to v, e.g. for optional config fields
+func Ptr[T any](v T) *T {
+	return &v
+}
+
+// Deref return the value p points to, or the zero value if p is nil
+func Deref[T any](p *T) T {
+	if p == nil {
+		var zero T
+		return zero
+	}
+	return *p
+}
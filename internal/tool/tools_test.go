@@ -17,6 +17,7 @@ package tool
 import (
 	"net"
 	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -112,3 +113,39 @@ func TestIpFromHostname(t *testing.T) {
 		})
 	}
 }
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{in: "SIGTERM", want: syscall.SIGTERM},
+		{in: "TERM", want: syscall.SIGTERM},
+		{in: "sigint", want: syscall.SIGINT},
+		{in: " quit ", want: syscall.SIGQUIT},
+		{in: "9", want: syscall.SIGKILL},
+		{in: "SIGFOO", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSignal(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSignal(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSignal(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+		if got == 0 {
+			continue
+		}
+		if again, err := ParseSignal(SignalName(got)); err != nil || again != got {
+			t.Errorf("ParseSignal(SignalName(%v)) = %v, %v", got, again, err)
+		}
+	}
+	if name := SignalName(syscall.Signal(40)); name != "40" {
+		t.Errorf("SignalName(40) = %s, want 40", name)
+	}
+}
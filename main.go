@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -16,6 +19,7 @@ import (
 
 	"github.com/sq325/cmdDaemon/config"
 	"github.com/sq325/cmdDaemon/daemon"
+	"github.com/sq325/cmdDaemon/internal/loki"
 	"github.com/sq325/cmdDaemon/web/handler"
 
 	_ "github.com/sq325/cmdDaemon/docs"
@@ -50,18 +54,29 @@ var (
 	configFile     *string = pflag.String("config.file", "./daemon.yml", "Daemon configuration file name.")
 	version        *bool   = pflag.BoolP("version", "v", false, "Print version information.")
 	port           *string = pflag.String("web.port", "9090", "Port to listen.")
+	enableAdminAPI *bool   = pflag.Bool("web.enable-admin-api", false, "Enable the api adding, removing, starting, stopping and signaling cmds. Only served to loopback unless web.admin-token-file is set.")
+	adminTokenFile *string = pflag.String("web.admin-token-file", "", "File containing the bearer token required by the admin api.")
 	// consulSvcRegFile *string   = pflag.String("consul.svcRegFile", "./services.json", "Consul service register file name.")
 	logLevel *string = pflag.String("log.level", "info", "Log level. e.g. debug, info, warn, error, dpanic, panic, fatal")
 
 	printCmds *bool = pflag.BoolP("printCmds", "p", false, "Print cmds parse from config.")
 	killCmds  *bool = pflag.Bool("killCmds", false, "Kill all child processes from config.")
+
+	configDiff *bool   = pflag.Bool("config.diff", false, "Print what reloading the config file would change on the running daemon, without reloading.")
+	stateFile  *string = pflag.String("state.file", "./daemon.state.json", "File keeping the run history of cmds across daemon restarts.")
+
+	lokiURL       *string        = pflag.String("loki.url", "", "Loki push URL, e.g. http://loki:3100/loki/api/v1/push. Push the output of cmds to Loki if set.")
+	lokiTenant    *string        = pflag.String("loki.tenant", "", "Loki tenant, sent as the X-Scope-OrgID header.")
+	lokiBatchWait *time.Duration = pflag.Duration("loki.batchWait", loki.DefaultBatchWait, "Maximum time to wait before pushing a batch to Loki.")
+	lokiSpoolDir  *string        = pflag.String("loki.spoolDir", "./loki-spool", "Directory buffering the batches while Loki is unreachable, retried with backoff. Empty drops them.")
+	lokiMaxSpool  *string        = pflag.String("loki.maxSpool", "100MB", "Maximum size of loki.spoolDir, the oldest batches are dropped beyond it.")
 	// printConsulConf *bool = pflag.Bool("printConsulConf", false, "Print consul config.")
 )
 
 var (
 	conf *config.Conf
 
-	signCh = make(chan os.Signal)
+	signCh = make(chan os.Signal, 1)
 )
 
 func init() {
@@ -87,7 +102,11 @@ func main() {
 	// config init
 	initConf()
 	if *printCmds {
-		cmds, _ := config.GenerateCmds(conf)
+		cmds, _, err := config.GenerateCmds(conf)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 		if len(cmds) == 0 {
 			fmt.Println("No cmd to print.")
 			return
@@ -98,10 +117,19 @@ func main() {
 		return
 	}
 
+	if *configDiff {
+		printConfigDiff()
+		return
+	}
+
 	// Clear potential zombie processes based on the configuration file
 	// only to be used when the daemon panics.
 	if *killCmds {
-		cmds, _ := config.GenerateCmds(conf)
+		cmds, _, err := config.GenerateCmds(conf)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 		if len(cmds) == 0 {
 			fmt.Println("No cmd to kill.")
 			return
@@ -146,34 +174,39 @@ func main() {
 	logger.Info("Daemon config file", "file", *configFile)
 
 	// config
-	cmds, annotationsList := config.GenerateCmds(conf)
-	if len(cmds) == 0 {
+	if len(conf.Cmds) == 0 {
 		logger.Error("No cmd to run. Daemon existed.")
 		return
 	}
 
 	// signal
-	signal.Notify(signCh, syscall.SIGHUP, syscall.SIGTERM)
+	signal.Notify(signCh, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGUSR1)
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// 初始化Daemon
 
-	dcmds := make([]*daemon.DaemonCmd, 0, len(cmds))
-	for i, cmd := range cmds {
-		dcmd := daemon.NewDaemonCmd(ctx, cmd, annotationsList[i])
-		dcmds = append(dcmds, dcmd)
+	dcmds, err := daemon.NewDaemonCmds(ctx, conf)
+	if err != nil {
+		logger.Error("Create cmds failed. Daemon exited.", "error", err)
+		cancel()
+		return
 	}
 	onceDaemon := sync.OnceValue(func() *daemon.Daemon {
 		return createDaemon(ctx, dcmds, logger)
 	})
 	d := onceDaemon()
+	daemon.WithDefaults(conf.Defaults)(d)
+	daemon.WithStateFile(*stateFile)(d)
+	if lokiClient := newLokiClient(logger); lokiClient != nil {
+		daemon.WithLoki(lokiClient)(d)
+		defer lokiClient.Stop() // 在子进程停止之后执行, 未发送的批次写入磁盘
+	}
 	logger.Info("Daemon created.")
 	logger.Debug("daemon", "dcmds", fmt.Sprintf("%+v", d.DCmds))
-	go d.Run()                  // run cmds
-	time.Sleep(5 * time.Second) // wait for cmds running
+	go d.Run() // run cmds, each cmd waits for its dependencies
 
 	// 初始化svcManager
-	svc := handler.NewSvcManager(logger, d)
+	svc := handler.NewSvcManager(logger, d, handler.WithConfigFile(*configFile))
 
 	reg := prometheus.NewRegistry()
 	{
@@ -185,10 +218,6 @@ func main() {
 	d.RegisterMetrics(reg)
 	metricsHandler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
 
-	healthSvc := func() bool {
-		return svc.Health()
-	}
-
 	// 注册路由
 	mux := gin.New() // Changed from gin.Default()
 	// gin.SetMode(gin.ReleaseMode) // Already default in gin.New() if not debug
@@ -237,15 +266,18 @@ func main() {
 		c.JSON(200, handler.SvcManagerResponse{V: "ok"})
 	})
 
+	// 兼容旧版本, 使用/api/v1/cmds
 	mux.Any("/list", func(c *gin.Context) {
 		data := svc.List()
 		if data == nil {
 			c.JSON(500, handler.SvcManagerResponse{Err: "No cmd to run."})
 			return
 		}
-		c.Data(200, "application/json", data)
+		c.Data(200, "text/plain; charset=utf-8", data)
 	})
 
+	mux.GET("/limiter", handler.NewGinHandler(handler.MakeLimitersEndpoint(svc), handler.DecodeSvcManagerRequest))
+
 	mux.PUT("/update", func(c *gin.Context) {
 		if err := svc.Update(); err != nil {
 			c.JSON(500, handler.SvcManagerResponse{Err: err.Error()})
@@ -262,15 +294,23 @@ func main() {
 		c.JSON(200, handler.SvcManagerResponse{V: "ok"})
 	})
 
-	mux.Any("/health",
-		func(c *gin.Context) {
-			if healthSvc() {
-				c.String(200, "%s service is healthy", projectName)
-				return
-			}
-			c.String(500, "%s service is unhealthy", projectName)
-		},
-	)
+	mux.Any("/health", handler.NewGinHandler(handler.MakeHealthEndpoint(svc), handler.DecodeSvcManagerRequest))
+	mux.GET("/ready", handler.NewGinHandler(handler.MakeReadyEndpoint(svc), handler.DecodeSvcManagerRequest))
+	// GET对比配置文件, POST对比请求体中的配置
+	configDiffHandler := handler.NewGinHandler(handler.MakeConfigDiffEndpoint(svc), handler.DecodeConfigDiffRequest)
+	mux.GET("/api/config/diff", configDiffHandler)
+	mux.POST("/api/config/diff", configDiffHandler)
+	handler.RegisterCmdRoutes(mux, svc)
+	// 子进程的新增、删除、启动、停止、重启和发送信号, 默认关闭
+	if *enableAdminAPI {
+		if token, err := readAdminToken(); err != nil {
+			logger.Error("Read admin token failed, admin api disabled", "error", err)
+		} else {
+			handler.RegisterAdminRoutes(mux.Group("", handler.AdminAuth(token)), svc)
+			logger.Info("Admin api enabled", "token", token != "")
+		}
+	}
+	handler.RegisterEventRoutes(mux, svc)
 	mux.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 	mux.GET("/metrics", gin.WrapH(metricsHandler))
 	mux.GET("/discovery", gin.WrapH(daemon.HttpSDHandler(d)))
@@ -287,11 +327,12 @@ func main() {
 	}()
 
 	// 防止子进程成为僵尸进程
+	// 子进程在独立的进程组中, 逐个按stopSignal和stopTimeout停止
 	defer func() {
-		pid := os.Getpid()
 		cancel()
-		syscall.Kill(-pid, syscall.SIGTERM)
-		time.Sleep(5 * time.Second)
+		if err := d.Stop(context.Background()); err != nil {
+			logger.Error("Stop child processes failed", "error", err)
+		}
 	}()
 
 	// 捕捉信号
@@ -307,6 +348,7 @@ func main() {
 					defer func() {
 						if r := recover(); r != nil {
 							logger.Error("Reload config failed", "error", r)
+							d.Events().Publish(daemon.Event{Type: daemon.EventReload, Err: fmt.Sprintf("reload config failed: %v", r)})
 							logger.Info("Panic Recover. Nothing changed.")
 							initConfPanic = true
 						}
@@ -318,55 +360,27 @@ func main() {
 				}
 
 				logger.Info("Reloaded config.")
-				cmds, anntationsList := config.GenerateCmds(conf)
-				if len(cmds) == 0 {
+				if len(conf.Cmds) == 0 {
 					logger.Error("No cmd to run. Do not reload.")
+					d.Events().Publish(daemon.Event{Type: daemon.EventReload, Err: "no cmd to run, not reloaded"})
 					break
 				}
-				// 关闭所有子进程
-				cancel()
-				var wg sync.WaitGroup
-				for _, dcmd := range d.DCmds {
-					dcmd := dcmd // capture range variable
-					if dcmd.Status == daemon.Exited {
-						continue
-					}
-					pid := dcmd.Cmd.Process.Pid
-					err := syscall.Kill(pid, syscall.SIGTERM)
-					if err != nil {
-						logger.Error("Kill failed", "cmd", dcmd.Cmd.String(), "pid", pid, "error", err)
-					}
-
-					// wait for child process exited
-					// if not exited, kill it after 10s
-					wg.Add(1)
-					go func() {
-						defer wg.Done()
-						// wait for child process exited
-						if dcmd.Cmd == nil || dcmd.Cmd.ProcessState == nil {
-							return
-						}
-						isExited := dcmd.Cmd.ProcessState.Exited()
-						ch := make(chan struct{}, 1)
-						if isExited {
-							ch <- struct{}{}
-						}
-						select {
-						case <-ch:
-						case <-time.After(10 * time.Second):
-							dcmd.Cmd.Process.Kill()
-						}
-					}()
+				// 只停止删除的cmd, 重启变化的cmd, 启动新增的cmd, 未变化的cmd保持运行
+				diff, err := d.Reload(context.Background(), conf)
+				if diff == nil {
+					logger.Error("Reload cmds failed. Nothing changed.", "error", err)
+					break
+				}
+				if err != nil {
+					logger.Error("Stop removed or changed cmds failed", "error", err)
+				}
+				logger.Info("Reloaded cmds", "added", len(diff.Added), "removed", len(diff.Removed),
+					"changed", len(diff.Changed), "unchanged", len(diff.Unchanged))
+			// 重新打开子进程的日志文件, 用于logrotate移动日志文件之后
+			case syscall.SIGUSR1:
+				if err := svc.ReopenLogs(); err != nil {
+					logger.Error("Reopen log files failed", "error", err)
 				}
-				wg.Wait()
-				logger.Info("Ctx canceled. All child processes killed.")
-
-				// reload Daemon and run new cmds
-				ctx, cancel = context.WithCancel(context.Background())
-				d.Reload(ctx, cmds, anntationsList)
-				go d.Run()
-
-				time.Sleep(10 * time.Second)
 			// kill all child processes
 			case syscall.SIGTERM:
 				logger.Warn("Catched a term sign, kill all child processes", "time", time.Now().Format(time.DateTime))
@@ -379,6 +393,46 @@ func main() {
 	}
 }
 
+// newLokiClient create the client pushing the output of cmds to Loki, nil if loki.url is not set
+func newLokiClient(logger *slog.Logger) *loki.Client {
+	if *lokiURL == "" {
+		return nil
+	}
+	maxSpool, err := config.ParseByteSize(*lokiMaxSpool)
+	if err != nil {
+		logger.Error("Invalid loki.maxSpool, use the default", "error", err)
+	}
+	c, err := loki.New(loki.Config{
+		URL:       *lokiURL,
+		TenantID:  *lokiTenant,
+		BatchWait: *lokiBatchWait,
+		SpoolDir:  *lokiSpoolDir,
+		MaxSpool:  int64(maxSpool),
+	}, logger)
+	if err != nil {
+		logger.Error("Create loki client failed, not push to loki", "error", err)
+		return nil
+	}
+	logger.Info("Push the output of cmds to loki", "url", *lokiURL)
+	return c
+}
+
+// readAdminToken read the bearer token of the admin api from web.admin-token-file, empty if not set
+func readAdminToken() (string, error) {
+	if *adminTokenFile == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(*adminTokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", *adminTokenFile)
+	}
+	return token, nil
+}
+
 // 守护进程上下文
 func newForkCtx() *fork.Context {
 	// commandName := os.Args[0]
@@ -410,19 +464,47 @@ func createConfigFile() {
 	fmt.Println("daemon.yml created.")
 }
 
+// 打印配置文件与运行中的daemon配置的差异, 不reload
+func printConfigDiff() {
+	configBytes, err := os.ReadFile(*configFile)
+	if err != nil {
+		fmt.Println("Read config failed:", err)
+		return
+	}
+	resp, err := http.Post("http://127.0.0.1:"+*port+"/api/config/diff", "application/x-yaml", bytes.NewReader(configBytes))
+	if err != nil {
+		fmt.Println("Request running daemon failed:", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var r handler.SvcManagerResponse
+		json.NewDecoder(resp.Body).Decode(&r)
+		fmt.Println("Diff config failed:", resp.Status, r.Err)
+		return
+	}
+	var diff config.ConfDiff
+	if err := json.NewDecoder(resp.Body).Decode(&diff); err != nil {
+		fmt.Println("Decode diff failed:", err)
+		return
+	}
+	fmt.Print(diff.String())
+}
+
 // 配置初始化
 func initConf() {
 	configBytes, err := os.ReadFile(*configFile)
 	if err != nil {
 		panic("Read config failed.")
 	}
-	conf, err = config.Unmarshal(configBytes)
+	newConf, err := config.Unmarshal(configBytes)
 	if err != nil {
-		panic("Unmarshal config failed.")
+		panic("Unmarshal config failed: " + err.Error())
 	}
-	if len(conf.Cmds) == 0 {
+	if len(newConf.Cmds) == 0 {
 		panic("No cmd found.")
 	}
+	conf = newConf
 }
 
 func NewLogger(level slog.Level) *slog.Logger {
@@ -448,7 +530,11 @@ func killcmd(cmd *exec.Cmd) error {
 	if err != nil {
 		return err
 	}
-	err = syscall.Kill(pid, syscall.SIGTERM)
+	// cmd是进程组的leader, 同时kill其子进程
+	err = syscall.Kill(-pid, syscall.SIGTERM)
+	if err == syscall.ESRCH {
+		err = syscall.Kill(pid, syscall.SIGTERM)
+	}
 	if err != nil {
 		return err
 	}
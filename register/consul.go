@@ -76,13 +76,13 @@ func NewConsul(Consuladdr string, node *Node, daemon *daemon.Daemon, svcList []*
 	}, nil
 }
 
-func NewServiceList(node *Node, daemon *daemon.Daemon) ([]*Service, error) {
-	dcmds := daemon.DCmds
+func NewServiceList(node *Node, d *daemon.Daemon) ([]*Service, error) {
+	dcmds := d.GetDCmds()
 	serviceList := make([]*Service, 0, len(dcmds))
 	var errs error
 	for _, dcmd := range dcmds {
 		// 忽略已经退出的cmd
-		if dcmd.Status != 1 {
+		if dcmd.State() != daemon.Running {
 			errors.Join(errs, errors.New("ignore exited cmd: "+dcmd.Cmd.String()))
 			continue
 		}
@@ -2,6 +2,13 @@ package handler
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/sq325/cmdDaemon/config"
+	"github.com/sq325/cmdDaemon/daemon"
 
 	"github.com/go-kit/kit/endpoint"
 )
@@ -54,11 +61,13 @@ func MakeReloadEndpoint(svcManager SvcManager) endpoint.Endpoint {
 
 // List
 //
-//	@Summary 				列出所有子进程的端口和命令
+//	@Summary 				列出所有子进程的端口、状态和命令
+//	@Description	每行为"port state cmd", 已废弃, 使用/api/v1/cmds
 //	@Tags			Reload
 //	@Accept			json
 //	@Produce		json
 //	@Success		200		{object}	SvcManagerResponse
+//	@Deprecated
 //	@Router			/list [get]
 func MakeListEndpoint(svcManager SvcManager) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
@@ -101,3 +110,602 @@ func MakeStopEndpoint(svcManager SvcManager) endpoint.Endpoint {
 		return SvcManagerResponse{V: "ok"}, nil
 	}
 }
+
+// Limiters
+//
+//	@Summary 				列出所有子进程的重启限制状态
+//	@Description	state: ok, cooldown(超过重启限制, 等待cooldown结束后重启), exhausted(超过重启限制, 不再重启)
+//	@Tags			Limiter
+//	@Accept			json
+//	@Produce		json
+//	@Success		200		{array}	LimiterInfo
+//	@Router			/limiter [get]
+func MakeLimitersEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return svcManager.Limiters(), nil
+	}
+}
+
+// Health
+//
+//	@Summary 				守护进程存活检查, 并列出未运行或不健康的子进程
+//	@Description	有子进程超过重启限制放弃重启(fatal)时返回503, 需要手动启动才能恢复
+//	@Tags			Health
+//	@Accept			json
+//	@Produce		json
+//	@Success		200		{object}	HealthReport
+//	@Failure		503		{object}	HealthReport
+//	@Router			/health [get]
+func MakeHealthEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return svcManager.Health(), nil
+	}
+}
+
+// Ready
+//
+//	@Summary 				守护进程就绪检查
+//	@Description	所有critical的子进程(没有配置critical时为所有子进程, 被停止或退出后不再重启的除外)运行中且健康检查通过时就绪, 否则返回503
+//	@Tags			Health
+//	@Accept			json
+//	@Produce		json
+//	@Success		200		{object}	HealthReport
+//	@Failure		503		{object}	HealthReport
+//	@Router			/ready [get]
+func MakeReadyEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return svcManager.Ready(), nil
+	}
+}
+
+type ConfigDiffRequest struct {
+	Conf []byte // 配置文件内容, 为空时读取daemon的配置文件
+}
+
+// ConfigDiffResponse is the diff, or the error if the config is invalid
+type ConfigDiffResponse struct {
+	*config.ConfDiff
+	Err string `json:"err,omitempty"`
+}
+
+// StatusCode return 400 if the config is invalid
+func (r ConfigDiffResponse) StatusCode() int {
+	if r.Err != "" {
+		return http.StatusBadRequest
+	}
+	return http.StatusOK
+}
+
+// ConfigDiff
+//
+//	@Summary 				预览reload配置文件的变化
+//	@Description	对比配置文件(GET)或请求体中的配置(POST)与运行中的配置, 列出新增、删除、需要重启和不变的子进程以及变化的annotations, 不会reload
+//	@Tags			Reload
+//	@Accept			x-yaml
+//	@Produce		json
+//	@Success		200		{object}	ConfigDiffResponse
+//	@Failure		400		{object}	ConfigDiffResponse
+//	@Router			/api/config/diff [get]
+//	@Router			/api/config/diff [post]
+func MakeConfigDiffEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req, _ := request.(ConfigDiffRequest)
+		diff, err := svcManager.ConfigDiff(req.Conf)
+		if err != nil {
+			return ConfigDiffResponse{Err: err.Error()}, nil
+		}
+		return ConfigDiffResponse{ConfDiff: diff}, nil
+	}
+}
+
+// CmdRequest is the request of per-cmd endpoints
+type CmdRequest struct {
+	ID      string         // name注释, 配置中的标识或CmdHash
+	Signal  syscall.Signal // signal接口发送的信号
+	Spec    []byte         // 新增cmd的配置, yaml或json
+	Persist bool           // 是否写回配置文件
+
+	Selector string        // 按annotations选择cmd, 例如app=xieCloud,name=prometheus
+	Batch    int           // 滚动重启每批cmd数量
+	Timeout  time.Duration // 滚动重启每批等待就绪的时间
+}
+
+// CmdResponse is the response of per-cmd endpoints
+type CmdResponse struct {
+	Cmd *CmdStatus `json:"cmd,omitempty"`
+	Err string     `json:"err,omitempty"`
+
+	err error
+}
+
+// StatusCode return the http status code of the response, see errStatusCode
+func (r CmdResponse) StatusCode() int {
+	return errStatusCode(r.err)
+}
+
+// CmdsResponse is the response of endpoints operating on cmds matching a selector
+type CmdsResponse struct {
+	Cmds []CmdStatus `json:"cmds"`
+	Err  string      `json:"err,omitempty"`
+
+	err error
+}
+
+// StatusCode return the http status code of the response, see errStatusCode
+func (r CmdsResponse) StatusCode() int {
+	return errStatusCode(r.err)
+}
+
+func newCmdsResponse(statuses []CmdStatus, err error) CmdsResponse {
+	resp := CmdsResponse{Cmds: statuses, err: err}
+	if statuses == nil {
+		resp.Cmds = []CmdStatus{}
+	}
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	return resp
+}
+
+// errStatusCode return the http status code of err:
+// 404 if no cmd found, 400 if the cmd config or selector is invalid,
+// 409 if the cmd is ambiguous, already exists or in a wrong state for the operation
+func errStatusCode(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, daemon.ErrNoCmdFound):
+		return http.StatusNotFound
+	case errors.Is(err, config.ErrIdentityNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, daemon.ErrInvalidConf), errors.Is(err, daemon.ErrInvalidSelector):
+		return http.StatusBadRequest
+	case errors.Is(err, daemon.ErrAmbiguousCmd), errors.Is(err, daemon.ErrInvalidTransition), errors.Is(err, daemon.ErrNotRunning),
+		errors.Is(err, daemon.ErrCmdExists), errors.Is(err, daemon.ErrNoLogFile):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func newCmdResponse(status CmdStatus, err error) CmdResponse {
+	resp := CmdResponse{err: err}
+	if status.Hash != "" {
+		resp.Cmd = &status
+	}
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	return resp
+}
+
+// StartCmd
+//
+//	@Summary 				启动子进程
+//	@Description	启动stopped、exited或fatal状态的子进程, 等待依赖就绪后启动, 并重置重启限制
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			id		path		string	true	"name注释、配置中的标识或CmdHash"
+//	@Success		200		{object}	CmdResponse
+//	@Failure		404		{object}	CmdResponse
+//	@Failure		409		{object}	CmdResponse
+//	@Router			/api/v1/cmds/{id}/start [put]
+func MakeStartCmdEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		return newCmdResponse(svcManager.StartCmd(req.ID)), nil
+	}
+}
+
+// StopCmd
+//
+//	@Summary 				停止子进程
+//	@Description	按stopSignal和stopTimeout停止子进程, 守护进程不会重启被停止的子进程
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			id		path		string	true	"name注释、配置中的标识或CmdHash"
+//	@Success		200		{object}	CmdResponse
+//	@Failure		404		{object}	CmdResponse
+//	@Router			/api/v1/cmds/{id}/stop [put]
+func MakeStopCmdEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		return newCmdResponse(svcManager.StopCmd(ctx, req.ID)), nil
+	}
+}
+
+// RestartCmd
+//
+//	@Summary 				重启子进程
+//	@Description	停止子进程后重新启动
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			id		path		string	true	"name注释、配置中的标识或CmdHash"
+//	@Success		200		{object}	CmdResponse
+//	@Failure		404		{object}	CmdResponse
+//	@Failure		409		{object}	CmdResponse
+//	@Router			/api/v1/cmds/{id}/restart [put]
+func MakeRestartCmdEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		return newCmdResponse(svcManager.RestartCmd(ctx, req.ID)), nil
+	}
+}
+
+// SignalCmd
+//
+//	@Summary 				向子进程发送信号
+//	@Description	向运行中的子进程的进程组发送信号, 例如USR1
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			id		path		string	true	"name注释、配置中的标识或CmdHash"
+//	@Param			sig		query		string	true	"信号名称或编号, 例如USR1、SIGHUP、10"
+//	@Success		200		{object}	CmdResponse
+//	@Failure		400		{object}	SvcManagerResponse
+//	@Failure		404		{object}	CmdResponse
+//	@Failure		409		{object}	CmdResponse
+//	@Router			/api/v1/cmds/{id}/signal [put]
+func MakeSignalCmdEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		return newCmdResponse(svcManager.SignalCmd(req.ID, req.Signal)), nil
+	}
+}
+
+// ReopenLog
+//
+//	@Summary 				重新打开子进程的日志文件
+//	@Description	不重启子进程, 用于logrotate等外部工具移动日志文件之后
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			id		path		string	true	"name注释、配置中的标识或CmdHash"
+//	@Success		200		{object}	CmdResponse
+//	@Failure		404		{object}	CmdResponse
+//	@Failure		409		{object}	CmdResponse
+//	@Router			/api/v1/cmds/{id}/log/reopen [put]
+func MakeReopenLogEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		return newCmdResponse(svcManager.ReopenLog(req.ID)), nil
+	}
+}
+
+// RotateLog
+//
+//	@Summary 				立即轮转子进程的日志文件
+//	@Description	不重启子进程, 空文件不轮转. 按log配置压缩和清理轮转后的文件
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			id		path		string	true	"name注释、配置中的标识或CmdHash"
+//	@Success		200		{object}	CmdResponse
+//	@Failure		404		{object}	CmdResponse
+//	@Failure		409		{object}	CmdResponse
+//	@Router			/api/v1/cmds/{id}/log/rotate [put]
+func MakeRotateLogEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		return newCmdResponse(svcManager.RotateLog(req.ID)), nil
+	}
+}
+
+// ReopenLogs
+//
+//	@Summary 				重新打开所有运行中子进程的日志文件
+//	@Description	不重启子进程, 与向守护进程发送SIGUSR1相同
+//	@Tags			Cmd
+//	@Produce		json
+//	@Success		200		{object}	SvcManagerResponse
+//	@Router			/api/v1/logs/reopen [put]
+func MakeReopenLogsEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		err := svcManager.ReopenLogs()
+		if err != nil {
+			return SvcManagerResponse{Err: err.Error()}, nil
+		}
+		return SvcManagerResponse{V: "ok"}, nil
+	}
+}
+
+// AddCmd
+//
+//	@Summary 				新增子进程
+//	@Description	请求体为cmd的配置(与配置文件中cmds的元素相同, yaml或json), 应用defaults后立即启动. persist=true时追加到配置文件, 否则下次reload时会被移除. user、group和groups须为守护进程自身的或配置文件api中允许的
+//	@Tags			Cmd
+//	@Accept			json
+//	@Produce		json
+//	@Param			persist	query		bool	false	"是否写回配置文件"
+//	@Success		200		{object}	CmdResponse
+//	@Failure		400		{object}	CmdResponse
+//	@Failure		403		{object}	CmdResponse
+//	@Failure		409		{object}	CmdResponse
+//	@Router			/api/v1/cmds [post]
+func MakeAddCmdEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		return newCmdResponse(svcManager.AddCmd(req.Spec, req.Persist)), nil
+	}
+}
+
+// RemoveCmd
+//
+//	@Summary 				删除子进程
+//	@Description	按stopSignal和stopTimeout停止子进程并不再管理. persist=true时同时从配置文件中删除
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			id		path		string	true	"name注释、配置中的标识或CmdHash"
+//	@Param			persist	query		bool	false	"是否写回配置文件"
+//	@Success		200		{object}	CmdResponse
+//	@Failure		400		{object}	CmdResponse
+//	@Failure		404		{object}	CmdResponse
+//	@Router			/api/v1/cmds/{id} [delete]
+func MakeRemoveCmdEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		return newCmdResponse(svcManager.RemoveCmd(ctx, req.ID, req.Persist)), nil
+	}
+}
+
+// StartCmds
+//
+//	@Summary 				启动匹配selector的子进程
+//	@Description	启动应用的所有子进程, 运行中的子进程不受影响
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			app			path		string	true	"app注释"
+//	@Param			selector	query		string	false	"缩小范围的annotations选择器, 例如name=prometheus"
+//	@Success		200		{object}	CmdsResponse
+//	@Failure		400		{object}	CmdsResponse
+//	@Failure		404		{object}	CmdsResponse
+//	@Router			/api/v1/apps/{app}/start [put]
+func MakeStartCmdsEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		return newCmdsResponse(svcManager.StartCmds(req.Selector)), nil
+	}
+}
+
+// StopCmds
+//
+//	@Summary 				停止匹配selector的子进程
+//	@Description	按依赖的相反顺序停止, 守护进程不会重启被停止的子进程
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			app			path		string	true	"app注释"
+//	@Param			selector	query		string	false	"缩小范围的annotations选择器, 例如name=prometheus"
+//	@Success		200		{object}	CmdsResponse
+//	@Failure		400		{object}	CmdsResponse
+//	@Failure		404		{object}	CmdsResponse
+//	@Router			/api/v1/apps/{app}/stop [put]
+func MakeStopCmdsEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		return newCmdsResponse(svcManager.StopCmds(ctx, req.Selector)), nil
+	}
+}
+
+// RestartCmds
+//
+//	@Summary 				滚动重启匹配selector的子进程
+//	@Description	每批重启batch个子进程, 等待本批全部就绪后再重启下一批, 本批在timeout内未就绪或退出时中止
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			app			path		string	true	"app注释"
+//	@Param			selector	query		string	false	"缩小范围的annotations选择器, 例如name=prometheus"
+//	@Param			batch		query		int		false	"每批子进程数量, 默认1"
+//	@Param			timeout		query		string	false	"每批等待就绪的时间, 默认60s"
+//	@Success		200		{object}	CmdsResponse
+//	@Failure		400		{object}	CmdsResponse
+//	@Failure		404		{object}	CmdsResponse
+//	@Failure		500		{object}	CmdsResponse
+//	@Router			/api/v1/apps/{app}/restart [put]
+func MakeRestartCmdsEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		return newCmdsResponse(svcManager.RestartCmds(ctx, req.Selector, req.Batch, req.Timeout)), nil
+	}
+}
+
+// SignalCmds
+//
+//	@Summary 				向匹配selector的子进程发送信号
+//	@Description	只向运行中的子进程发送
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			app			path		string	true	"app注释"
+//	@Param			selector	query		string	false	"缩小范围的annotations选择器, 例如name=prometheus"
+//	@Param			sig			query		string	true	"信号名称或编号, 例如USR1、SIGHUP、10"
+//	@Success		200		{object}	CmdsResponse
+//	@Failure		400		{object}	SvcManagerResponse
+//	@Failure		404		{object}	CmdsResponse
+//	@Router			/api/v1/apps/{app}/signal [put]
+func MakeSignalCmdsEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		return newCmdsResponse(svcManager.SignalCmds(req.Selector, req.Signal)), nil
+	}
+}
+
+// CmdInfoResponse is the response of GET /api/v1/cmds/{id}
+type CmdInfoResponse struct {
+	Cmd *CmdInfo `json:"cmd,omitempty"`
+	Err string   `json:"err,omitempty"`
+
+	err error
+}
+
+// StatusCode return the http status code of the response, see errStatusCode
+func (r CmdInfoResponse) StatusCode() int {
+	return errStatusCode(r.err)
+}
+
+// CmdInfosResponse is the response of GET /api/v1/cmds
+type CmdInfosResponse struct {
+	Cmds []CmdInfo `json:"cmds"`
+	Err  string    `json:"err,omitempty"`
+
+	err error
+}
+
+// StatusCode return the http status code of the response, see errStatusCode
+func (r CmdInfosResponse) StatusCode() int {
+	return errStatusCode(r.err)
+}
+
+// ListCmds
+//
+//	@Summary 				列出子进程详情
+//	@Description	按配置顺序返回子进程的状态、pid、监听端口、运行时长、重启次数、最近退出码和原因、重启限制状态及annotations
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			selector	query		string	false	"按annotations选择, 例如app=xieCloud,name=prometheus, 为空时返回全部"
+//	@Success		200			{object}	CmdInfosResponse
+//	@Failure		400			{object}	CmdInfosResponse
+//	@Router			/api/v1/cmds [get]
+func MakeListCmdsEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		infos, err := svcManager.Cmds(req.Selector)
+		resp := CmdInfosResponse{Cmds: infos, err: err}
+		if infos == nil {
+			resp.Cmds = []CmdInfo{}
+		}
+		if err != nil {
+			resp.Err = err.Error()
+		}
+		return resp, nil
+	}
+}
+
+// GetCmd
+//
+//	@Summary 				查询子进程详情
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			id		path		string	true	"name注释、配置中的标识或CmdHash"
+//	@Success		200		{object}	CmdInfoResponse
+//	@Failure		404		{object}	CmdInfoResponse
+//	@Failure		409		{object}	CmdInfoResponse
+//	@Router			/api/v1/cmds/{id} [get]
+func MakeGetCmdEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		info, err := svcManager.Cmd(req.ID)
+		resp := CmdInfoResponse{err: err}
+		if err != nil {
+			resp.Err = err.Error()
+		} else {
+			resp.Cmd = &info
+		}
+		return resp, nil
+	}
+}
+
+// EventsResponse is the response of /api/v1/events/history
+type EventsResponse struct {
+	Events []daemon.Event `json:"events"`
+}
+
+// Events
+//
+//	@Summary 				查询生命周期事件历史
+//	@Description	返回保留在环形缓冲区中的最近事件, 按seq升序
+//	@Tags			Events
+//	@Produce		json
+//	@Param			cmd		query		string	false	"DaemonCmd.ID或name注释"
+//	@Param			app		query		string	false	"app注释"
+//	@Param			type	query		string	false	"事件类型, 逗号分隔, 例如state,restart,limitReached,health,reload,action"
+//	@Param			since	query		int		false	"只返回seq大于since的事件"
+//	@Param			limit	query		int		false	"只返回最近limit个事件"
+//	@Success		200		{object}	EventsResponse
+//	@Failure		400		{object}	SvcManagerResponse
+//	@Router			/api/v1/events/history [get]
+func MakeEventsEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(EventsRequest)
+		return EventsResponse{Events: svcManager.Events(req.Filter, req.Since, req.Limit)}, nil
+	}
+}
+
+// CmdHistoryResponse is the response of GET /api/v1/cmds/{id}/history
+type CmdHistoryResponse struct {
+	CmdHistory
+	Err string `json:"err,omitempty"`
+
+	err error
+}
+
+// StatusCode return the http status code of the response, see errStatusCode
+func (r CmdHistoryResponse) StatusCode() int {
+	return errStatusCode(r.err)
+}
+
+// CmdHistory
+//
+//	@Summary 				查询子进程的运行记录
+//	@Description	按时间升序返回最近的运行记录: 启动原因、启动和退出时间、运行时长、退出原因、退出码、终止信号、错误和最后几行stderr.
+//	@Description	重启的原因见上一条记录的exitReason和err. 运行记录保存在状态文件中, 守护进程重启后仍然保留
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			id		path		string	true	"name注释、配置中的标识或CmdHash"
+//	@Success		200		{object}	CmdHistoryResponse
+//	@Failure		404		{object}	CmdHistoryResponse
+//	@Failure		409		{object}	CmdHistoryResponse
+//	@Router			/api/v1/cmds/{id}/history [get]
+func MakeCmdHistoryEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdRequest)
+		history, err := svcManager.CmdHistory(req.ID)
+		resp := CmdHistoryResponse{CmdHistory: history, err: err}
+		if resp.Runs == nil {
+			resp.Runs = []daemon.RunRecord{}
+		}
+		if err != nil {
+			resp.Err = err.Error()
+		}
+		return resp, nil
+	}
+}
+
+// CmdLogsResponse is the response of GET /api/v1/cmds/{id}/logs without follow
+type CmdLogsResponse struct {
+	CmdLogs
+	Err string `json:"err,omitempty"`
+
+	err error
+}
+
+// StatusCode return the http status code of the response, see errStatusCode
+func (r CmdLogsResponse) StatusCode() int {
+	return errStatusCode(r.err)
+}
+
+// CmdLogs
+//
+//	@Summary 				查询子进程最近的输出
+//	@Description	返回内存中保留的最近输出行(每个cmd最多1000行, 跨重启保留), 未配置日志目录时也可用.
+//	@Description	follow=true时先推送最近的行, 然后持续推送新行: 请求头Accept: text/event-stream时使用SSE, 否则为分块传输的JSON行(application/x-ndjson)
+//	@Tags			Cmd
+//	@Produce		json
+//	@Param			id		path		string	true	"name注释、配置中的标识或CmdHash"
+//	@Param			tail	query		int		false	"最近的行数, 默认100"
+//	@Param			stream	query		string	false	"stdout或stderr, 默认全部"
+//	@Param			follow	query		bool	false	"持续推送新行"
+//	@Success		200		{object}	CmdLogsResponse
+//	@Failure		400		{object}	SvcManagerResponse
+//	@Failure		404		{object}	CmdLogsResponse
+//	@Failure		409		{object}	CmdLogsResponse
+//	@Router			/api/v1/cmds/{id}/logs [get]
+func MakeCmdLogsEndpoint(svcManager SvcManager) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CmdLogsRequest)
+		logs, err := svcManager.CmdLogs(req.ID, req.Stream, req.Tail)
+		resp := CmdLogsResponse{CmdLogs: logs, err: err}
+		if resp.Lines == nil {
+			resp.Lines = []daemon.LogLine{}
+		}
+		if err != nil {
+			resp.Err = err.Error()
+		}
+		return resp, nil
+	}
+}
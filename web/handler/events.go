@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sq325/cmdDaemon/daemon"
+	"golang.org/x/net/websocket"
+)
+
+// eventsHeartbeat SSE连接的心跳间隔, 防止代理关闭空闲连接
+var eventsHeartbeat = 15 * time.Second
+
+// EventsRequest is the request of the events endpoints
+type EventsRequest struct {
+	Filter daemon.EventFilter
+	Since  uint64 // 只返回seq大于Since的事件
+	Limit  int    // 只返回最近Limit个事件, 0表示不限制
+}
+
+// DecodeEventsRequest decode the cmd, app, type, since and limit query params.
+// The Last-Event-ID header of a reconnecting SSE client overrides since
+func DecodeEventsRequest(c *gin.Context) (interface{}, error) {
+	req := EventsRequest{Filter: daemon.EventFilter{
+		Cmd:   c.Query("cmd"),
+		App:   c.Query("app"),
+		Types: daemon.ParseEventTypes(c.Query("type")),
+	}}
+	since := c.Query("since")
+	if id := c.GetHeader("Last-Event-ID"); id != "" {
+		since = id
+	}
+	if since != "" {
+		n, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid since: %w", err)
+		}
+		req.Since = n
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid limit %q", limit)
+		}
+		req.Limit = n
+	}
+	return req, nil
+}
+
+// StreamEvents
+//
+//	@Summary 				订阅生命周期事件
+//	@Description	以SSE推送JSON事件, 带Upgrade: websocket请求头时使用websocket, 每条消息为一个JSON事件.
+//	@Description	先推送历史中seq大于since的事件, 然后推送新事件. 客户端落后过多时连接被关闭, 可以用Last-Event-ID或since重连
+//	@Tags			Events
+//	@Produce		text/event-stream
+//	@Param			cmd		query		string	false	"DaemonCmd.ID或name注释"
+//	@Param			app		query		string	false	"app注释"
+//	@Param			type	query		string	false	"事件类型, 逗号分隔, 例如state,restart,limitReached,health,reload,action"
+//	@Param			since	query		int		false	"只推送seq大于since的事件, 默认只推送新事件"
+//	@Success		200		{object}	daemon.Event
+//	@Failure		400		{object}	SvcManagerResponse
+//	@Router			/api/v1/events [get]
+func StreamEvents(svcManager SvcManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		request, err := DecodeEventsRequest(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, SvcManagerResponse{Err: err.Error()})
+			return
+		}
+		req := request.(EventsRequest)
+		// 未指定since时只推送新事件
+		if c.Query("since") == "" && c.GetHeader("Last-Event-ID") == "" {
+			req.Since = ^uint64(0)
+		}
+		history, events, cancel := svcManager.SubscribeEvents(req.Filter, req.Since)
+		defer cancel()
+
+		if c.IsWebsocket() {
+			websocket.Server{Handler: func(ws *websocket.Conn) {
+				serveEventsWebsocket(ws, history, events)
+			}}.ServeHTTP(c.Writer, c.Request)
+			return
+		}
+		serveEventsSSE(c, history, events)
+	}
+}
+
+// serveEventsSSE write history and events as server-sent events until the client disconnects
+// or events is closed
+func serveEventsSSE(c *gin.Context, history []daemon.Event, events <-chan daemon.Event) {
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // 禁止nginx缓冲
+	w.WriteHeader(http.StatusOK)
+
+	write := func(e daemon.Event) error {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, b); err != nil {
+			return err
+		}
+		w.Flush()
+		return nil
+	}
+	for _, e := range history {
+		if write(e) != nil {
+			return
+		}
+	}
+	w.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if write(e) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			w.Flush()
+		}
+	}
+}
+
+// serveEventsWebsocket send history and events as JSON text messages until the client closes
+// the connection or events is closed
+func serveEventsWebsocket(ws *websocket.Conn, history []daemon.Event, events <-chan daemon.Event) {
+	defer ws.Close()
+	// 客户端不发送消息, 读取只用于检测连接关闭
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		io.Copy(io.Discard, ws)
+	}()
+
+	for _, e := range history {
+		if websocket.JSON.Send(ws, e) != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case <-closed:
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if websocket.JSON.Send(ws, e) != nil {
+				return
+			}
+		}
+	}
+}
+
+// RegisterEventRoutes register the event stream and history routes on r
+func RegisterEventRoutes(r gin.IRouter, svcManager SvcManager) {
+	r.GET("/api/v1/events", StreamEvents(svcManager))
+	r.GET("/api/v1/events/history", NewGinHandler(MakeEventsEndpoint(svcManager), DecodeEventsRequest))
+}
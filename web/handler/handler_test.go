@@ -1,10 +1,28 @@
 package handler
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/sq325/cmdDaemon/config"
+	"github.com/sq325/cmdDaemon/daemon"
+	"github.com/sq325/cmdDaemon/internal/tool"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
 )
 
 func TestPortCmdMap(t *testing.T) {
@@ -25,3 +43,738 @@ func TestPortCmdMap(t *testing.T) {
 		t.Log(i, len(lineSlice), lineSlice[len(lineSlice)-2])
 	}
 }
+
+func TestHandler_HealthAndReady(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newDcmd := func(name string, critical bool, args ...string) *daemon.DaemonCmd {
+		return daemon.NewDaemonCmd(ctx, exec.Command(args[0], args[1:]...),
+			map[string]string{daemon.AnnotationsNameKey: name},
+			daemon.WithCmdConf(config.CmdConf{Restart: config.RestartNever, Critical: critical}))
+	}
+	running := newDcmd("running", true, "sleep", "100")
+	exited := newDcmd("exited", false, "false")
+
+	d := daemon.NewDaemon(ctx, []*daemon.DaemonCmd{running, exited}, slog.Default())
+	daemon.WithCmdLogDir("")(d)
+	go d.Run()
+	defer d.Stop(context.Background())
+
+	deadline := time.Now().Add(3 * time.Second)
+	for running.State() != daemon.Running || exited.State() != daemon.Exited {
+		if time.Now().After(deadline) {
+			t.Fatalf("states = %v, %v", running.State(), exited.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	h := NewSvcManager(slog.Default(), d)
+	health := h.Health()
+	if !health.OK() || len(health.Failing) != 1 || health.Failing[0].Name != "exited" {
+		t.Errorf("Health() = %+v, want ok with exited failing", health)
+	}
+
+	// 只有running是critical的, exited不影响就绪
+	ready := h.Ready()
+	if !ready.OK() || len(ready.Failing) != 1 || ready.Failing[0].Critical {
+		t.Errorf("Ready() = %+v, want ok with non-critical exited failing", ready)
+	}
+
+	// 没有critical的cmd时, 所有cmd都是critical, 但按重启策略不再重启的exited除外
+	pending := newDcmd("pending", false, "sleep", "100")
+	h = NewSvcManager(slog.Default(), daemon.NewDaemon(ctx, []*daemon.DaemonCmd{exited, pending}, slog.Default()))
+	ready = h.Ready()
+	if ready.OK() || len(ready.Failing) != 2 || ready.Failing[0].Critical || ready.Failing[0].Err == "" || !ready.Failing[1].Critical {
+		t.Errorf("Ready() = %+v, want fail with non-critical exited and critical pending failing", ready)
+	}
+
+	// 手动停止的cmd也不影响就绪
+	d2 := daemon.NewDaemon(ctx, []*daemon.DaemonCmd{pending, exited}, slog.Default())
+	daemon.WithCmdLogDir("")(d2)
+	if err := d2.StartCmd(pending); err != nil {
+		t.Fatal(err)
+	}
+	for pending.State() != daemon.Running {
+		if time.Now().After(deadline) {
+			t.Fatalf("pending state = %v", pending.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := pending.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h = NewSvcManager(slog.Default(), d2)
+	ready = h.Ready()
+	if !ready.OK() || len(ready.Failing) != 2 {
+		t.Errorf("Ready() = %+v, want ok with non-critical stopped and exited failing", ready)
+	}
+
+	// 放弃重启的cmd使存活检查失败
+	fatal := daemon.NewDaemonCmd(ctx, exec.Command("false"), map[string]string{daemon.AnnotationsNameKey: "fatal"},
+		daemon.WithCmdConf(config.CmdConf{LimiterConf: config.LimiterConf{RestartLimit: tool.Ptr(0), Cooldown: tool.Ptr(time.Duration(0))}}))
+	d3 := daemon.NewDaemon(ctx, []*daemon.DaemonCmd{fatal}, slog.Default())
+	daemon.WithCmdLogDir("")(d3)
+	go d3.Run()
+	defer d3.Stop(context.Background())
+	for fatal.State() != daemon.Fatal {
+		if time.Now().After(deadline) {
+			t.Fatalf("fatal state = %v", fatal.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	health = NewSvcManager(slog.Default(), d3).Health()
+	if health.OK() || len(health.Failing) != 1 || health.Failing[0].Name != "fatal" {
+		t.Errorf("Health() = %+v, want fail with fatal failing", health)
+	}
+	gin.SetMode(gin.TestMode)
+	mux := gin.New()
+	mux.GET("/health", NewGinHandler(MakeHealthEndpoint(NewSvcManager(slog.Default(), d3)), DecodeSvcManagerRequest))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /health code = %d, want 503", w.Code)
+	}
+}
+
+func TestHandler_ConfigDiff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conf, err := config.Unmarshal([]byte(`cmds:
+  - cmd: sleep
+    args: ["100"]
+    annotations:
+      name: sleeper
+  - cmd: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcmds, err := daemon.NewDaemonCmds(ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := daemon.NewDaemon(ctx, dcmds, slog.Default())
+
+	file := filepath.Join(t.TempDir(), "daemon.yml")
+	if err := os.WriteFile(file, []byte(`cmds:
+  - cmd: sleep
+    args: ["100"]
+    annotations:
+      name: sleeper
+      app: demo
+  - cmd: false
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := NewSvcManager(slog.Default(), d, WithConfigFile(file))
+
+	// 未指定配置时读取配置文件
+	diff, err := h.ConfigDiff(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Added) != 1 || len(diff.Removed) != 1 || len(diff.Changed) != 1 || len(diff.Unchanged) != 0 {
+		t.Fatalf("ConfigDiff(nil) = %+v, want false added, true removed, sleeper changed", diff)
+	}
+	if a := diff.Changed[0].Annotations; len(a) != 1 || a[0].Key != "app" || a[0].New != "demo" {
+		t.Errorf("Changed annotations = %+v, want app added", a)
+	}
+
+	diff, err = h.ConfigDiff([]byte(`cmds:
+  - cmd: sleep
+    args: ["100"]
+    annotations:
+      name: sleeper
+  - cmd: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Empty() || len(diff.Unchanged) != 2 {
+		t.Errorf("ConfigDiff(same) = %+v, want 2 unchanged", diff)
+	}
+
+	if _, err := h.ConfigDiff([]byte("cmds: [")); err == nil {
+		t.Error("ConfigDiff(invalid yaml) error = nil")
+	}
+	if _, err := h.ConfigDiff([]byte("cmds:\n  - cmd: a\n    dependsOn: [b]\n")); err == nil {
+		t.Error("ConfigDiff(unknown dependency) error = nil")
+	}
+
+	gin.SetMode(gin.TestMode)
+	mux := gin.New()
+	mux.Any("/api/config/diff", NewGinHandler(MakeConfigDiffEndpoint(h), DecodeConfigDiffRequest))
+	do := func(method, body string) (int, config.ConfDiff) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, "/api/config/diff", strings.NewReader(body)))
+		var diff config.ConfDiff
+		json.Unmarshal(w.Body.Bytes(), &diff)
+		return w.Code, diff
+	}
+	if code, diff := do(http.MethodGet, ""); code != http.StatusOK || len(diff.Changed) != 1 {
+		t.Errorf("GET diff = %d, %+v, want 200 with sleeper changed", code, diff)
+	}
+	if code, _ := do(http.MethodPost, "cmds: ["); code != http.StatusBadRequest {
+		t.Errorf("POST invalid config code = %d, want 400", code)
+	}
+}
+
+func TestRegisterCmdRoutes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sleeper := daemon.NewDaemonCmd(ctx, exec.Command("sleep", "100"),
+		map[string]string{daemon.AnnotationsNameKey: "sleeper"},
+		daemon.WithCmdConf(config.CmdConf{Restart: config.RestartNever}))
+	d := daemon.NewDaemon(ctx, []*daemon.DaemonCmd{sleeper}, slog.Default())
+	daemon.WithCmdLogDir("")(d)
+	go d.Run()
+	defer d.Stop(context.Background())
+
+	gin.SetMode(gin.TestMode)
+	mux := gin.New()
+	svc := NewSvcManager(slog.Default(), d)
+	RegisterCmdRoutes(mux, svc)
+	RegisterAdminRoutes(mux, svc)
+	put := func(path string) (int, CmdResponse) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPut, path, nil))
+		var resp CmdResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	waitState := func(want daemon.State) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for sleeper.State() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("State() = %v, want %v", sleeper.State(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitState(daemon.Running)
+
+	tests := []struct {
+		path  string
+		code  int
+		state string // 为空时不检查
+	}{
+		{"/api/v1/cmds/nope/stop", http.StatusNotFound, ""},
+		{"/api/v1/cmds/sleeper/signal?sig=BOGUS", http.StatusBadRequest, ""},
+		{"/api/v1/cmds/sleeper/signal?sig=CONT", http.StatusOK, "running"},
+		{"/api/v1/cmds/sleeper/log/reopen", http.StatusConflict, "running"}, // 未配置日志目录
+		{"/api/v1/logs/reopen", http.StatusOK, ""},
+		{"/api/v1/cmds/sleeper/stop", http.StatusOK, "stopped"},
+		{"/api/v1/cmds/sleeper/signal?sig=USR1", http.StatusConflict, "stopped"},
+		{"/api/v1/cmds/sleeper/start", http.StatusOK, ""},
+		{"/api/v1/cmds/" + sleeper.CmdHash() + "/restart", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		code, resp := put(tt.path)
+		if code != tt.code {
+			t.Errorf("PUT %s code = %d, want %d, resp %+v", tt.path, code, tt.code, resp)
+		}
+		if tt.state != "" && (resp.Cmd == nil || resp.Cmd.State.String() != tt.state) {
+			t.Errorf("PUT %s cmd = %+v, want state %v", tt.path, resp.Cmd, tt.state)
+		}
+		if strings.HasSuffix(tt.path, "start") || strings.HasSuffix(tt.path, "restart") {
+			waitState(daemon.Running)
+		}
+	}
+
+	// stop和restart各结束一次运行
+	get := func(path string) (int, CmdHistoryResponse) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var resp CmdHistoryResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	code, history := get("/api/v1/cmds/sleeper/history")
+	if code != http.StatusOK || history.ID != sleeper.ID() || len(history.Runs) != 2 ||
+		history.Runs[0].ExitReason != daemon.ExitReasonStopped || history.Runs[1].StartReason != daemon.StartReasonManual {
+		t.Errorf("GET history = %d, %+v", code, history)
+	}
+	if code, _ := get("/api/v1/cmds/nope/history"); code != http.StatusNotFound {
+		t.Errorf("GET history of unknown cmd = %d, want 404", code)
+	}
+}
+
+func TestRegisterCmdRoutes_addAndRemove(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	yml := `cmds:
+  - cmd: sleep
+    args: ["100"]
+    annotations:
+      name: base
+`
+	file := filepath.Join(t.TempDir(), "daemon.yml")
+	if err := os.WriteFile(file, []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := config.Unmarshal([]byte(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcmds, err := daemon.NewDaemonCmds(ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := daemon.NewDaemon(ctx, dcmds, slog.Default())
+	daemon.WithCmdLogDir("")(d)
+	go d.Run()
+	defer d.Stop(context.Background())
+
+	gin.SetMode(gin.TestMode)
+	mux := gin.New()
+	RegisterAdminRoutes(mux, NewSvcManager(slog.Default(), d, WithConfigFile(file)))
+	do := func(method, path, body string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := do(http.MethodPost, "/api/v1/cmds?persist=true", `{"cmd": "sleep", "args": ["101"], "annotations": {"name": "app"}}`); code != http.StatusOK {
+		t.Fatalf("POST code = %d", code)
+	}
+	if code := do(http.MethodPost, "/api/v1/cmds", `{"cmd": "sleep", "annotations": {"name": "app"}}`); code != http.StatusConflict {
+		t.Errorf("POST same name code = %d, want 409", code)
+	}
+	if code := do(http.MethodPost, "/api/v1/cmds", `{"cmd": "sleep", "bogus": 1}`); code != http.StatusBadRequest {
+		t.Errorf("POST unknown field code = %d, want 400", code)
+	}
+	if code := do(http.MethodPost, "/api/v1/cmds?persist=maybe", `{"cmd": "sleep"}`); code != http.StatusBadRequest {
+		t.Errorf("POST invalid persist code = %d, want 400", code)
+	}
+	if code := do(http.MethodPost, "/api/v1/cmds", `{"cmd": "sleep", "user": "54321", "group": "54321"}`); code != http.StatusForbidden {
+		t.Errorf("POST user not allowed code = %d, want 403", code)
+	}
+	b, _ := os.ReadFile(file)
+	if c, err := config.Unmarshal(b); err != nil || len(c.Cmds) != 2 {
+		t.Fatalf("config file after POST = %s, %v", b, err)
+	}
+
+	if code := do(http.MethodDelete, "/api/v1/cmds/base?persist=true", ""); code != http.StatusOK {
+		t.Fatalf("DELETE code = %d", code)
+	}
+	if code := do(http.MethodDelete, "/api/v1/cmds/base", ""); code != http.StatusNotFound {
+		t.Errorf("DELETE removed code = %d, want 404", code)
+	}
+	b, _ = os.ReadFile(file)
+	if c, err := config.Unmarshal(b); err != nil || len(c.Cmds) != 1 || c.Cmds[0].Annotations["name"] != "app" {
+		t.Errorf("config file after DELETE = %s, %v", b, err)
+	}
+	if len(d.DCmds) != 1 || d.DCmds[0].ID() != "app" {
+		t.Errorf("DCmds after DELETE = %v", d.DCmds)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name   string
+		token  string
+		remote string
+		auth   string
+		code   int
+	}{
+		{name: "loopback without token", remote: "127.0.0.1:1234", code: http.StatusOK},
+		{name: "ipv6 loopback without token", remote: "[::1]:1234", code: http.StatusOK},
+		{name: "remote without token", remote: "192.0.2.1:1234", code: http.StatusForbidden},
+		{name: "valid token", token: "secret", remote: "192.0.2.1:1234", auth: "Bearer secret", code: http.StatusOK},
+		{name: "invalid token", token: "secret", remote: "127.0.0.1:1234", auth: "Bearer nope", code: http.StatusUnauthorized},
+		{name: "missing token", token: "secret", remote: "127.0.0.1:1234", code: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := gin.New()
+			mux.Use(AdminAuth(tt.token))
+			mux.PUT("/admin", func(c *gin.Context) { c.Status(http.StatusOK) })
+			req := httptest.NewRequest(http.MethodPut, "/admin", nil)
+			req.RemoteAddr = tt.remote
+			req.Header.Set("X-Forwarded-For", "127.0.0.1")
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.code {
+				t.Errorf("code = %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestRegisterCmdRoutes_selector(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conf, err := config.Unmarshal([]byte(`cmds:
+  - cmd: sleep
+    args: ["100"]
+    annotations: {name: a, app: web}
+  - cmd: sleep
+    args: ["101"]
+    annotations: {name: b, app: web}
+  - cmd: sleep
+    args: ["102"]
+    annotations: {name: c, app: db}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcmds, err := daemon.NewDaemonCmds(ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := daemon.NewDaemon(ctx, dcmds, slog.Default())
+	daemon.WithCmdLogDir("")(d)
+	go d.Run()
+	defer d.Stop(context.Background())
+	dcmds = d.GetDCmds()
+	deadline := time.Now().Add(3 * time.Second)
+	for dcmds[0].State() != daemon.Running || dcmds[1].State() != daemon.Running || dcmds[2].State() != daemon.Running {
+		if time.Now().After(deadline) {
+			t.Fatal("cmds not running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dbPid := dcmds[2].Pid()
+
+	gin.SetMode(gin.TestMode)
+	mux := gin.New()
+	RegisterAdminRoutes(mux, NewSvcManager(slog.Default(), d))
+	put := func(path string) (int, CmdsResponse) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPut, path, nil))
+		var resp CmdsResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	tests := []struct {
+		path  string
+		code  int
+		names []string
+	}{
+		{"/api/v1/apps/web/stop?selector=,", http.StatusBadRequest, nil},
+		{"/api/v1/apps/web/stop?selector=app", http.StatusBadRequest, nil},
+		{"/api/v1/apps/none/stop", http.StatusNotFound, nil},
+		{"/api/v1/apps/web/stop?selector=app=db", http.StatusBadRequest, nil},
+		{"/api/v1/apps/web/restart?batch=0", http.StatusBadRequest, nil},
+		{"/api/v1/apps/web/signal?sig=CONT", http.StatusOK, []string{"a", "b"}},
+		{"/api/v1/apps/web/stop?selector=name=a", http.StatusOK, []string{"a"}},
+		{"/api/v1/apps/web/start", http.StatusOK, []string{"a", "b"}},
+		{"/api/v1/apps/web/restart?batch=1&timeout=3s", http.StatusOK, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		code, resp := put(tt.path)
+		if code != tt.code {
+			t.Errorf("PUT %s code = %d, want %d, resp %+v", tt.path, code, tt.code, resp)
+			continue
+		}
+		var names []string
+		for _, c := range resp.Cmds {
+			names = append(names, c.Name)
+		}
+		if tt.names != nil && !slices.Equal(names, tt.names) {
+			t.Errorf("PUT %s cmds = %v, want %v", tt.path, names, tt.names)
+		}
+	}
+	for _, dcmd := range dcmds[:2] {
+		if dcmd.State() != daemon.Running {
+			t.Errorf("%s state = %v after app restart, want running", dcmd.ID(), dcmd.State())
+		}
+	}
+	if dcmds[2].Pid() != dbPid {
+		t.Error("cmd of other app restarted")
+	}
+}
+
+func TestRegisterCmdRoutes_list(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conf, err := config.Unmarshal([]byte(`cmds:
+  - cmd: sleep
+    args: ["100"]
+    annotations: {name: a, app: web}
+  - cmd: sh
+    args: ["-c", "exit 3"]
+    restart: never
+    annotations: {name: b, app: web}
+  - cmd: sleep
+    args: ["102"]
+    annotations: {name: c, app: db}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcmds, err := daemon.NewDaemonCmds(ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := daemon.NewDaemon(ctx, dcmds, slog.Default())
+	daemon.WithCmdLogDir("")(d)
+	go d.Run()
+	defer d.Stop(context.Background())
+	dcmds = d.GetDCmds()
+	deadline := time.Now().Add(3 * time.Second)
+	for dcmds[0].State() != daemon.Running || dcmds[1].State() != daemon.Exited || dcmds[2].State() != daemon.Running {
+		if time.Now().After(deadline) {
+			t.Fatal("cmds not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	gin.SetMode(gin.TestMode)
+	mux := gin.New()
+	RegisterCmdRoutes(mux, NewSvcManager(slog.Default(), d))
+	get := func(path string, resp any) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+			t.Fatalf("GET %s: %v: %s", path, err, w.Body)
+		}
+		return w.Code
+	}
+
+	var list CmdInfosResponse
+	if code := get("/api/v1/cmds", &list); code != http.StatusOK || len(list.Cmds) != 3 {
+		t.Fatalf("GET /api/v1/cmds = %d, %+v", code, list)
+	}
+	for i, name := range []string{"a", "b", "c"} {
+		if list.Cmds[i].Name != name {
+			t.Errorf("cmds[%d].Name = %s, want %s", i, list.Cmds[i].Name, name)
+		}
+	}
+	a, b := list.Cmds[0], list.Cmds[1]
+	if a.State != daemon.Running || a.Pid != dcmds[0].Pid() || a.Ports == nil || a.Uptime == "" ||
+		a.ExitCode != nil || a.Limiter.State != daemon.LimiterOK || a.Annotations["app"] != "web" {
+		t.Errorf("running cmd = %+v", a)
+	}
+	if b.State != daemon.Exited || b.Pid != 0 || b.Uptime != "" || b.ExitCode == nil || *b.ExitCode != 3 || b.Err == "" {
+		t.Errorf("exited cmd = %+v", b)
+	}
+
+	list = CmdInfosResponse{}
+	if code := get("/api/v1/cmds?selector=app=web", &list); code != http.StatusOK || len(list.Cmds) != 2 {
+		t.Errorf("GET /api/v1/cmds?selector=app=web = %d, %+v", code, list)
+	}
+	if code := get("/api/v1/cmds?selector=app", &list); code != http.StatusBadRequest {
+		t.Errorf("GET invalid selector = %d, want 400", code)
+	}
+
+	var one CmdInfoResponse
+	if code := get("/api/v1/cmds/c", &one); code != http.StatusOK || one.Cmd == nil || one.Cmd.ID != dcmds[2].ID() {
+		t.Errorf("GET /api/v1/cmds/c = %d, %+v", code, one)
+	}
+	if code := get("/api/v1/cmds/nope", &one); code != http.StatusNotFound {
+		t.Errorf("GET /api/v1/cmds/nope = %d, want 404", code)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(NewSvcManager(slog.Default(), d).List())), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "- exited ") || !strings.HasSuffix(lines[1], "sh -c exit 3") {
+		t.Errorf("List() = %q", lines)
+	}
+}
+
+func TestRegisterEventRoutes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sleeper := daemon.NewDaemonCmd(ctx, exec.Command("sleep", "100"),
+		map[string]string{daemon.AnnotationsNameKey: "sleeper", daemon.AnnotationsAppKey: "web"})
+	d := daemon.NewDaemon(ctx, []*daemon.DaemonCmd{sleeper}, slog.Default())
+	daemon.WithCmdLogDir("")(d)
+	go d.Run()
+	defer d.Stop(context.Background())
+
+	gin.SetMode(gin.TestMode)
+	mux := gin.New()
+	svc := NewSvcManager(slog.Default(), d)
+	RegisterAdminRoutes(mux, svc)
+	RegisterEventRoutes(mux, svc)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for sleeper.State() != daemon.Running {
+		if time.Now().After(deadline) {
+			t.Fatal("sleeper not running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Get(srv.URL + "/api/v1/events?app=web&type=action,state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %s", ct)
+	}
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/events?cmd=sleeper&since=0", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/api/v1/cmds/sleeper/stop", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT stop = %v, %v", resp, err)
+	}
+
+	// SSE只推送订阅之后的事件
+	scanner := bufio.NewScanner(resp.Body)
+	var sse []string
+	for len(sse) < 3 && scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var e daemon.Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Fatal(err)
+		}
+		sse = append(sse, string(e.Type)+":"+e.To+e.Action)
+	}
+	if want := []string{"state:stopping", "state:stopped", "action:stop"}; !slices.Equal(sse, want) {
+		t.Errorf("SSE events = %v, want %v", sse, want)
+	}
+
+	// websocket从since=0开始推送历史事件
+	var wsEvents []string
+	ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for len(wsEvents) < 5 {
+		var e daemon.Event
+		if err := websocket.JSON.Receive(ws, &e); err != nil {
+			t.Fatal(err)
+		}
+		wsEvents = append(wsEvents, string(e.Type)+":"+e.To+e.Action)
+	}
+	if want := []string{"state:starting", "state:running", "state:stopping", "state:stopped", "action:stop"}; !slices.Equal(wsEvents, want) {
+		t.Errorf("websocket events = %v, want %v", wsEvents, want)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/events/history?type=action&limit=1", nil))
+	var history EventsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil || len(history.Events) != 1 || history.Events[0].Action != "stop" {
+		t.Errorf("GET /api/v1/events/history = %s", w.Body)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/events/history?since=x", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GET invalid since = %d, want 400", w.Code)
+	}
+}
+
+func TestCmdLogsHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// 读取stdin的一行后输出, 以便测试follow
+	echo := daemon.NewDaemonCmd(ctx, exec.Command("sh", "-c", "echo a; echo b >&2; echo c; while read l; do echo $l; done"),
+		map[string]string{daemon.AnnotationsNameKey: "echo"},
+		daemon.WithCmdConf(config.CmdConf{Restart: config.RestartNever}))
+	stdin, err := echo.Cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := daemon.NewDaemon(ctx, []*daemon.DaemonCmd{echo}, slog.Default())
+	daemon.WithCmdLogDir("")(d) // 未配置日志目录时也保留最近的行
+	go d.Run()
+	defer d.Stop(context.Background())
+
+	gin.SetMode(gin.TestMode)
+	mux := gin.New()
+	RegisterCmdRoutes(mux, NewSvcManager(slog.Default(), d))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for len(echo.Logs("", -1)) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Logs() = %+v", echo.Logs("", -1))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	get := func(path string) (int, CmdLogsResponse) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var resp CmdLogsResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	lineText := func(lines []daemon.LogLine) []string {
+		var s []string
+		for _, l := range lines {
+			s = append(s, l.Stream+":"+l.Line)
+		}
+		return s
+	}
+	if code, resp := get("/api/v1/cmds/echo/logs?stream=stdout&tail=1"); code != http.StatusOK || resp.ID != echo.ID() ||
+		!slices.Equal(lineText(resp.Lines), []string{"stdout:c"}) {
+		t.Errorf("GET logs?stream=stdout&tail=1 = %d, %+v", code, resp)
+	}
+	if code, resp := get("/api/v1/cmds/echo/logs?stream=stderr"); code != http.StatusOK || !slices.Equal(lineText(resp.Lines), []string{"stderr:b"}) {
+		t.Errorf("GET logs?stream=stderr = %d, %+v", code, resp)
+	}
+	for path, want := range map[string]int{
+		"/api/v1/cmds/nope/logs":             http.StatusNotFound,
+		"/api/v1/cmds/nope/logs?follow=true": http.StatusNotFound,
+		"/api/v1/cmds/echo/logs?stream=x":    http.StatusBadRequest,
+		"/api/v1/cmds/echo/logs?tail=-1":     http.StatusBadRequest,
+	} {
+		if code, _ := get(path); code != want {
+			t.Errorf("GET %s = %d, want %d", path, code, want)
+		}
+	}
+
+	// 分块传输的JSON行
+	resp, err := http.Get(srv.URL + "/api/v1/cmds/echo/logs?follow=true&tail=1&stream=stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Content-Type = %s", ct)
+	}
+	// SSE
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/cmds/echo/logs?follow=true&tail=0", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	sseResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sseResp.Body.Close()
+	if ct := sseResp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %s", ct)
+	}
+	io.WriteString(stdin, "d\n")
+
+	dec := json.NewDecoder(resp.Body)
+	var chunked []daemon.LogLine
+	for len(chunked) < 2 {
+		var l daemon.LogLine
+		if err := dec.Decode(&l); err != nil {
+			t.Fatal(err)
+		}
+		chunked = append(chunked, l)
+	}
+	if got := lineText(chunked); !slices.Equal(got, []string{"stdout:c", "stdout:d"}) {
+		t.Errorf("chunked lines = %v", got)
+	}
+
+	scanner := bufio.NewScanner(sseResp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var l daemon.LogLine
+		if err := json.Unmarshal([]byte(data), &l); err != nil || l.Line != "d" || l.Seq != chunked[1].Seq {
+			t.Errorf("SSE line = %s, err %v", data, err)
+		}
+		break
+	}
+}
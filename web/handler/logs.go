@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sq325/cmdDaemon/daemon"
+)
+
+// DefaultLogTail is the number of latest lines returned by /api/v1/cmds/{id}/logs without tail
+const DefaultLogTail = 100
+
+// CmdLogsRequest is the request of /api/v1/cmds/{id}/logs
+type CmdLogsRequest struct {
+	ID     string
+	Stream string // stdout或stderr, 为空表示全部
+	Tail   int
+	Follow bool
+}
+
+// DecodeCmdLogsRequest decode the :id path param and the tail, stream and follow query params
+func DecodeCmdLogsRequest(c *gin.Context) (interface{}, error) {
+	req := CmdLogsRequest{ID: c.Param("id"), Stream: c.Query("stream")}
+	switch req.Stream {
+	case "", daemon.StreamStdout, daemon.StreamStderr:
+	default:
+		return nil, fmt.Errorf("invalid stream %q, must be %s or %s", req.Stream, daemon.StreamStdout, daemon.StreamStderr)
+	}
+	tail, err := strconv.Atoi(c.DefaultQuery("tail", strconv.Itoa(DefaultLogTail)))
+	if err != nil || tail < 0 {
+		return nil, fmt.Errorf("invalid tail %q, want a non-negative integer", c.Query("tail"))
+	}
+	req.Tail = tail
+	if req.Follow, err = strconv.ParseBool(c.DefaultQuery("follow", "false")); err != nil {
+		return nil, fmt.Errorf("invalid follow: %w", err)
+	}
+	return req, nil
+}
+
+// CmdLogsHandler serve the latest output lines of a cmd as JSON, see MakeCmdLogsEndpoint.
+// With follow=true the following lines are streamed until the client disconnects:
+// as server-sent events if the client accepts text/event-stream, otherwise as chunked JSON lines
+func CmdLogsHandler(svcManager SvcManager) gin.HandlerFunc {
+	tail := NewGinHandler(MakeCmdLogsEndpoint(svcManager), DecodeCmdLogsRequest)
+	return func(c *gin.Context) {
+		request, err := DecodeCmdLogsRequest(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, SvcManagerResponse{Err: err.Error()})
+			return
+		}
+		req := request.(CmdLogsRequest)
+		if !req.Follow {
+			tail(c)
+			return
+		}
+		logs, lines, cancel, err := svcManager.SubscribeCmdLogs(req.ID, req.Stream, req.Tail)
+		if err != nil {
+			c.JSON(errStatusCode(err), CmdLogsResponse{Err: err.Error()})
+			return
+		}
+		defer cancel()
+		if strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+			serveLogsSSE(c, logs.Lines, lines)
+			return
+		}
+		serveLogsChunked(c, logs.Lines, lines)
+	}
+}
+
+// serveLogsSSE write history and lines as server-sent events until the client disconnects
+// or lines is closed
+func serveLogsSSE(c *gin.Context, history []daemon.LogLine, lines <-chan daemon.LogLine) {
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // 禁止nginx缓冲
+	w.WriteHeader(http.StatusOK)
+	streamLogs(c, history, lines, func(l daemon.LogLine) error {
+		b, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", l.Seq, l.Stream, b)
+		return err
+	}, ": ping\n\n")
+}
+
+// serveLogsChunked write history and lines as JSON lines until the client disconnects or lines is closed
+func serveLogsChunked(c *gin.Context, history []daemon.LogLine, lines <-chan daemon.LogLine) {
+	w := c.Writer
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	streamLogs(c, history, lines, func(l daemon.LogLine) error { return enc.Encode(l) }, "\n")
+}
+
+// streamLogs write history and lines with write, flushing after each line, and write ping
+// every eventsHeartbeat so proxies do not close the idle connection
+func streamLogs(c *gin.Context, history []daemon.LogLine, lines <-chan daemon.LogLine, write func(daemon.LogLine) error, ping string) {
+	w := c.Writer
+	for _, l := range history {
+		if write(l) != nil {
+			return
+		}
+	}
+	w.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case l, ok := <-lines:
+			if !ok {
+				return
+			}
+			if write(l) != nil {
+				return
+			}
+			w.Flush()
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ping); err != nil {
+				return
+			}
+			w.Flush()
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -9,39 +10,172 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/sq325/cmdDaemon/config"
 	"github.com/sq325/cmdDaemon/daemon"
 	"github.com/sq325/cmdDaemon/internal/tool"
 
 	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v2"
 )
 
 type SvcManager interface {
-	Restart() error // restart daemon process and child processes
-	Reload() error  // reload child processes
-	List() []byte   // list all port and cmd
-	Update() error  // update config file
-	Stop() error    // stop daemon process
-	Health() bool   // check health
+	Restart() error       // restart daemon process and child processes
+	Reload() error        // reload child processes
+	List() []byte         // list "port state cmd" of all cmds, deprecated, use Cmds
+	Update() error        // update config file
+	Stop() error          // stop daemon process
+	Health() HealthReport // daemon liveness, fail if any cmd gave up restarting, list failing cmds
+	Ready() HealthReport  // daemon readiness, all critical cmds running and healthy
+
+	ConfigDiff(conf []byte) (*config.ConfDiff, error) // diff conf with the running config without reloading
+
+	StartCmd(id string) (CmdStatus, error)                        // start a stopped or exited cmd
+	StopCmd(ctx context.Context, id string) (CmdStatus, error)    // stop a cmd, the daemon does not restart it
+	RestartCmd(ctx context.Context, id string) (CmdStatus, error) // stop and start a cmd
+	SignalCmd(id string, sig syscall.Signal) (CmdStatus, error)   // send sig to the process group of a cmd
+	ReopenLog(id string) (CmdStatus, error)                       // reopen the log file of a running cmd
+	RotateLog(id string) (CmdStatus, error)                       // rotate the log file of a running cmd
+	ReopenLogs() error                                            // reopen the log files of all running cmds
+
+	AddCmd(spec []byte, persist bool) (CmdStatus, error)                       // add and start a cmd, optionally append it to the config file
+	RemoveCmd(ctx context.Context, id string, persist bool) (CmdStatus, error) // stop and remove a cmd, optionally remove it from the config file
+
+	StartCmds(selector string) ([]CmdStatus, error)                                                          // start cmds matching selector
+	StopCmds(ctx context.Context, selector string) ([]CmdStatus, error)                                      // stop cmds matching selector
+	RestartCmds(ctx context.Context, selector string, batch int, timeout time.Duration) ([]CmdStatus, error) // rolling restart cmds matching selector
+	SignalCmds(selector string, sig syscall.Signal) ([]CmdStatus, error)                                     // send sig to running cmds matching selector
+
+	Cmds(selector string) ([]CmdInfo, error)  // list cmds matching selector, all cmds if selector is empty
+	Cmd(id string) (CmdInfo, error)           // get the cmd identified by id
+	CmdHistory(id string) (CmdHistory, error) // finished runs of the cmd identified by id
+
+	CmdLogs(id, stream string, tail int) (CmdLogs, error)                                         // latest output lines of the cmd identified by id
+	SubscribeCmdLogs(id, stream string, tail int) (CmdLogs, <-chan daemon.LogLine, func(), error) // latest output lines and following lines
+
+	Events(filter daemon.EventFilter, since uint64, limit int) []daemon.Event                              // lifecycle events in the history after seq since
+	SubscribeEvents(filter daemon.EventFilter, since uint64) ([]daemon.Event, <-chan daemon.Event, func()) // history after seq since and following events
+
+	Limiters() []LimiterInfo // list restart limiter status of all cmds
+}
+
+// LimiterInfo is the restart limiter status of a cmd
+type LimiterInfo struct {
+	Name string `json:"name"`
+	Cmd  string `json:"cmd"`
+	Hash string `json:"hash"`
+	daemon.LimiterStatus
+}
+
+// Status of HealthReport
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// HealthReport is the response of /health and /ready
+type HealthReport struct {
+	Status  string      `json:"status"`  // ok or fail
+	Failing []CmdStatus `json:"failing"` // cmds not running or unhealthy
+}
+
+// OK report whether the status is ok
+func (r HealthReport) OK() bool {
+	return r.Status == StatusOK
+}
+
+// StatusCode return 503 if the status is not ok
+func (r HealthReport) StatusCode() int {
+	if !r.OK() {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+// CmdStatus is the state and health check result of a cmd
+type CmdStatus struct {
+	ID       string              `json:"id"`
+	Name     string              `json:"name"`
+	Cmd      string              `json:"cmd"`
+	Hash     string              `json:"hash"`
+	State    daemon.State        `json:"state"`
+	Health   daemon.HealthStatus `json:"health"`
+	Critical bool                `json:"critical"`
+	Err      string              `json:"err,omitempty"`
+}
+
+// CmdInfo is the detail of a cmd returned by /api/v1/cmds
+type CmdInfo struct {
+	ID          string               `json:"id"`
+	Name        string               `json:"name"`
+	Cmd         string               `json:"cmd"`
+	Hash        string               `json:"hash"`
+	State       daemon.State         `json:"state"`
+	StateSince  time.Time            `json:"stateSince"`
+	Pid         int                  `json:"pid,omitempty"`      // 0 if not running
+	Ports       []string             `json:"ports"`              // listening ports of pid
+	Uptime      string               `json:"uptime,omitempty"`   // empty if not running
+	Restarts    int                  `json:"restarts"`           // total restarts since the daemon started
+	ExitCode    *int                 `json:"exitCode,omitempty"` // exit code of the last exit, -1 if killed by a signal
+	Err         string               `json:"err,omitempty"`      // reason of the last exit
+	Health      daemon.HealthStatus  `json:"health"`
+	HealthErr   string               `json:"healthErr,omitempty"`
+	LogErr      string               `json:"logErr,omitempty"` // first error writing the log file of the current run
+	Critical    bool                 `json:"critical"`
+	Limiter     daemon.LimiterStatus `json:"limiter"`
+	Annotations map[string]string    `json:"annotations"`
+}
+
+// CmdHistory is the run history of a cmd returned by /api/v1/cmds/{id}/history
+type CmdHistory struct {
+	ID   string             `json:"id"`
+	Name string             `json:"name"`
+	Runs []daemon.RunRecord `json:"runs"` // oldest first
+}
+
+// CmdLogs is the latest output lines of a cmd returned by /api/v1/cmds/{id}/logs
+type CmdLogs struct {
+	ID    string           `json:"id"`
+	Name  string           `json:"name"`
+	Lines []daemon.LogLine `json:"lines"` // oldest first
 }
 
 // Handler implement SvcManager interface
 // Handler 处理reload和restart请求
 type Handler struct {
-	logger *slog.Logger
-	Daemon *daemon.Daemon
+	logger     *slog.Logger
+	configFile string     // daemon配置文件
+	persistMu  sync.Mutex // 串行化对配置文件的修改
+	Daemon     *daemon.Daemon
 }
 
 var _ SvcManager = (*Handler)(nil)
 
 // NewHandler create a new Handler
-func NewSvcManager(logger *slog.Logger, d *daemon.Daemon) SvcManager {
-	return &Handler{
-		logger: logger,
-		Daemon: d,
+func NewSvcManager(logger *slog.Logger, d *daemon.Daemon, opts ...HandlerFunc) SvcManager {
+	h := &Handler{
+		logger:     logger,
+		configFile: "./daemon.yml",
+		Daemon:     d,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+type HandlerFunc func(h *Handler)
+
+// WithConfigFile set the config file read by ConfigDiff, default ./daemon.yml
+func WithConfigFile(file string) HandlerFunc {
+	return func(h *Handler) {
+		h.configFile = file
 	}
 }
 
@@ -51,55 +185,152 @@ func (h *Handler) Restart() error {
 
 func (h *Handler) Reload() error {
 
-	if len(h.Daemon.DCmds) == 0 {
+	if len(h.Daemon.GetDCmds()) == 0 {
 		return errors.New("no child processes")
 	}
 
 	var errs error
-	for _, dcmd := range h.Daemon.DCmds {
-		if dcmd.Status == daemon.Exited {
+	for _, dcmd := range h.Daemon.GetDCmds() {
+		if dcmd.State() != daemon.Running {
 			continue
 		}
-		pid := dcmd.Cmd.Process.Pid
-		err := syscall.Kill(pid, syscall.SIGHUP) // send HUP sig
+		err := dcmd.Signal(syscall.SIGHUP) // send HUP sig to the process group
+		h.publishAction(dcmd, "reload", err)
 		if err != nil {
-			errtmp := fmt.Errorf("cmd: %s Pid: %d kill failed. %v", dcmd.Cmd.String(), pid, err)
-			errs = errors.Join(errs, errtmp)
+			errs = errors.Join(errs, err)
 		}
 	}
 	return errs
 }
 
+// List list "port state cmd" of all cmds in config order, port is "-" if the cmd does not listen.
+// Ports of a cmd listening on several ports are joined by ",".
+// Deprecated: kept for /list, use Cmds
 func (h *Handler) List() []byte {
-	addrCmd, err := addrCmdMap(h.Daemon.DCmds)
-	if err != nil {
-		h.logger.Error("AddrCmdMap error", "error", err)
-		return nil
-	}
-	if addrCmd == nil {
+	infos, _ := h.Cmds("")
+	if len(infos) == 0 {
 		return nil
 	}
 
 	var bys []byte
-	for addr, cmd := range addrCmd {
-		var port string
-		url, err := url.Parse("http://" + addr)
-		if err != nil {
-			h.logger.Error("Parse addr error", "addr", addr, "error", err)
-			port, err = portFromAddr(addr)
-			if err != nil {
-				h.logger.Error("portFromAddr error", "error", err)
-				bys = append(bys, []byte(addr+" "+cmd+"\n")...)
-				continue
-			}
-			bys = append(bys, []byte(port+" "+cmd+"\n")...)
+	for _, info := range infos {
+		port := "-"
+		if len(info.Ports) > 0 {
+			port = strings.Join(info.Ports, ",")
 		}
-		bys = append(bys, []byte(url.Port()+" "+cmd+"\n")...)
+		bys = append(bys, []byte(port+" "+info.State.String()+" "+info.Cmd+"\n")...)
 	}
 
 	return bys
 }
 
+// Cmds list the cmds matching selector in config order, see daemon.ParseSelector.
+// All cmds are listed if selector is empty
+func (h *Handler) Cmds(selector string) ([]CmdInfo, error) {
+	sel, err := daemon.ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return h.cmdInfos(h.Daemon.Select(sel)), nil
+}
+
+// Cmd get the cmd identified by id, see daemon.Daemon.GetDCmdByID
+func (h *Handler) Cmd(id string) (CmdInfo, error) {
+	dcmd, err := h.Daemon.GetDCmdByID(id)
+	if err != nil {
+		return CmdInfo{}, err
+	}
+	return h.cmdInfos([]*daemon.DaemonCmd{dcmd})[0], nil
+}
+
+// CmdHistory return the finished runs of the cmd identified by id, see daemon.DaemonCmd.History
+func (h *Handler) CmdHistory(id string) (CmdHistory, error) {
+	dcmd, err := h.Daemon.GetDCmdByID(id)
+	if err != nil {
+		return CmdHistory{}, err
+	}
+	return CmdHistory{
+		ID:   dcmd.ID(),
+		Name: dcmd.Annotations[daemon.AnnotationsNameKey],
+		Runs: dcmd.History(),
+	}, nil
+}
+
+// CmdLogs return the latest tail lines of stream of the cmd identified by id, see daemon.DaemonCmd.Logs
+func (h *Handler) CmdLogs(id, stream string, tail int) (CmdLogs, error) {
+	dcmd, err := h.Daemon.GetDCmdByID(id)
+	if err != nil {
+		return CmdLogs{}, err
+	}
+	return CmdLogs{
+		ID:    dcmd.ID(),
+		Name:  dcmd.Annotations[daemon.AnnotationsNameKey],
+		Lines: dcmd.Logs(stream, tail),
+	}, nil
+}
+
+// SubscribeCmdLogs return the latest tail lines of stream of the cmd identified by id,
+// and a channel receiving the following lines, see daemon.DaemonCmd.SubscribeLogs
+func (h *Handler) SubscribeCmdLogs(id, stream string, tail int) (CmdLogs, <-chan daemon.LogLine, func(), error) {
+	dcmd, err := h.Daemon.GetDCmdByID(id)
+	if err != nil {
+		return CmdLogs{}, nil, nil, err
+	}
+	lines, ch, cancel := dcmd.SubscribeLogs(stream, tail)
+	return CmdLogs{ID: dcmd.ID(), Name: dcmd.Annotations[daemon.AnnotationsNameKey], Lines: lines}, ch, cancel, nil
+}
+
+// cmdInfos return the details of dcmds, ports are empty if lsof fails
+func (h *Handler) cmdInfos(dcmds []*daemon.DaemonCmd) []CmdInfo {
+	pidAddrs, err := tool.PidAddrs()
+	if err != nil {
+		h.logger.Error("PidAddrs error", "error", err)
+	}
+	infos := make([]CmdInfo, 0, len(dcmds))
+	for _, dcmd := range dcmds {
+		health, healthErr := dcmd.Health()
+		info := CmdInfo{
+			ID:          dcmd.ID(),
+			Name:        dcmd.Annotations[daemon.AnnotationsNameKey],
+			Cmd:         dcmd.String(),
+			Hash:        dcmd.CmdHash(),
+			State:       dcmd.State(),
+			StateSince:  dcmd.StateSince(),
+			Pid:         dcmd.Pid(),
+			Ports:       []string{},
+			Restarts:    dcmd.Restarts(),
+			Health:      health,
+			Critical:    dcmd.Critical(),
+			Limiter:     dcmd.Limiter.Status(),
+			Annotations: dcmd.Annotations,
+		}
+		if info.Pid > 0 {
+			for _, addr := range pidAddrs[strconv.Itoa(info.Pid)] {
+				if port := tool.Parseport(addr); !slices.Contains(info.Ports, port) {
+					info.Ports = append(info.Ports, port)
+				}
+			}
+		}
+		if uptime := dcmd.Uptime(); uptime > 0 {
+			info.Uptime = uptime.Round(time.Second).String()
+		}
+		if code, ok := dcmd.ExitCode(); ok {
+			info.ExitCode = &code
+		}
+		if err := dcmd.LastErr(); err != nil {
+			info.Err = err.Error()
+		}
+		if healthErr != nil {
+			info.HealthErr = healthErr.Error()
+		}
+		if err := dcmd.LogErr(); err != nil {
+			info.LogErr = err.Error()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
 func (h *Handler) Update() error {
 	err := GitPull()
 	if err != nil {
@@ -115,13 +346,370 @@ func (h *Handler) Stop() error {
 	return syscall.Kill(pid, syscall.SIGTERM)
 }
 
-func (h *Handler) Health() bool {
-	return true
+// Health report the daemon is alive.
+// The status fails if any cmd gave up restarting, which needs a manual start and would not recover by itself.
+// Failing lists cmds waiting to restart, exited, gave up or unhealthy
+func (h *Handler) Health() HealthReport {
+	report := HealthReport{Status: StatusOK, Failing: []CmdStatus{}}
+	for _, dcmd := range h.Daemon.GetDCmds() {
+		status := cmdStatus(dcmd)
+		switch {
+		case status.State == daemon.Fatal:
+			report.Status = StatusFail
+		case status.Health == daemon.HealthUnhealthy:
+		case status.State == daemon.Backoff, status.State == daemon.Exited:
+		default:
+			continue
+		}
+		report.Failing = append(report.Failing, status)
+	}
+	return report
+}
+
+// Ready report whether all critical cmds are running and healthy.
+// If no cmd is critical, all cmds are treated as critical, except the finished ones, see daemon.DaemonCmd.Finished.
+// Failing lists all cmds not ready, including non-critical ones
+func (h *Handler) Ready() HealthReport {
+	report := HealthReport{Status: StatusOK, Failing: []CmdStatus{}}
+	dcmds := h.Daemon.GetDCmds()
+	anyCritical := slices.ContainsFunc(dcmds, (*daemon.DaemonCmd).Critical)
+	for _, dcmd := range dcmds {
+		status := cmdStatus(dcmd)
+		// 没有critical的cmd时, 除了被停止或按重启策略不再重启的cmd, 所有cmd都是critical
+		status.Critical = status.Critical || (!anyCritical && !dcmd.Finished())
+		if status.State == daemon.Running &&
+			(status.Health == daemon.HealthUnknown || status.Health == daemon.HealthHealthy) {
+			continue
+		}
+		if status.Critical {
+			report.Status = StatusFail
+		}
+		report.Failing = append(report.Failing, status)
+	}
+	return report
+}
+
+// ConfigDiff compare conf, the content of a config file, with the running config without reloading,
+// using the same identity rules as reload. The config file is read if conf is empty
+func (h *Handler) ConfigDiff(conf []byte) (*config.ConfDiff, error) {
+	if len(conf) == 0 {
+		var err error
+		conf, err = os.ReadFile(h.configFile)
+		if err != nil {
+			return nil, fmt.Errorf("read config file: %w", err)
+		}
+	}
+	newConf, err := unmarshalConf(conf)
+	if err != nil {
+		return nil, err
+	}
+	return h.Daemon.Diff(newConf)
+}
+
+// unmarshalConf is config.Unmarshal recovering its panic on invalid yaml
+func unmarshalConf(b []byte) (conf *config.Conf, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unmarshal config: %v", r)
+		}
+	}()
+	conf, err = config.Unmarshal(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return conf, nil
+}
+
+// StartCmd start the cmd identified by id, see daemon.Daemon.GetDCmdByID and daemon.Daemon.StartCmd
+func (h *Handler) StartCmd(id string) (CmdStatus, error) {
+	dcmd, err := h.Daemon.GetDCmdByID(id)
+	if err != nil {
+		return CmdStatus{}, err
+	}
+	err = h.Daemon.StartCmd(dcmd)
+	h.publishAction(dcmd, "start", err)
+	return cmdStatus(dcmd), err
+}
+
+// StopCmd stop the cmd identified by id, see daemon.DaemonCmd.Stop.
+// The cmd is stopped even if ctx is canceled, e.g. the client disconnects
+func (h *Handler) StopCmd(ctx context.Context, id string) (CmdStatus, error) {
+	dcmd, err := h.Daemon.GetDCmdByID(id)
+	if err != nil {
+		return CmdStatus{}, err
+	}
+	h.logger.Info("Stopping command", "cmd", dcmd.String())
+	err = dcmd.Stop(context.WithoutCancel(ctx))
+	h.publishAction(dcmd, "stop", err)
+	return cmdStatus(dcmd), err
+}
+
+// RestartCmd restart the cmd identified by id, see daemon.Daemon.RestartCmd
+func (h *Handler) RestartCmd(ctx context.Context, id string) (CmdStatus, error) {
+	dcmd, err := h.Daemon.GetDCmdByID(id)
+	if err != nil {
+		return CmdStatus{}, err
+	}
+	err = h.Daemon.RestartCmd(context.WithoutCancel(ctx), dcmd)
+	h.publishAction(dcmd, "restart", err)
+	return cmdStatus(dcmd), err
+}
+
+// SignalCmd send sig to the process group of the cmd identified by id
+func (h *Handler) SignalCmd(id string, sig syscall.Signal) (CmdStatus, error) {
+	dcmd, err := h.Daemon.GetDCmdByID(id)
+	if err != nil {
+		return CmdStatus{}, err
+	}
+	err = dcmd.Signal(sig)
+	h.publishAction(dcmd, "signal "+tool.SignalName(sig), err)
+	return cmdStatus(dcmd), err
+}
+
+// ReopenLog reopen the log file of the cmd identified by id, see daemon.DaemonCmd.ReopenLog
+func (h *Handler) ReopenLog(id string) (CmdStatus, error) {
+	dcmd, err := h.Daemon.GetDCmdByID(id)
+	if err != nil {
+		return CmdStatus{}, err
+	}
+	err = dcmd.ReopenLog()
+	h.publishAction(dcmd, "reopen log", err)
+	return cmdStatus(dcmd), err
+}
+
+// RotateLog rotate the log file of the cmd identified by id, see daemon.DaemonCmd.RotateLog
+func (h *Handler) RotateLog(id string) (CmdStatus, error) {
+	dcmd, err := h.Daemon.GetDCmdByID(id)
+	if err != nil {
+		return CmdStatus{}, err
+	}
+	err = dcmd.RotateLog()
+	h.publishAction(dcmd, "rotate log", err)
+	return cmdStatus(dcmd), err
+}
+
+// ReopenLogs reopen the log files of all running cmds, see daemon.Daemon.ReopenLogs
+func (h *Handler) ReopenLogs() error {
+	h.logger.Info("Reopening log files")
+	return h.Daemon.ReopenLogs()
+}
+
+// AddCmd parse spec, a yaml or json cmd config, and add it to the daemon, see daemon.Daemon.AddCmd.
+// If persist is true, spec is appended to the config file after the cmd is added
+func (h *Handler) AddCmd(spec []byte, persist bool) (CmdStatus, error) {
+	var c config.CmdConf
+	if err := yaml.UnmarshalStrict(spec, &c); err != nil {
+		return CmdStatus{}, fmt.Errorf("%w: %v", daemon.ErrInvalidConf, err)
+	}
+	if err := h.allowIdentity(&c); err != nil {
+		return CmdStatus{}, err
+	}
+	dcmd, err := h.Daemon.AddCmd(c)
+	if err != nil {
+		return CmdStatus{}, err
+	}
+	h.publishAction(dcmd, "add", nil)
+	if !persist {
+		return cmdStatus(dcmd), nil
+	}
+	h.persistMu.Lock()
+	defer h.persistMu.Unlock()
+	if err := config.AddCmdToFile(h.configFile, spec); err != nil {
+		return cmdStatus(dcmd), fmt.Errorf("cmd added but not persisted to %s: %w", h.configFile, err)
+	}
+	h.logger.Info("Command persisted", "cmd", dcmd.String(), "file", h.configFile)
+	return cmdStatus(dcmd), nil
+}
+
+// allowIdentity check the user, group and groups of c against the api block of the config file,
+// see config.APIConf.Allow. The config file is read on each call, so the allow lists follow its edits
+func (h *Handler) allowIdentity(c *config.CmdConf) error {
+	if c.User == "" && c.Group == "" && len(c.Groups) == 0 {
+		return nil
+	}
+	var conf config.Conf
+	if b, err := os.ReadFile(h.configFile); err == nil {
+		if err := yaml.Unmarshal(b, &conf); err != nil {
+			return fmt.Errorf("parse config file %s: %w", h.configFile, err)
+		}
+	}
+	err := conf.API.Allow(c)
+	if err != nil && !errors.Is(err, config.ErrIdentityNotAllowed) {
+		return fmt.Errorf("%w: %v", daemon.ErrInvalidConf, err)
+	}
+	return err
+}
+
+// RemoveCmd stop and remove the cmd identified by id, see daemon.Daemon.RemoveCmd.
+// If persist is true, the cmd is removed from the config file after it is stopped
+func (h *Handler) RemoveCmd(ctx context.Context, id string, persist bool) (CmdStatus, error) {
+	dcmd, err := h.Daemon.GetDCmdByID(id)
+	if err != nil {
+		return CmdStatus{}, err
+	}
+	err = h.Daemon.RemoveCmd(context.WithoutCancel(ctx), dcmd)
+	h.publishAction(dcmd, "remove", err)
+	if err != nil {
+		return cmdStatus(dcmd), err
+	}
+	if !persist {
+		return cmdStatus(dcmd), nil
+	}
+	h.persistMu.Lock()
+	defer h.persistMu.Unlock()
+	if err := config.RemoveCmdFromFile(h.configFile, dcmd.ID()); err != nil {
+		return cmdStatus(dcmd), fmt.Errorf("cmd removed but not persisted to %s: %w", h.configFile, err)
+	}
+	h.logger.Info("Command removed from config file", "cmd", dcmd.String(), "file", h.configFile)
+	return cmdStatus(dcmd), nil
+}
+
+// selectCmds return the cmds matching selector, see daemon.ParseSelector.
+// Return ErrInvalidSelector if selector is empty, ErrNoCmdFound if no cmd matches
+func (h *Handler) selectCmds(selector string) ([]*daemon.DaemonCmd, error) {
+	sel, err := daemon.ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("%w: empty selector", daemon.ErrInvalidSelector)
+	}
+	dcmds := h.Daemon.Select(sel)
+	if len(dcmds) == 0 {
+		return nil, fmt.Errorf("%w: %s", daemon.ErrNoCmdFound, sel)
+	}
+	return dcmds, nil
+}
+
+func cmdStatuses(dcmds []*daemon.DaemonCmd) []CmdStatus {
+	statuses := make([]CmdStatus, 0, len(dcmds))
+	for _, dcmd := range dcmds {
+		statuses = append(statuses, cmdStatus(dcmd))
+	}
+	return statuses
+}
+
+// StartCmds start the cmds matching selector, running cmds are skipped, see daemon.Daemon.StartCmds
+func (h *Handler) StartCmds(selector string) ([]CmdStatus, error) {
+	dcmds, err := h.selectCmds(selector)
+	if err != nil {
+		return nil, err
+	}
+	err = h.Daemon.StartCmds(dcmds)
+	h.publishActions(dcmds, "start", selector, err)
+	return cmdStatuses(dcmds), err
+}
+
+// StopCmds stop the cmds matching selector in reverse dependency order, see daemon.Daemon.StopCmds
+func (h *Handler) StopCmds(ctx context.Context, selector string) ([]CmdStatus, error) {
+	dcmds, err := h.selectCmds(selector)
+	if err != nil {
+		return nil, err
+	}
+	h.logger.Info("Stopping commands", "selector", selector, "count", len(dcmds))
+	err = h.Daemon.StopCmds(context.WithoutCancel(ctx), dcmds)
+	h.publishActions(dcmds, "stop", selector, err)
+	return cmdStatuses(dcmds), err
+}
+
+// RestartCmds restart the cmds matching selector in batches of batch cmds,
+// each batch waits up to timeout for the cmds to be ready, see daemon.Daemon.RollingRestart
+func (h *Handler) RestartCmds(ctx context.Context, selector string, batch int, timeout time.Duration) ([]CmdStatus, error) {
+	dcmds, err := h.selectCmds(selector)
+	if err != nil {
+		return nil, err
+	}
+	h.logger.Info("Rolling restart commands", "selector", selector, "count", len(dcmds), "batch", batch, "timeout", timeout)
+	err = h.Daemon.RollingRestart(context.WithoutCancel(ctx), dcmds, batch, timeout)
+	h.publishActions(dcmds, "restart", selector, err)
+	return cmdStatuses(dcmds), err
+}
+
+// SignalCmds send sig to the process groups of the running cmds matching selector, other cmds are skipped
+func (h *Handler) SignalCmds(selector string, sig syscall.Signal) ([]CmdStatus, error) {
+	dcmds, err := h.selectCmds(selector)
+	if err != nil {
+		return nil, err
+	}
+	var errs error
+	for _, dcmd := range dcmds {
+		if err := dcmd.Signal(sig); err != nil && !errors.Is(err, daemon.ErrNotRunning) {
+			errs = errors.Join(errs, err)
+		}
+	}
+	h.publishActions(dcmds, "signal "+tool.SignalName(sig), selector, errs)
+	return cmdStatuses(dcmds), errs
+}
+
+// publishAction publish an EventAction of dcmd done through the API
+func (h *Handler) publishAction(dcmd *daemon.DaemonCmd, action string, err error) {
+	e := daemon.NewCmdEvent(dcmd, daemon.EventAction)
+	e.Action = action
+	if err != nil {
+		e.Err = err.Error()
+	}
+	h.Daemon.Events().Publish(e)
+}
+
+// publishActions publish an EventAction for each of dcmds selected by selector,
+// err is the error of the whole operation
+func (h *Handler) publishActions(dcmds []*daemon.DaemonCmd, action, selector string, err error) {
+	for _, dcmd := range dcmds {
+		e := daemon.NewCmdEvent(dcmd, daemon.EventAction)
+		e.Action, e.Message = action, "selector: "+selector
+		if err != nil {
+			e.Err = err.Error()
+		}
+		h.Daemon.Events().Publish(e)
+	}
+}
+
+// Events return the events matching filter with seq greater than since, see daemon.EventBus.History
+func (h *Handler) Events(filter daemon.EventFilter, since uint64, limit int) []daemon.Event {
+	return h.Daemon.Events().History(filter, since, limit)
+}
+
+// SubscribeEvents subscribe to the events matching filter, see daemon.EventBus.Subscribe
+func (h *Handler) SubscribeEvents(filter daemon.EventFilter, since uint64) ([]daemon.Event, <-chan daemon.Event, func()) {
+	return h.Daemon.Events().Subscribe(filter, since)
+}
+
+func cmdStatus(dcmd *daemon.DaemonCmd) CmdStatus {
+	health, healthErr := dcmd.Health()
+	status := CmdStatus{
+		ID:       dcmd.ID(),
+		Name:     dcmd.Annotations[daemon.AnnotationsNameKey],
+		Cmd:      dcmd.String(),
+		Hash:     dcmd.CmdHash(),
+		State:    dcmd.State(),
+		Health:   health,
+		Critical: dcmd.Critical(),
+	}
+	if err := dcmd.LastErr(); err != nil {
+		status.Err = err.Error()
+	}
+	if healthErr != nil {
+		status.Err = healthErr.Error()
+	}
+	return status
+}
+
+func (h *Handler) Limiters() []LimiterInfo {
+	infos := make([]LimiterInfo, 0, len(h.Daemon.GetDCmds()))
+	for _, dcmd := range h.Daemon.GetDCmds() {
+		infos = append(infos, LimiterInfo{
+			Name:          dcmd.Annotations[daemon.AnnotationsNameKey],
+			Cmd:           dcmd.String(),
+			Hash:          dcmd.CmdHash(),
+			LimiterStatus: dcmd.Limiter.Status(),
+		})
+	}
+	return infos
 }
 
 // ListPortAndCmd list all cmd and listen port
 func (h *Handler) ListPortAndCmd(c *gin.Context) {
-	addrCmd, err := addrCmdMap(h.Daemon.DCmds)
+	addrCmd, err := addrCmdMap(h.Daemon.GetDCmds())
 	if err != nil {
 		h.logger.Error("AddrCmdMap error", "error", err)
 		c.Writer.WriteHeader(http.StatusInternalServerError)
@@ -149,7 +737,7 @@ func (h *Handler) ListPortAndCmd(c *gin.Context) {
 	}
 	c.Writer.WriteHeader(http.StatusOK)
 	c.Writer.Write([]byte("--------------------\n"))
-	c.Writer.Write([]byte("All " + strconv.Itoa(len(h.Daemon.DCmds)) + ", List " + strconv.Itoa(len(addrCmd))))
+	c.Writer.Write([]byte("All " + strconv.Itoa(len(h.Daemon.GetDCmds())) + ", List " + strconv.Itoa(len(addrCmd))))
 }
 
 func (h *Handler) UpdateConfig(c *gin.Context) {
@@ -171,7 +759,7 @@ func restart() error {
 
 // Generate consul service config
 func (h *Handler) ConsulSvc(c *gin.Context) {
-	dcmds := h.Daemon.DCmds
+	dcmds := h.Daemon.GetDCmds()
 	if len(dcmds) == 0 {
 		c.Writer.WriteHeader(http.StatusNoContent)
 		c.Writer.Write([]byte("No services"))
@@ -237,13 +825,13 @@ func addrCmdMap(dcmds []*daemon.DaemonCmd) (map[string]string, error) {
 	}
 
 	for _, dcmd := range dcmds {
-		if dcmd.Cmd == nil || dcmd.Cmd.Process == nil {
+		if dcmd.Pid() == 0 {
 			continue
 		}
-		pid := strconv.Itoa(dcmd.Cmd.Process.Pid)
+		pid := strconv.Itoa(dcmd.Pid())
 
 		if addr, ok := pidAddr[pid]; ok {
-			addrCmd[addr] = dcmd.Cmd.String()
+			addrCmd[addr] = dcmd.String()
 		}
 	}
 
@@ -2,8 +2,20 @@ package handler
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/sq325/cmdDaemon/daemon"
+	"github.com/sq325/cmdDaemon/internal/tool"
 )
 
 func EncodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
@@ -13,3 +25,205 @@ func EncodeResponse(_ context.Context, w http.ResponseWriter, response interface
 func DecodeRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	return nil, nil
 }
+
+// StatusCoder is implemented by responses carrying their http status code, default 200
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// GinDecodeRequestFunc extract an endpoint request from a gin request
+type GinDecodeRequestFunc func(c *gin.Context) (interface{}, error)
+
+// NewGinHandler adapt e to a gin handler. A decode error is responded with 400
+func NewGinHandler(e endpoint.Endpoint, dec GinDecodeRequestFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		request, err := dec(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, SvcManagerResponse{Err: err.Error()})
+			return
+		}
+		response, err := e(c.Request.Context(), request)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, SvcManagerResponse{Err: err.Error()})
+			return
+		}
+		code := http.StatusOK
+		if sc, ok := response.(StatusCoder); ok {
+			code = sc.StatusCode()
+		}
+		c.JSON(code, response)
+	}
+}
+
+// DecodeSvcManagerRequest decode a request without params
+func DecodeSvcManagerRequest(c *gin.Context) (interface{}, error) {
+	return SvcManagerRequest{}, nil
+}
+
+// DecodeConfigDiffRequest decode the body as the config to diff, empty to diff the config file
+func DecodeConfigDiffRequest(c *gin.Context) (interface{}, error) {
+	body, err := c.GetRawData()
+	if err != nil {
+		return nil, err
+	}
+	return ConfigDiffRequest{Conf: body}, nil
+}
+
+// DecodeCmdRequest decode the :id path param
+func DecodeCmdRequest(c *gin.Context) (interface{}, error) {
+	return CmdRequest{ID: c.Param("id")}, nil
+}
+
+// DecodeListCmdsRequest decode the optional selector query param
+func DecodeListCmdsRequest(c *gin.Context) (interface{}, error) {
+	return CmdRequest{Selector: c.Query("selector")}, nil
+}
+
+// DecodeSignalCmdRequest decode the :id path param and the sig query param
+func DecodeSignalCmdRequest(c *gin.Context) (interface{}, error) {
+	sig, err := tool.ParseSignal(c.Query("sig"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid sig: %w", err)
+	}
+	return CmdRequest{ID: c.Param("id"), Signal: sig}, nil
+}
+
+// DecodeAddCmdRequest decode the request body as the cmd spec and the persist query param
+func DecodeAddCmdRequest(c *gin.Context) (interface{}, error) {
+	persist, err := decodePersist(c)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := c.GetRawData()
+	if err != nil {
+		return nil, err
+	}
+	if len(spec) == 0 {
+		return nil, errors.New("empty cmd spec")
+	}
+	return CmdRequest{Spec: spec, Persist: persist}, nil
+}
+
+// DecodeRemoveCmdRequest decode the :id path param and the persist query param
+func DecodeRemoveCmdRequest(c *gin.Context) (interface{}, error) {
+	persist, err := decodePersist(c)
+	if err != nil {
+		return nil, err
+	}
+	return CmdRequest{ID: c.Param("id"), Persist: persist}, nil
+}
+
+func decodePersist(c *gin.Context) (bool, error) {
+	persist, err := strconv.ParseBool(c.DefaultQuery("persist", "false"))
+	if err != nil {
+		return false, fmt.Errorf("invalid persist: %w", err)
+	}
+	return persist, nil
+}
+
+// Defaults of rolling restart
+const (
+	DefaultRolloutBatch   = 1
+	DefaultRolloutTimeout = 60 * time.Second
+)
+
+// DecodeSelectorRequest decode the :app path param as the selector app=<app>, the optional selector query param
+// narrowing the cmds of the app, and the rolling restart params batch and timeout
+func DecodeSelectorRequest(c *gin.Context) (interface{}, error) {
+	selector := daemon.AnnotationsAppKey + "=" + c.Param("app")
+	if s, ok := c.GetQuery("selector"); ok {
+		sel, err := daemon.ParseSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		// 例如selector=, 解析后为空, 不能当作没有selector
+		if len(sel) == 0 {
+			return nil, fmt.Errorf("%w: empty selector %q", daemon.ErrInvalidSelector, s)
+		}
+		selector += "," + s
+	}
+	batch, err := strconv.Atoi(c.DefaultQuery("batch", strconv.Itoa(DefaultRolloutBatch)))
+	if err != nil || batch <= 0 {
+		return nil, fmt.Errorf("invalid batch %q, want a positive integer", c.Query("batch"))
+	}
+	timeout, err := time.ParseDuration(c.DefaultQuery("timeout", DefaultRolloutTimeout.String()))
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid timeout %q, want a positive duration", c.Query("timeout"))
+	}
+	return CmdRequest{Selector: selector, Batch: batch, Timeout: timeout}, nil
+}
+
+// DecodeSignalSelectorRequest decode the selector and sig query params
+func DecodeSignalSelectorRequest(c *gin.Context) (interface{}, error) {
+	request, err := DecodeSelectorRequest(c)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := tool.ParseSignal(c.Query("sig"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid sig: %w", err)
+	}
+	req := request.(CmdRequest)
+	req.Signal = sig
+	return req, nil
+}
+
+// RegisterCmdRoutes register the read-only per-cmd api under /api/v1/cmds and the log api.
+// The api changing the state or the set of cmds is registered by RegisterAdminRoutes
+func RegisterCmdRoutes(r gin.IRouter, svcManager SvcManager) {
+	r.GET("/api/v1/cmds", NewGinHandler(MakeListCmdsEndpoint(svcManager), DecodeListCmdsRequest))
+	r.GET("/api/v1/cmds/:id", NewGinHandler(MakeGetCmdEndpoint(svcManager), DecodeCmdRequest))
+	r.GET("/api/v1/cmds/:id/history", NewGinHandler(MakeCmdHistoryEndpoint(svcManager), DecodeCmdRequest))
+	r.GET("/api/v1/cmds/:id/logs", CmdLogsHandler(svcManager))
+
+	cmds := r.Group("/api/v1/cmds/:id")
+	cmds.PUT("/log/reopen", NewGinHandler(MakeReopenLogEndpoint(svcManager), DecodeCmdRequest))
+	cmds.PUT("/log/rotate", NewGinHandler(MakeRotateLogEndpoint(svcManager), DecodeCmdRequest))
+
+	r.PUT("/api/v1/logs/reopen", NewGinHandler(MakeReopenLogsEndpoint(svcManager), DecodeSvcManagerRequest))
+}
+
+// RegisterAdminRoutes register the api adding, removing, starting, stopping and signaling cmds,
+// per cmd under /api/v1/cmds/:id and for the cmds of an app, narrowed by ?selector=, under /api/v1/apps/:app.
+// r should be guarded by AdminAuth
+func RegisterAdminRoutes(r gin.IRouter, svcManager SvcManager) {
+	apps := r.Group("/api/v1/apps/:app")
+	apps.PUT("/start", NewGinHandler(MakeStartCmdsEndpoint(svcManager), DecodeSelectorRequest))
+	apps.PUT("/stop", NewGinHandler(MakeStopCmdsEndpoint(svcManager), DecodeSelectorRequest))
+	apps.PUT("/restart", NewGinHandler(MakeRestartCmdsEndpoint(svcManager), DecodeSelectorRequest))
+	apps.PUT("/signal", NewGinHandler(MakeSignalCmdsEndpoint(svcManager), DecodeSignalSelectorRequest))
+
+	r.POST("/api/v1/cmds", NewGinHandler(MakeAddCmdEndpoint(svcManager), DecodeAddCmdRequest))
+	r.DELETE("/api/v1/cmds/:id", NewGinHandler(MakeRemoveCmdEndpoint(svcManager), DecodeRemoveCmdRequest))
+
+	cmds := r.Group("/api/v1/cmds/:id")
+	cmds.PUT("/start", NewGinHandler(MakeStartCmdEndpoint(svcManager), DecodeCmdRequest))
+	cmds.PUT("/stop", NewGinHandler(MakeStopCmdEndpoint(svcManager), DecodeCmdRequest))
+	cmds.PUT("/restart", NewGinHandler(MakeRestartCmdEndpoint(svcManager), DecodeCmdRequest))
+	cmds.PUT("/signal", NewGinHandler(MakeSignalCmdEndpoint(svcManager), DecodeSignalCmdRequest))
+}
+
+// AdminAuth guard the admin api.
+// If token is set, requests must carry "Authorization: Bearer <token>",
+// otherwise only requests from a loopback address are accepted.
+// The peer address of the connection is used, X-Forwarded-For and similar headers are ignored
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token != "" {
+			auth, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+				c.Header("WWW-Authenticate", "Bearer")
+				c.AbortWithStatusJSON(http.StatusUnauthorized, SvcManagerResponse{Err: "invalid or missing bearer token"})
+				return
+			}
+			c.Next()
+			return
+		}
+		host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			c.AbortWithStatusJSON(http.StatusForbidden, SvcManagerResponse{Err: "admin api is only served to loopback without a token"})
+			return
+		}
+		c.Next()
+	}
+}